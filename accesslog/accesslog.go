@@ -0,0 +1,85 @@
+// Package accesslog records every connection a peer asked the server for when it ends.
+//
+// Records have no user field. All peers share the password of the server, so there is nothing
+// identifying a user; peers are told apart only by their PeerID and the source address of the tunnel.
+package accesslog
+
+import (
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/logger"
+)
+
+// Why a connection ended
+const (
+	ReasonEOF             = "eof"              // Destination closed the connection
+	ReasonPeerClose       = "peer_close"       // Peer closed the connection
+	ReasonReset           = "reset"            // Destination reset the connection
+	ReasonTimeout         = "timeout"          // Blocks of the connection are lost, see options.Options.PacketWaitTimeout
+	ReasonReorderOverflow = "reorder_overflow" // Too many out-of-order blocks
+	ReasonDialError       = "dial_error"       // Cannot dial the destination
+	ReasonDeny            = "deny"             // Dial rejected by access control
+	ReasonError           = "error"            // Other I/O errors
+	ReasonShutdown        = "shutdown"         // The peer is gone
+	ReasonListenError     = "listen_error"     // Cannot listen on the requested address
+	ReasonIdle            = "idle"             // UDP session is idle for options.Options.DatagramSessionTimeout
+)
+
+// What a peer asked the server for
+const (
+	KindConnect = "connect" // Connection dialed by the server
+	KindAccept  = "accept"  // Connection handed to the listener of a server created by server.NewListenerServer
+	KindListen  = "listen"  // Listener for reverse forwarding
+	KindReverse = "reverse" // Connection accepted by a listener for reverse forwarding
+	KindUDP     = "udp"     // UDP session
+)
+
+// Record describes a finished connection, its peer is identified by PeerID and Source since there are no users
+type Record struct {
+	Kind        string
+	PeerID      uint32
+	Source      string // Address of the tunnel of the peer
+	Destination string // Requested by the peer, the first destination of a UDP session
+	Remote      string // Address of the connection accepted for KindReverse
+	BytesIn     int64  // Bytes from the peer to destination
+	BytesOut    int64  // Bytes from destination to the peer
+	Start       time.Time
+	Duration    time.Duration
+	Reason      string
+}
+
+// Logger writes records to a sink, so the format is the same as logger.NewTextSink or logger.NewJSONSink.
+// eg: NewLogger(logger.NewJSONSink(file)) for JSON lines written to a RotatingFile
+type Logger struct {
+	sink logger.Sink
+}
+
+func NewLogger(sink logger.Sink) *Logger {
+	return &Logger{sink: sink}
+}
+
+func (l *Logger) Log(record Record) {
+	fields := make([]logger.Field, 0, 10)
+	fields = append(fields,
+		logger.Field{Key: "kind", Value: record.Kind},
+		logger.Field{Key: "peer_id", Value: record.PeerID},
+		logger.Field{Key: "source", Value: record.Source},
+		logger.Field{Key: "dest", Value: record.Destination},
+	)
+	if record.Remote != "" {
+		fields = append(fields, logger.Field{Key: "remote", Value: record.Remote})
+	}
+	fields = append(fields,
+		logger.Field{Key: "bytes_in", Value: record.BytesIn},
+		logger.Field{Key: "bytes_out", Value: record.BytesOut},
+		logger.Field{Key: "duration_ms", Value: record.Duration.Milliseconds()},
+		logger.Field{Key: "reason", Value: record.Reason},
+	)
+	l.sink.Log(logger.Entry{
+		Time:      record.Start.Add(record.Duration),
+		Level:     logger.LogLevelInfo,
+		Component: "Access",
+		Message:   "Connection closed.",
+		Fields:    fields,
+	})
+}
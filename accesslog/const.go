@@ -0,0 +1,6 @@
+package accesslog
+
+const (
+	DefaultMaxSize    = 100 * 1024 * 1024 // RotatingFile is rotated when it grows larger than this
+	DefaultMaxBackups = 5                 // Rotated files kept by RotatingFile
+)
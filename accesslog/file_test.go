@@ -0,0 +1,85 @@
+package accesslog
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Contents of path and its backups, empty if the file doesn't exist
+func readFiles(t *testing.T, path string, backups int) []string {
+	t.Helper()
+	contents := make([]string, 0, backups+1)
+	for i := 0; i <= backups; i++ {
+		name := path
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", path, i)
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(data))
+	}
+	return contents
+}
+
+func expectFiles(t *testing.T, path string, want ...string) {
+	t.Helper()
+	got := readFiles(t, path, len(want)-1)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Files are %q, want %q.", got, want)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(s string) {
+		t.Helper()
+		if n, err := f.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write %q: %d, %v.", s, n, err)
+		}
+	}
+
+	write("aaaa\n")
+	write("bbbb\n")
+	expectFiles(t, path, "aaaa\nbbbb\n", "")
+	// Writes exceeding the size go to a new file
+	write("cccc\n")
+	expectFiles(t, path, "cccc\n", "aaaa\nbbbb\n", "")
+	write("dddd\n")
+	write("eeee\n")
+	expectFiles(t, path, "eeee\n", "cccc\ndddd\n", "aaaa\nbbbb\n")
+	// The oldest backup is removed
+	write("ffff\n")
+	write("gggg\n")
+	expectFiles(t, path, "gggg\n", "eeee\nffff\n", "cccc\ndddd\n", "")
+	// A write larger than the size isn't split
+	write("hhhhhhhhhhhhhhh\n")
+	expectFiles(t, path, "hhhhhhhhhhhhhhh\n", "gggg\n", "eeee\nffff\n", "")
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("iiii\n")); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Write after Close: %v.", err)
+	}
+
+	// Size of the existing file counts after reopening
+	f, err = OpenRotatingFile(path, 20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	write("jjjj\n")
+	expectFiles(t, path, "jjjj\n", "hhhhhhhhhhhhhhh\n", "gggg\n", "")
+}
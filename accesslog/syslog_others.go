@@ -0,0 +1,15 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package accesslog
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrSyslogNotSupported = errors.New("syslog is not supported on this platform")
+
+func DialSyslog(tag string) (io.WriteCloser, error) {
+	return nil, ErrSyslogNotSupported
+}
@@ -0,0 +1,288 @@
+package bench
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/client"
+	"github.com/ihciah/rabbit-tcp/connection"
+	"github.com/ihciah/rabbit-tcp/options"
+	"github.com/ihciah/rabbit-tcp/tunnel"
+)
+
+// Config of Run, zero fields take default values
+type Config struct {
+	Endpoint   string // Address of the server, which must have the bench target enabled
+	Cipher     tunnel.Cipher
+	Options    *options.Options
+	TunnelNums []int         // Every tunnelN measured
+	Bytes      int64         // Bytes sent by each throughput measurement, split among streams
+	Streams    int           // Concurrent connections of multi-stream throughput
+	Pings      int           // Round trips measured for connect latency and tail latency
+	Timeout    time.Duration // Each measurement fails if not finished within this
+}
+
+func (c *Config) setDefaults() {
+	if c.Bytes == 0 {
+		c.Bytes = DefaultBytes
+	}
+	if c.Streams == 0 {
+		c.Streams = DefaultStreams
+	}
+	if c.Pings == 0 {
+		c.Pings = DefaultPings
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultTimeout
+	}
+}
+
+// Result of a tunnelN
+type Result struct {
+	TunnelNum    int
+	SingleStream float64 // Throughput of one connection, bytes per second
+	MultiStream  float64 // Throughput of all Config.Streams connections
+	ConnectP50   time.Duration
+	ConnectP99   time.Duration // Time to first byte of new connections, including SendConnect
+	RTTP50       time.Duration
+	RTTP99       time.Duration // Round trip time of small writes on an established connection
+	ReorderPeak  int64         // Most out-of-order blocks cached during throughput measurements, only the server's if it's in this process
+	Err          error         // Measurements after the failed one are not taken
+}
+
+// Measure every tunnelN with a new client
+func Run(config Config) []Result {
+	config.setDefaults()
+	results := make([]Result, 0, len(config.TunnelNums))
+	for _, tunnelNum := range config.TunnelNums {
+		c := client.NewClient(tunnelNum, config.Endpoint, config.Cipher, config.Options)
+		result := Result{TunnelNum: tunnelNum}
+		result.Err = measure(&c, &result, &config)
+		c.Close()
+		results = append(results, result)
+	}
+	return results
+}
+
+func measure(c *client.Client, result *Result, config *Config) error {
+	tunnelNum := result.TunnelNum
+	deadline := time.Now().Add(config.Timeout)
+	for c.TunnelCount() < tunnelNum {
+		if time.Now().After(deadline) {
+			return errors.New("tunnels are not established in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	connectTimes := make([]time.Duration, 0, config.Pings)
+	for i := 0; i < config.Pings; i++ {
+		d, err := connectTime(c, config.Timeout)
+		if err != nil {
+			return fmt.Errorf("connect latency: %v", err)
+		}
+		connectTimes = append(connectTimes, d)
+	}
+	result.ConnectP50, result.ConnectP99 = percentile(connectTimes, 0.5), percentile(connectTimes, 0.99)
+
+	rtts, err := roundTrips(c, config.Pings, config.Timeout)
+	if err != nil {
+		return fmt.Errorf("tail latency: %v", err)
+	}
+	result.RTTP50, result.RTTP99 = percentile(rtts, 0.5), percentile(rtts, 0.99)
+
+	stopSampling := sampleReorderPeak(&result.ReorderPeak)
+	defer stopSampling()
+	if result.SingleStream, err = throughput(c, 1, config.Bytes, config.Timeout); err != nil {
+		return fmt.Errorf("single-stream throughput: %v", err)
+	}
+	if result.MultiStream, err = throughput(c, config.Streams, config.Bytes, config.Timeout); err != nil {
+		return fmt.Errorf("multi-stream throughput: %v", err)
+	}
+	return nil
+}
+
+func dial(c *client.Client, mode byte, timeout time.Duration) (connection.HalfOpenConn, error) {
+	conn := c.Dial(TargetAddress)
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte{mode}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Time from dialing to the first byte echoed
+func connectTime(c *client.Client, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn, err := dial(c, modeEcho, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 1)
+	if _, err := conn.Write(buf); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+func roundTrips(c *client.Client, count int, timeout time.Duration) ([]time.Duration, error) {
+	conn, err := dial(c, modeEcho, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, pingSize)
+	rtts := make([]time.Duration, 0, count)
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		if _, err := conn.Write(buf); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	return rtts, nil
+}
+
+// Send bytes in total over streams connections, until the target receives all of them
+func throughput(c *client.Client, streams int, bytes int64, timeout time.Duration) (float64, error) {
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	start := time.Now()
+	for i := 0; i < streams; i++ {
+		size := bytes / int64(streams)
+		if i == 0 {
+			size += bytes % int64(streams)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- sink(c, size, timeout)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return float64(bytes) / elapsed.Seconds(), nil
+}
+
+func sink(c *client.Client, size int64, timeout time.Duration) error {
+	conn, err := dial(c, modeSink, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	chunk := make([]byte, writeChunkSize)
+	for sent := int64(0); sent < size; {
+		n := int64(len(chunk))
+		if size-sent < n {
+			n = size - sent
+		}
+		if _, err := conn.Write(chunk[:n]); err != nil {
+			return err
+		}
+		sent += n
+	}
+	if err := conn.CloseWrite(); err != nil {
+		return err
+	}
+	count := make([]byte, 8)
+	if _, err := io.ReadFull(conn, count); err != nil {
+		return err
+	}
+	if received := int64(binary.LittleEndian.Uint64(count)); received != size {
+		return fmt.Errorf("target received %d bytes of %d", received, size)
+	}
+	return nil
+}
+
+// Record the peak of out-of-order blocks cached in this process to peak, until the returned function is called
+func sampleReorderPeak(peak *int64) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(reorderSampleInterval)
+		defer ticker.Stop()
+		for {
+			if blocks := connection.GetReorderStats().Blocks; blocks > *peak {
+				*peak = blocks
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1)+0.5)]
+}
+
+// Write results as a table, throughput in MB/s, and errors of failed results after it
+func WriteTable(w io.Writer, results []Result, streams int) error {
+	if streams == 0 {
+		streams = DefaultStreams
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "tunnelN\t1-stream MB/s\t%d-stream MB/s\tconnect p50\tconnect p99\trtt p50\trtt p99\treorder peak\t\n", streams)
+	for _, r := range results {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t\n",
+			r.TunnelNum, formatThroughput(r.SingleStream), formatThroughput(r.MultiStream),
+			formatDuration(r.ConnectP50), formatDuration(r.ConnectP99), formatDuration(r.RTTP50), formatDuration(r.RTTP99), r.ReorderPeak)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			if _, err := fmt.Fprintf(w, "tunnelN %d failed: %v\n", r.TunnelNum, r.Err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Values not measured are shown as -
+func formatThroughput(bytesPerSecond float64) string {
+	if bytesPerSecond == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", bytesPerSecond/1e6)
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(10 * time.Microsecond).String()
+}
@@ -0,0 +1,17 @@
+package bench
+
+import "time"
+
+// Servers with the bench target enabled serve connections to this address in-process, see server.Server.EnableBenchTarget
+const TargetAddress = "rabbit-bench.invalid:9"
+
+const (
+	DefaultBytes   = 64 * 1024 * 1024 // Bytes sent by each throughput measurement
+	DefaultStreams = 8                // Concurrent connections of multi-stream throughput
+	DefaultPings   = 100              // Round trips measured for latency
+	DefaultTimeout = 60 * time.Second // Each measurement fails if not finished within this
+	writeChunkSize = 32 * 1024
+	pingSize       = 64
+
+	reorderSampleInterval = 10 * time.Millisecond // Interval of sampling reorder gauges during throughput measurements
+)
@@ -0,0 +1,50 @@
+package bench
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// The first byte of a connection to the target selects how it's served
+const (
+	modeEcho = 'e' // Write back everything
+	modeSink = 's' // Discard everything, and reply the byte count in uint64 after EOF
+)
+
+// Listen on loopback for ServeTarget
+func ListenTarget() (net.Listener, error) {
+	return net.Listen("tcp", "127.0.0.1:0")
+}
+
+// Serve connections of Run from listener, it returns when listener is closed
+func ServeTarget(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveTargetConn(conn)
+	}
+}
+
+func serveTargetConn(conn net.Conn) {
+	defer conn.Close()
+	mode := make([]byte, 1)
+	if _, err := io.ReadFull(conn, mode); err != nil {
+		return
+	}
+	switch mode[0] {
+	case modeEcho:
+		io.Copy(conn, conn)
+	case modeSink:
+		n, err := io.Copy(ioutil.Discard, conn)
+		if err != nil {
+			return
+		}
+		count := make([]byte, 8)
+		binary.LittleEndian.PutUint64(count, uint64(n))
+		conn.Write(count)
+	}
+}
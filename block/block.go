@@ -2,8 +2,11 @@ package block
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 
+	"github.com/ihciah/rabbit-tcp/buffer"
 	"go.uber.org/atomic"
 )
 
@@ -21,51 +24,213 @@ const (
 	MaxSize    = HeaderSize + DataSize
 )
 
+// Types introduced later are numbered after TypeData, without shifting shutdown types
+const (
+	TypeListen = TypeData + 1 + iota
+	TypeDatagram
+	TypeCompressedData // Only on the wire, ReadBlock returns it as TypeData
+	TypeReset          // Abort a connection like TCP RST, BlockData is one of ResetReason
+	TypeAck            // Blocks received by the tunnel pool, only sent if resumption is negotiated
+)
+
+const AckSize = 4
+
+// Why a connection is reset, unknown reasons should be taken as ResetReasonError
+const (
+	ResetReasonError       = iota // Unclassified error
+	ResetReasonPeer               // Real connection reset by peer
+	ResetReasonTimeout            // Timeout of real connection or waiting blocks
+	ResetReasonRefused            // Dialing is refused by destination
+	ResetReasonUnreachable        // Destination can't be resolved or routed
+	ResetReasonDenied             // Dialing is denied by server policy
+)
+
+// Options of a connection, sent along with the address in connect block
+const (
+	ConnectOptionCompress = 1 << iota // Data blocks of both directions may be compressed
+)
+
+var (
+	ErrInvalidDatagram = errors.New("invalid datagram block")
+	ErrUnknownType     = errors.New("unknown block type")
+	ErrBlockTooLarge   = errors.New("block length exceeds limit")
+	ErrInvalidPayload  = errors.New("invalid block payload")
+)
+
+// InvalidBlockError is returned by NewBlockFromReader when the header or payload is malformed.
+// The reader is out of sync after that, so it should be dropped.
+type InvalidBlockError struct {
+	Type        uint8
+	BlockLength uint32
+	Err         error
+}
+
+func (e *InvalidBlockError) Error() string {
+	return fmt.Sprintf("invalid block(type: %d, length: %d): %v", e.Type, e.BlockLength, e.Err)
+}
+
+func (e *InvalidBlockError) Unwrap() error {
+	return e.Err
+}
+
+// Packed blocks and blocks read from reader hold a reference of a pooled buffer.
+// Copies of a Block share the buffer: the last owner should call Release once the block is
+// sent or consumed, and Retain is needed before handing it to one more owner.
+// Blocks never released are simply collected by GC.
 type Block struct {
 	Type         uint8  // 1 byte
 	ConnectionID uint32 // 4 bytes
 	BlockID      uint32 // 4 bytes
 	BlockLength  uint32 // 4 bytes
 	BlockData    []byte
+	Seq          uint32 // Sequence in the sending tunnel pool, assigned when it's first sent if resumption is negotiated
 	packed       []byte
+	buffer       *buffer.Buffer
 }
 
 func (block *Block) Pack() []byte {
 	if block.packed != nil {
 		return block.packed
 	}
-	block.packed = make([]byte, HeaderSize+len(block.BlockData))
+	block.buffer = buffer.Get(HeaderSize + len(block.BlockData))
+	block.packed = block.buffer.Bytes
+	block.putHeader()
+	copy(block.packed[HeaderSize:], block.BlockData)
+	// BlockData shouldn't refer to memory of the caller any more
+	block.BlockData = block.packed[HeaderSize:]
+	return block.packed
+}
+
+func (block *Block) putHeader() {
 	block.packed[0] = block.Type
 	binary.LittleEndian.PutUint32(block.packed[1:], block.ConnectionID)
 	binary.LittleEndian.PutUint32(block.packed[5:], block.BlockID)
 	binary.LittleEndian.PutUint32(block.packed[9:], block.BlockLength)
-	copy(block.packed[HeaderSize:], block.BlockData)
-	return block.packed
+}
+
+func (block *Block) Retain() {
+	if block.buffer != nil {
+		block.buffer.Retain()
+	}
+}
+
+// Release the buffer of the block, BlockData must not be used after that
+func (block *Block) Release() {
+	if block.buffer != nil {
+		block.buffer.Release()
+	}
 }
 
 func NewBlockFromReader(reader io.Reader) (*Block, error) {
-	headerBuf := make([]byte, HeaderSize)
 	block := Block{}
+	if err := ReadBlock(reader, &block); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// Like NewBlockFromReader, but read into the given block to avoid allocation
+func ReadBlock(reader io.Reader, block *Block) error {
+	buf := buffer.Get(MaxSize)
+	headerBuf := buf.Bytes[:HeaderSize]
 	_, err := io.ReadFull(reader, headerBuf)
 	if err != nil {
-		return nil, err
+		buf.Release()
+		return err
 	}
 	block.Type = headerBuf[0]
 	block.ConnectionID = binary.LittleEndian.Uint32(headerBuf[1:])
 	block.BlockID = binary.LittleEndian.Uint32(headerBuf[5:])
 	block.BlockLength = binary.LittleEndian.Uint32(headerBuf[9:])
-	block.BlockData = make([]byte, block.BlockLength)
+	if err := block.validateHeader(); err != nil {
+		buf.Release()
+		return &InvalidBlockError{Type: block.Type, BlockLength: block.BlockLength, Err: err}
+	}
+	block.packed = buf.Bytes[:HeaderSize+block.BlockLength]
+	block.BlockData = block.packed[HeaderSize:]
 	if block.BlockLength > 0 {
 		_, err = io.ReadFull(reader, block.BlockData)
 		if err != nil {
-			return nil, err
+			block.packed, block.BlockData = nil, nil
+			buf.Release()
+			return err
 		}
 	}
-	return &block, nil
+	if err := block.validatePayload(); err != nil {
+		block.packed, block.BlockData = nil, nil
+		buf.Release()
+		return &InvalidBlockError{Type: block.Type, BlockLength: block.BlockLength, Err: err}
+	}
+	if block.Type == TypeCompressedData {
+		decompressed, err := block.decompress(buf)
+		if err != nil {
+			block.packed, block.BlockData = nil, nil
+			buf.Release()
+			return &InvalidBlockError{Type: block.Type, BlockLength: block.BlockLength, Err: err}
+		}
+		buf = decompressed
+	}
+	block.buffer = buf
+	return nil
+}
+
+// Check type and length before anything is allocated for the payload
+func (block *Block) validateHeader() error {
+	switch block.Type {
+	case TypeConnect, TypeDisconnect, TypeData, TypeListen, TypeDatagram, TypeCompressedData, TypeReset, TypeAck:
+	default:
+		return ErrUnknownType
+	}
+	if block.BlockLength > DataSize {
+		return ErrBlockTooLarge
+	}
+	return nil
+}
+
+// Check invariants of payload relied on by its consumers
+func (block *Block) validatePayload() error {
+	switch block.Type {
+	case TypeConnect, TypeListen:
+		if block.BlockLength == 0 {
+			return ErrInvalidPayload
+		}
+	case TypeDisconnect:
+		if block.BlockLength != 1 {
+			return ErrInvalidPayload
+		}
+		switch block.BlockData[0] {
+		case ShutdownRead, ShutdownWrite, ShutdownBoth:
+		default:
+			return ErrInvalidPayload
+		}
+	case TypeReset:
+		if block.BlockLength != 1 {
+			return ErrInvalidPayload
+		}
+	case TypeAck:
+		if block.BlockLength != AckSize {
+			return ErrInvalidPayload
+		}
+	case TypeDatagram:
+		if _, _, err := block.ParseDatagram(); err != nil {
+			return ErrInvalidPayload
+		}
+	case TypeCompressedData:
+		return block.validateCompressed()
+	}
+	return nil
 }
 
 func NewConnectBlock(connectID uint32, blockID uint32, address string) Block {
+	return NewConnectBlockWithOptions(connectID, blockID, address, 0)
+}
+
+// Options are appended to the address after a zero byte, which never appears in addresses
+func NewConnectBlockWithOptions(connectID uint32, blockID uint32, address string, options uint8) Block {
 	data := []byte(address)
+	if options != 0 {
+		data = append(data, 0, options)
+	}
 	return Block{
 		Type:         TypeConnect,
 		ConnectionID: connectID,
@@ -75,6 +240,56 @@ func NewConnectBlock(connectID uint32, blockID uint32, address string) Block {
 	}
 }
 
+func NewListenBlock(connectID uint32, blockID uint32, address string) Block {
+	data := []byte(address)
+	return Block{
+		Type:         TypeListen,
+		ConnectionID: connectID,
+		BlockID:      blockID,
+		BlockLength:  uint32(len(data)),
+		BlockData:    data,
+	}
+}
+
+// Split BlockData of a connect block into address and options
+func (block *Block) ParseConnect() (address string, options uint8) {
+	data := block.BlockData
+	if len(data) >= 2 && data[len(data)-2] == 0 {
+		return string(data[:len(data)-2]), data[len(data)-1]
+	}
+	return string(data), 0
+}
+
+// Datagram blocks are delivered without ordering, BlockData is 1 byte address length, address and payload.
+// The address is the destination when sent by client and the source when sent by server.
+func NewDatagramBlock(sessionID uint32, address string, data []byte) (Block, error) {
+	if len(address) > 0xff || 1+len(address)+len(data) > DataSize {
+		return Block{}, ErrInvalidDatagram
+	}
+	blockData := make([]byte, 1+len(address)+len(data))
+	blockData[0] = uint8(len(address))
+	copy(blockData[1:], address)
+	copy(blockData[1+len(address):], data)
+	return Block{
+		Type:         TypeDatagram,
+		ConnectionID: sessionID,
+		BlockLength:  uint32(len(blockData)),
+		BlockData:    blockData,
+	}, nil
+}
+
+// Split BlockData of a datagram block into address and payload
+func (block *Block) ParseDatagram() (address string, data []byte, err error) {
+	if block.Type != TypeDatagram || len(block.BlockData) < 1 {
+		return "", nil, ErrInvalidDatagram
+	}
+	addressEnd := 1 + int(block.BlockData[0])
+	if len(block.BlockData) < addressEnd {
+		return "", nil, ErrInvalidDatagram
+	}
+	return string(block.BlockData[1:addressEnd]), block.BlockData[addressEnd:], nil
+}
+
 func newDataBlock(connectID uint32, blockID uint32, data []byte) Block {
 	// We should copy data now
 	blk := Block{
@@ -89,7 +304,7 @@ func newDataBlock(connectID uint32, blockID uint32, data []byte) Block {
 }
 
 func NewDataBlocks(connectID uint32, blockID *atomic.Uint32, data []byte) []Block {
-	blocks := make([]Block, 0)
+	blocks := make([]Block, 0, (len(data)+DataSize-1)/DataSize)
 	for cursor := 0; cursor < len(data); {
 		end := cursor + DataSize
 		if len(data) < end {
@@ -101,6 +316,31 @@ func NewDataBlocks(connectID uint32, blockID *atomic.Uint32, data []byte) []Bloc
 	return blocks
 }
 
+// Acknowledge that all blocks sequenced before seq are received
+func NewAckBlock(seq uint32) Block {
+	data := make([]byte, AckSize)
+	binary.LittleEndian.PutUint32(data, seq)
+	return Block{
+		Type:        TypeAck,
+		BlockLength: AckSize,
+		BlockData:   data,
+	}
+}
+
+func (block *Block) ParseAck() uint32 {
+	return binary.LittleEndian.Uint32(block.BlockData)
+}
+
+func NewResetBlock(connectID uint32, blockID uint32, reason uint8) Block {
+	return Block{
+		Type:         TypeReset,
+		ConnectionID: connectID,
+		BlockID:      blockID,
+		BlockLength:  1,
+		BlockData:    []byte{reason},
+	}
+}
+
 func NewDisconnectBlock(connectID uint32, blockID uint32, shutdownType uint8) Block {
 	return Block{
 		Type:         TypeDisconnect,
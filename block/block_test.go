@@ -0,0 +1,200 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/golang/snappy"
+	"go.uber.org/atomic"
+)
+
+// Pack a block of typ with data as it is, length is taken from data
+func rawBlock(typ uint8, data []byte) []byte {
+	packed := make([]byte, HeaderSize+len(data))
+	packed[0] = typ
+	binary.LittleEndian.PutUint32(packed[1:], 1)
+	binary.LittleEndian.PutUint32(packed[5:], 2)
+	binary.LittleEndian.PutUint32(packed[9:], uint32(len(data)))
+	copy(packed[HeaderSize:], data)
+	return packed
+}
+
+// Blocks of every type are read back as they are packed, and compressed ones as data blocks
+func TestReadBlock(t *testing.T) {
+	var blockID atomic.Uint32
+	compressible := bytes.Repeat([]byte("rabbit"), 1024)
+	blocks := []Block{
+		NewConnectBlockWithOptions(1, 0, "example.com:443", ConnectOptionCompress),
+		NewListenBlock(1, 0, ":8080"),
+		NewDisconnectBlock(1, 1, ShutdownWrite),
+		NewResetBlock(1, 2, ResetReasonRefused),
+		NewAckBlock(42),
+		NewDataBlocks(1, &blockID, []byte("hello"))[0],
+		NewCompressedDataBlocks(1, &blockID, compressible)[0],
+	}
+	datagram, err := NewDatagramBlock(1, "127.0.0.1:53", []byte("query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks = append(blocks, datagram)
+
+	for _, sent := range blocks {
+		packed := append([]byte(nil), sent.Pack()...)
+		wantType, wantData := sent.Type, sent.BlockData
+		if sent.Type == TypeCompressedData {
+			wantType, wantData = TypeData, compressible
+		}
+		var blk Block
+		if err := ReadBlock(bytes.NewReader(packed), &blk); err != nil {
+			t.Fatalf("block of type %d: %v", sent.Type, err)
+		}
+		if blk.Type != wantType || blk.ConnectionID != sent.ConnectionID || blk.BlockID != sent.BlockID ||
+			int(blk.BlockLength) != len(wantData) || !bytes.Equal(blk.BlockData, wantData) {
+			t.Fatalf("read %+v, want type %d with %d bytes", blk, wantType, len(wantData))
+		}
+		blk.Release()
+		sent.Release()
+	}
+}
+
+func TestReadBlockInvalid(t *testing.T) {
+	oversized := rawBlock(TypeData, nil)
+	binary.LittleEndian.PutUint32(oversized[9:], DataSize+1)
+	tooLarge := snappy.Encode(nil, make([]byte, DataSize+1))
+	corrupted := snappy.Encode(nil, bytes.Repeat([]byte("rabbit"), 100))
+	corrupted = corrupted[:len(corrupted)-3]
+
+	for _, c := range []struct {
+		name  string
+		input []byte
+		err   error // Wrapped by InvalidBlockError if it's not an io error
+	}{
+		{"empty", nil, io.EOF},
+		{"truncated header", rawBlock(TypeData, nil)[:HeaderSize-1], io.ErrUnexpectedEOF},
+		{"truncated payload", rawBlock(TypeData, []byte("hello"))[:HeaderSize+2], io.ErrUnexpectedEOF},
+		{"missing payload", rawBlock(TypeData, []byte("hello"))[:HeaderSize], io.EOF},
+		{"unknown type", rawBlock(TypeAck+1, nil), ErrUnknownType},
+		{"too large", oversized, ErrBlockTooLarge},
+		{"empty connect", rawBlock(TypeConnect, nil), ErrInvalidPayload},
+		{"empty listen", rawBlock(TypeListen, nil), ErrInvalidPayload},
+		{"long disconnect", rawBlock(TypeDisconnect, []byte{ShutdownWrite, 0}), ErrInvalidPayload},
+		{"unknown shutdown", rawBlock(TypeDisconnect, []byte{ShutdownBoth + 1}), ErrInvalidPayload},
+		{"empty reset", rawBlock(TypeReset, nil), ErrInvalidPayload},
+		{"short ack", rawBlock(TypeAck, []byte{1, 2, 3}), ErrInvalidPayload},
+		{"empty datagram", rawBlock(TypeDatagram, nil), ErrInvalidPayload},
+		{"datagram address overflow", rawBlock(TypeDatagram, []byte{10, 'a'}), ErrInvalidPayload},
+		{"compressed garbage", rawBlock(TypeCompressedData, []byte{0xff, 0xff, 0xff, 0xff, 0xff}), ErrInvalidPayload},
+		{"compressed too large", rawBlock(TypeCompressedData, tooLarge), ErrInvalidPayload},
+		{"compressed truncated", rawBlock(TypeCompressedData, corrupted), ErrInvalidPayload},
+	} {
+		var blk Block
+		err := ReadBlock(bytes.NewReader(c.input), &blk)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: error %v, want %v", c.name, err, c.err)
+			continue
+		}
+		var invalid *InvalidBlockError
+		if isInvalid := errors.As(err, &invalid); isInvalid != (c.err != io.EOF && c.err != io.ErrUnexpectedEOF) {
+			t.Errorf("%s: error %v is not an InvalidBlockError", c.name, err)
+		}
+		if blk.buffer != nil || blk.BlockData != nil {
+			t.Errorf("%s: buffer is held by the rejected block", c.name)
+		}
+	}
+}
+
+// Copies of a block share its buffer, which goes back to the pool when the last reference is released
+func TestRetainRelease(t *testing.T) {
+	var blockID atomic.Uint32
+	blk := NewDataBlocks(1, &blockID, []byte("hello"))[0]
+	buf := blk.buffer
+	copies := make([]Block, 3)
+	for i := range copies {
+		blk.Retain()
+		copies[i] = blk
+	}
+	for _, c := range copies {
+		c.Release()
+		if buf.Bytes == nil {
+			t.Fatal("buffer is released while it's referenced")
+		}
+	}
+	blk.Release()
+	if buf.Bytes != nil {
+		t.Fatal("buffer is not released after the last reference")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("releasing more than retained doesn't panic")
+		}
+	}()
+	blk.Release()
+}
+
+// A compressed block read holds only the buffer of the restored data
+func TestReadCompressedRelease(t *testing.T) {
+	var blockID atomic.Uint32
+	data := bytes.Repeat([]byte("rabbit"), 1024)
+	sent := NewCompressedDataBlocks(1, &blockID, data)[0]
+	packed := append([]byte(nil), sent.Pack()...)
+	sent.Release()
+
+	var blk Block
+	if err := ReadBlock(bytes.NewReader(packed), &blk); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blk.BlockData, data) {
+		t.Fatal("data is not restored")
+	}
+	buf := blk.buffer
+	blk.Release()
+	if buf.Bytes != nil {
+		t.Fatal("buffer is not released")
+	}
+}
+
+func fullBlockData() []byte {
+	return make([]byte, DataSize)
+}
+
+// Split a full block of data and pack it, with buffers taken from and released to the pool
+func BenchmarkBlockPack(b *testing.B) {
+	data := fullBlockData()
+	var blockID atomic.Uint32
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blk := NewDataBlocks(1, &blockID, data)[0]
+		blk.Pack()
+		blk.Release()
+	}
+}
+
+// Parse full blocks from a stream
+func BenchmarkBlockRead(b *testing.B) {
+	var blockID atomic.Uint32
+	var stream []byte
+	for i := 0; i < 64; i++ {
+		blk := NewDataBlocks(1, &blockID, fullBlockData())[0]
+		stream = append(stream, blk.Pack()...)
+		blk.Release()
+	}
+	reader := bytes.NewReader(stream)
+	var blk Block
+	b.SetBytes(DataSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if reader.Len() == 0 {
+			reader.Reset(stream)
+		}
+		if err := ReadBlock(reader, &blk); err != nil {
+			b.Fatal(err)
+		}
+		blk.Release()
+	}
+}
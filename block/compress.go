@@ -0,0 +1,80 @@
+package block
+
+import (
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/ihciah/rabbit-tcp/buffer"
+	"go.uber.org/atomic"
+)
+
+// Compressed payload is sent only if it saves at least 1/CompressMinSaving of the raw payload,
+// so incompressible data costs nothing on the receiving side.
+const CompressMinSaving = 8
+
+var compressBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, snappy.MaxEncodedLen(DataSize))
+		return &buf
+	},
+}
+
+// Like NewDataBlocks, but payload is compressed with snappy when worthwhile.
+// Compressed blocks are restored to data blocks by ReadBlock.
+func NewCompressedDataBlocks(connectID uint32, blockID *atomic.Uint32, data []byte) []Block {
+	compressBuf := compressBufferPool.Get().(*[]byte)
+	defer compressBufferPool.Put(compressBuf)
+	blocks := make([]Block, 0, (len(data)+DataSize-1)/DataSize)
+	for cursor := 0; cursor < len(data); {
+		end := cursor + DataSize
+		if len(data) < end {
+			end = len(data)
+		}
+		blocks = append(blocks, newCompressedDataBlock(connectID, blockID.Inc()-1, data[cursor:end], compressBuf))
+		cursor = end
+	}
+	return blocks
+}
+
+func newCompressedDataBlock(connectID uint32, blockID uint32, data []byte, compressBuf *[]byte) Block {
+	compressed := snappy.Encode(*compressBuf, data)
+	if len(compressed) > len(data)-len(data)/CompressMinSaving {
+		return newDataBlock(connectID, blockID, data)
+	}
+	blk := Block{
+		Type:         TypeCompressedData,
+		ConnectionID: connectID,
+		BlockID:      blockID,
+		BlockLength:  uint32(len(compressed)),
+		BlockData:    compressed,
+	}
+	// Copy data now, compressBuf will be reused
+	blk.Pack()
+	return blk
+}
+
+// Check compressed payload without decoding it
+func (block *Block) validateCompressed() error {
+	n, err := snappy.DecodedLen(block.BlockData)
+	if err != nil || n > DataSize {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+// Turn a compressed block read from reader into a data block
+func (block *Block) decompress(buf *buffer.Buffer) (*buffer.Buffer, error) {
+	n, _ := snappy.DecodedLen(block.BlockData)
+	out := buffer.Get(HeaderSize + n)
+	if _, err := snappy.Decode(out.Bytes[HeaderSize:], block.BlockData); err != nil {
+		out.Release()
+		return nil, ErrInvalidPayload
+	}
+	buf.Release()
+	block.Type = TypeData
+	block.BlockLength = uint32(n)
+	block.packed = out.Bytes
+	block.putHeader()
+	block.BlockData = block.packed[HeaderSize:]
+	return out, nil
+}
@@ -0,0 +1,54 @@
+package buffer
+
+import (
+	"sync"
+
+	"go.uber.org/atomic"
+)
+
+const (
+	Size = 16 * 1024 // Size of pooled buffers, same as block.MaxSize
+)
+
+var pool = sync.Pool{
+	New: func() interface{} {
+		return &Buffer{data: make([]byte, Size)}
+	},
+}
+
+// Buffer is a reference counted byte slice. It goes back to pool when the last reference is released,
+// so Bytes must not be used after Release.
+type Buffer struct {
+	Bytes []byte
+	data  []byte
+	refs  atomic.Int32
+}
+
+// Get a buffer of length size with one reference. Buffers larger than Size are not pooled.
+func Get(size int) *Buffer {
+	var buf *Buffer
+	if size > Size {
+		buf = &Buffer{Bytes: make([]byte, size)}
+	} else {
+		buf = pool.Get().(*Buffer)
+		buf.Bytes = buf.data[:size]
+	}
+	buf.refs.Store(1)
+	return buf
+}
+
+// Retain adds a reference, each of them should be released
+func (buf *Buffer) Retain() {
+	buf.refs.Inc()
+}
+
+func (buf *Buffer) Release() {
+	refs := buf.refs.Dec()
+	if refs < 0 {
+		panic("buffer released more than retained")
+	}
+	if refs == 0 && buf.data != nil {
+		buf.Bytes = nil
+		pool.Put(buf)
+	}
+}
@@ -1,33 +1,55 @@
 package client
 
 import (
+	"errors"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/ihciah/rabbit-tcp/connection"
 	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
 	"github.com/ihciah/rabbit-tcp/peer"
 	"github.com/ihciah/rabbit-tcp/tunnel"
+	"go.uber.org/atomic"
 )
 
 type Client struct {
 	peer   peer.ClientPeer
+	opts   *options.Options
 	logger *logger.Logger
 }
 
-func NewClient(tunnelNum int, endpoint string, cipher tunnel.Cipher) Client {
+// opts may be nil for defaults
+func NewClient(tunnelNum int, endpoint string, cipher tunnel.Cipher, opts *options.Options) Client {
 	return Client{
-		peer:   peer.NewClientPeer(tunnelNum, endpoint, cipher),
-		logger: logger.NewLogger("[Client]"),
+		peer:   peer.NewClientPeer(tunnelNum, endpoint, cipher, opts),
+		opts:   opts.WithDefaults(),
+		logger: logger.NewLogger("Client"),
 	}
 }
 
+// Stop all tunnels and connections of the client
+func (c *Client) Close() {
+	c.peer.Stop()
+}
+
+// Number of tunnels established now, it grows to tunnelNum after the client is created
+func (c *Client) TunnelCount() int {
+	return c.peer.TunnelCount()
+}
+
 func (c *Client) Dial(address string) connection.HalfOpenConn {
 	return c.peer.Dial(address)
 }
 
+// Compress connections to destinations matching any of patterns, see peer.ClientPeer.SetCompression
+func (c *Client) SetCompression(patterns ...string) error {
+	return c.peer.SetCompression(patterns)
+}
+
 func (c *Client) ServeForward(listen, dest string) error {
 	listener, err := net.Listen("tcp", listen)
 	if err != nil {
@@ -40,40 +62,97 @@ func (c *Client) ServeForward(listen, dest string) error {
 			continue
 		}
 		go func() {
-			c.logger.Infoln("Accepted a connection.")
+			c.logger.Info("Accepted a connection.", "remote", conn.RemoteAddr().String())
 			connProxy := c.Dial(dest)
-			biRelay(conn.(*net.TCPConn), connProxy, c.logger)
+			connection.BiRelay(conn.(*net.TCPConn), connProxy, c.logger)
 		}()
 	}
 }
 
-func biRelay(left, right connection.HalfOpenConn, logger *logger.Logger) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go relay(left, right, &wg, logger, "local <- tunnel")
-	wg.Add(1)
-	go relay(right, left, &wg, logger, "local -> tunnel")
-	wg.Wait()
-	// logger.Errorf("===========> Close client biRelay")
-	_ = left.Close()
-	_ = right.Close()
+// Open a UDP session, datagrams written to it are sent to their destination from the server side
+func (c *Client) ListenPacket() net.PacketConn {
+	return c.peer.ListenPacket()
+}
+
+// UDP session of a source address
+type udpSession struct {
+	net.PacketConn
+	lastActive *atomic.Int64 // Unix time in nanoseconds of the latest datagram of either direction
 }
 
-func relay(dst, src connection.HalfOpenConn, wg *sync.WaitGroup, logger *logger.Logger, label string) {
-	defer wg.Done()
-	_, err := io.Copy(dst, src)
+// Forward UDP datagrams received on listen to dest, each source address gets its own session
+func (c *Client) ServeUDPForward(listen, dest string) error {
+	conn, err := net.ListenPacket("udp", listen)
 	if err != nil {
-		_ = dst.SetDeadline(time.Now())
-		_ = src.SetDeadline(time.Now())
-		_ = dst.Close()
-		_ = src.Close()
-		if err != io.EOF {
-			logger.Errorf("Error when relay client: %v.\n", err)
+		return err
+	}
+	destAddr := &connection.Addr{Address: dest}
+	var sessionLock sync.Mutex
+	sessions := make(map[string]*udpSession)
+	buffer := make([]byte, connection.DatagramRecvBuffer)
+	for {
+		n, src, err := conn.ReadFrom(buffer)
+		if err != nil {
+			c.logger.Errorf("Error when read datagram: %v.\n", err)
+			continue
+		}
+		sessionLock.Lock()
+		session, ok := sessions[src.String()]
+		if !ok {
+			c.logger.Infof("New UDP session from %s.\n", src)
+			session = &udpSession{
+				PacketConn: c.ListenPacket(),
+				lastActive: atomic.NewInt64(time.Now().UnixNano()),
+			}
+			sessions[src.String()] = session
+			go func() {
+				relayDatagram(conn, session, src, c.opts.DatagramSessionTimeout, c.logger)
+				sessionLock.Lock()
+				delete(sessions, src.String())
+				sessionLock.Unlock()
+			}()
+		}
+		sessionLock.Unlock()
+		session.lastActive.Store(time.Now().UnixNano())
+		if _, err := session.WriteTo(buffer[:n], destAddr); err != nil {
+			c.logger.Warnf("Error when forward datagram from %s: %v.\n", src, err)
 		}
-	} else {
-		// logger.Debugf("!!!!!!!!!!!!!!!! %s : dst close write", label)
-		dst.CloseWrite()
-		// logger.Debugf("!!!!!!!!!!!!!!!! %s : src close read", label)
-		src.CloseRead()
 	}
 }
+
+// Relay datagrams from session back to src until no datagram of either direction is seen for timeout
+func relayDatagram(conn net.PacketConn, session *udpSession, src net.Addr, timeout time.Duration, logger *logger.Logger) {
+	defer session.Close()
+	buffer := make([]byte, connection.DatagramRecvBuffer)
+	for {
+		lastActive := session.lastActive.Load()
+		_ = session.SetReadDeadline(time.Unix(0, lastActive).Add(timeout))
+		n, _, err := session.ReadFrom(buffer)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && session.lastActive.Load() != lastActive {
+			// Datagrams are sent to dest meanwhile
+			continue
+		}
+		if err != nil {
+			logger.Infof("UDP session from %s closed: %v.\n", src, err)
+			return
+		}
+		session.lastActive.Store(time.Now().UnixNano())
+		if _, err := conn.WriteTo(buffer[:n], src); err != nil {
+			logger.Warnf("Error when send datagram back to %s: %v.\n", src, err)
+		}
+	}
+}
+
+// Listen on address at the server side, and forward connections accepted there to dest.
+// Returns when the remote listener is closed.
+func (c *Client) ServeReverse(remoteListen, dest string) error {
+	conn := c.peer.Listen(remoteListen, dest)
+	defer c.peer.Unlisten(remoteListen)
+	c.logger.Infof("Remote listen on %s requested.\n", remoteListen)
+	_, err := io.Copy(ioutil.Discard, conn)
+	_ = conn.Close()
+	if err != nil {
+		return err
+	}
+	return errors.New("remote listener closed")
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"errors"
+	"net"
+
+	"github.com/ihciah/rabbit-tcp/connection"
+)
+
+const (
+	TransparentRedirect = "redirect" // Connections redirected by iptables/nftables REDIRECT, destination from SO_ORIGINAL_DST
+	TransparentTProxy   = "tproxy"   // Connections diverted by TPROXY, destination is the local address
+)
+
+var ErrTransparentNotSupported = errors.New("transparent proxy is not supported on this platform")
+
+// Accept connections redirected to listen, and dial their original destinations through tunnels
+func (c *Client) ServeTransparent(listen, mode string) error {
+	if mode != TransparentRedirect && mode != TransparentTProxy {
+		return errors.New("unknown transparent mode " + mode)
+	}
+	listener, err := listenTransparent(listen, mode == TransparentTProxy)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			c.logger.Errorf("Error when accept connection: %v.\n", err)
+			continue
+		}
+		go func() {
+			tcpConn := conn.(*net.TCPConn)
+			var dest *net.TCPAddr
+			var err error
+			if mode == TransparentTProxy {
+				dest = tcpConn.LocalAddr().(*net.TCPAddr)
+			} else {
+				dest, err = originalDestination(tcpConn)
+			}
+			if err != nil {
+				c.logger.Errorf("Error when get original destination: %v.\n", err)
+				_ = tcpConn.Close()
+				return
+			}
+			if isListenerAddr(dest, listener.Addr().(*net.TCPAddr)) {
+				// Not redirected, dialing itself would make a loop
+				c.logger.Warnf("Connection from %s is not redirected.\n", tcpConn.RemoteAddr())
+				_ = tcpConn.Close()
+				return
+			}
+			c.logger.Infof("Accepted a connection to %s.\n", dest)
+			connProxy := c.Dial(dest.String())
+			connection.BiRelay(tcpConn, connProxy, c.logger)
+		}()
+	}
+}
+
+// Whether dest is the address listened on, a wildcard listener listens on all local addresses
+func isListenerAddr(dest, listen *net.TCPAddr) bool {
+	if dest.Port != listen.Port {
+		return false
+	}
+	if len(listen.IP) != 0 && !listen.IP.IsUnspecified() {
+		return dest.IP.Equal(listen.IP)
+	}
+	return isLocalIP(dest.IP)
+}
+
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
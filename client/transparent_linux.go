@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST in linux/netfilter_ipv4.h
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST in linux/netfilter_ipv6/ip6_tables.h
+	ipv6Transparent   = 75 // IPV6_TRANSPARENT in linux/in6.h
+)
+
+func listenTransparent(address string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			controlErr := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				} else {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				}
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return err
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// Get the destination before REDIRECT rewrote it
+func originalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	controlErr := rawConn.Control(func(fd uintptr) {
+		if conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+			addr, err = originalDestination4(int(fd))
+		} else {
+			addr, err = originalDestination6(int(fd))
+		}
+	})
+	if controlErr != nil {
+		return nil, controlErr
+	}
+	return addr, err
+}
+
+func originalDestination4(fd int) (*net.TCPAddr, error) {
+	// sockaddr_in is returned, which fits in IPv6Mreq
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.SOL_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&mreq.Multiaddr[0]))
+	return &net.TCPAddr{
+		IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+		Port: int(ntohs(sa.Port)),
+	}, nil
+}
+
+func originalDestination6(fd int) (*net.TCPAddr, error) {
+	// sockaddr_in6 is returned, which fits in IPv6MTUInfo
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.SOL_IPV6, ip6tSoOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, info.Addr.Addr[:])
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: int(ntohs(info.Addr.Port)),
+	}, nil
+}
+
+// Port in sockaddr is in network byte order
+func ntohs(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
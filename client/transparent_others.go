@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"net"
+)
+
+func listenTransparent(address string, tproxy bool) (net.Listener, error) {
+	return nil, ErrTransparentNotSupported
+}
+
+func originalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentNotSupported
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsListenerAddr(t *testing.T) {
+	var local net.IP
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			local = ipNet.IP
+			break
+		}
+	}
+
+	type testCase struct {
+		dest, listen string
+		loop         bool
+	}
+	cases := []testCase{
+		{"127.0.0.1:1080", "127.0.0.1:1080", true},
+		{"127.0.0.1:1080", "0.0.0.0:1080", true},
+		{"[::1]:1080", "[::]:1080", true},
+		{"127.0.0.1:1080", "[::]:1080", true},
+		{"127.0.0.1:443", "0.0.0.0:1080", false},
+		{"192.0.2.1:1080", "0.0.0.0:1080", false},
+		{"192.0.2.1:1080", "127.0.0.1:1080", false},
+	}
+	if local != nil {
+		cases = append(cases, testCase{net.JoinHostPort(local.String(), "1080"), "[::]:1080", true})
+	}
+	for _, c := range cases {
+		dest, _ := net.ResolveTCPAddr("tcp", c.dest)
+		listen, _ := net.ResolveTCPAddr("tcp", c.listen)
+		if loop := isListenerAddr(dest, listen); loop != c.loop {
+			t.Errorf("isListenerAddr(%s, %s) = %v, want %v", c.dest, c.listen, loop, c.loop)
+		}
+	}
+}
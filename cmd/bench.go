@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ihciah/rabbit-tcp/bench"
+	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/server"
+	"github.com/ihciah/rabbit-tcp/tunnel"
+)
+
+// rabbit bench [flags]: measure throughput and latency through tunnels for every tunnelN
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	addr := flags.String("rabbit-addr", "", "server address, whose bench target must be enabled by -bench; a local server is started if empty")
+	password := flags.String("password", "", "password of the server")
+	tunnelNs := flags.String("tunnelN", "1,2,4,8", "comma separated tunnelN values to compare")
+	size := flags.Int("size", bench.DefaultBytes/1024/1024, "MB sent by each throughput measurement")
+	streams := flags.Int("streams", bench.DefaultStreams, "concurrent connections of multi-stream throughput")
+	pings := flags.Int("pings", bench.DefaultPings, "round trips measured for latency")
+	verbose := flags.Int("verbose", 1, "verbose level(0~5)")
+	flags.Parse(args)
+	logger.SetLevel(int32(*verbose))
+
+	config := bench.Config{
+		Endpoint: *addr,
+		Bytes:    int64(*size) * 1024 * 1024,
+		Streams:  *streams,
+		Pings:    *pings,
+	}
+	for _, s := range strings.Split(*tunnelNs, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			log.Printf("Invalid tunnelN %s.\n", s)
+			return
+		}
+		config.TunnelNums = append(config.TunnelNums, n)
+	}
+
+	if *addr == "" {
+		*password = DefaultPassword
+		cipher, _ := tunnel.NewAEADCipher("CHACHA20-IETF-POLY1305", nil, *password)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		s := server.NewServer(cipher, nil)
+		if err := s.EnableBenchTarget(); err != nil {
+			log.Println(err)
+			return
+		}
+		go s.ServeListener(listener)
+		config.Endpoint = listener.Addr().String()
+		fmt.Printf("Benchmarking a local server at %s.\n", config.Endpoint)
+	} else if *password == "" {
+		log.Println("Password must be specified.")
+		return
+	}
+	config.Cipher, _ = tunnel.NewAEADCipher("CHACHA20-IETF-POLY1305", nil, *password)
+
+	bench.WriteTable(os.Stdout, bench.Run(config), config.Streams)
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"flag"
+	"github.com/ihciah/rabbit-tcp/accesslog"
 	"github.com/ihciah/rabbit-tcp/client"
+	"github.com/ihciah/rabbit-tcp/fault"
 	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/resolver"
 	"github.com/ihciah/rabbit-tcp/server"
 	"github.com/ihciah/rabbit-tcp/tunnel"
+	"io"
 	"log"
+	"net/http"
+	"os"
 	"strings"
 )
 
@@ -18,16 +24,61 @@ const (
 	DefaultPassword = "PASSWORD"
 )
 
-func parseFlags() (pass bool, mode int, password string, addr string, listen string, dest string, tunnelN int, verbose int) {
+// Config of the command line, fields not used by the mode are ignored
+type config struct {
+	mode      int
+	password  string
+	addr      string
+	verbose   int
+	logFormat string
+
+	// Client mode
+	listen       string
+	remoteListen string
+	dest         string
+	udp          bool
+	transparent  string
+	compress     string
+	tunnelN      int
+
+	// Server mode
+	accessLog      string
+	benchTarget    bool
+	allowListen    bool
+	allowUDP       bool
+	refuseUnproven bool
+	dnsConfig      *resolver.Config
+	bindRules      []server.BindRule
+
+	faultAdmin string
+}
+
+func parseFlags() (cfg config, pass bool) {
 	var modeString string
 	var printVersion bool
+	var dns, dnsFamilyString string
+	var bindString string
 	flag.StringVar(&modeString, "mode", "c", "running mode(s or c)")
-	flag.StringVar(&password, "password", DefaultPassword, "password")
-	flag.StringVar(&addr, "rabbit-addr", ":443", "listen(server mode) or remote(client mode) address used by rabbit-tcp")
-	flag.StringVar(&listen, "listen", "", "[Client Only] listen address, eg: 127.0.0.1:2333")
-	flag.StringVar(&dest, "dest", "", "[Client Only] destination address, eg: shadowsocks server address")
-	flag.IntVar(&tunnelN, "tunnelN", 4, "[Client Only] number of tunnels to use in rabbit-tcp")
-	flag.IntVar(&verbose, "verbose", 2, "verbose level(0~5)")
+	flag.StringVar(&cfg.password, "password", DefaultPassword, "password")
+	flag.StringVar(&cfg.addr, "rabbit-addr", ":443", "listen(server mode) or remote(client mode) address used by rabbit-tcp")
+	flag.StringVar(&cfg.listen, "listen", "", "[Client Only] listen address, eg: 127.0.0.1:2333")
+	flag.StringVar(&cfg.remoteListen, "remote-listen", "", "[Client Only] listen address at server side, connections accepted there will be forwarded to dest, the server must run with -allow-listen, eg: :8080")
+	flag.StringVar(&cfg.dest, "dest", "", "[Client Only] destination address, eg: shadowsocks server address")
+	flag.BoolVar(&cfg.udp, "udp", false, "[Client Only] forward UDP datagrams received on listen address to dest too, the server must run with -allow-udp")
+	flag.StringVar(&cfg.transparent, "transparent", "", "[Client Only] accept connections redirected to listen address and forward them to their original destinations, redirect or tproxy(linux only)")
+	flag.StringVar(&cfg.compress, "compress", "", "[Client Only] compress connections to destinations matching these comma separated patterns, eg: * or *:80,logs.internal:*")
+	flag.IntVar(&cfg.tunnelN, "tunnelN", 4, "[Client Only] number of tunnels to use in rabbit-tcp")
+	flag.StringVar(&cfg.faultAdmin, "fault-admin", "", "[Staging Only] serve fault injection API on this address, the binary must be built with -tags faultinject, eg: 127.0.0.1:6061")
+	flag.IntVar(&cfg.verbose, "verbose", 2, "verbose level(0~5)")
+	flag.StringVar(&cfg.logFormat, "log-format", "text", "log format(text or json)")
+	flag.BoolVar(&cfg.benchTarget, "bench", false, "[Server Only] serve `rabbit bench` clients with a built-in echo and sink target")
+	flag.BoolVar(&cfg.allowListen, "allow-listen", false, "[Server Only] listen on addresses requested by clients with -remote-listen")
+	flag.BoolVar(&cfg.allowUDP, "allow-udp", false, "[Server Only] relay UDP datagrams of clients with -udp")
+	flag.BoolVar(&cfg.refuseUnproven, "refuse-unproven", false, "[Server Only] refuse more than one tunnel of clients without session resumption(version 1), which cannot prove their peer ID, so they must use -tunnelN 1")
+	flag.StringVar(&dns, "dns", "", "[Server Only] resolve destinations with these comma separated DNS servers instead of the system resolver, eg: 8.8.8.8,tls://1.1.1.1,https://dns.google/dns-query")
+	flag.StringVar(&dnsFamilyString, "dns-family", "", "[Server Only] address families of destinations to connect(dual, ipv4-first, ipv4 or ipv6), resolve them with the system resolver if neither this nor -dns is given")
+	flag.StringVar(&bindString, "bind", "", "[Server Only] dial destinations matching semicolon separated rules from their source ip, interface(linux only) or fwmark(linux only), eg: dest=*:25,ip=192.0.2.10;dest=10.0.0.0/8,dev=wg0,mark=100")
+	flag.StringVar(&cfg.accessLog, "access-log", "", "[Server Only] log connections to this file(rotated by size) or syslog, eg: /var/log/rabbit-access.log")
 	flag.BoolVar(&printVersion, "version", false, "show version")
 	flag.Parse()
 
@@ -44,38 +95,74 @@ func parseFlags() (pass bool, mode int, password string, addr string, listen str
 	// mode
 	modeString = strings.ToLower(modeString)
 	if modeString == "c" || modeString == "client" {
-		mode = ClientMode
+		cfg.mode = ClientMode
 	} else if modeString == "s" || modeString == "server" {
-		mode = ServerMode
+		cfg.mode = ServerMode
 	} else {
 		log.Printf("Unsupported mode %s.\n", modeString)
 		pass = false
 		return
 	}
 
+	// log format
+	cfg.logFormat = strings.ToLower(cfg.logFormat)
+	if cfg.logFormat != "text" && cfg.logFormat != "json" {
+		log.Printf("Unsupported log format %s.\n", cfg.logFormat)
+		pass = false
+		return
+	}
+
+	// dns
+	var err error
+	if dns != "" || dnsFamilyString != "" {
+		cfg.dnsConfig = &resolver.Config{}
+		if cfg.dnsConfig.Family, err = resolver.ParseFamily(dnsFamilyString); err != nil {
+			log.Println(err)
+			pass = false
+			return
+		}
+		if dns != "" {
+			cfg.dnsConfig.Servers = strings.Split(dns, ",")
+		}
+	}
+
+	// bind rules
+	if cfg.bindRules, err = server.ParseBindRules(bindString); err != nil {
+		log.Println(err)
+		pass = false
+		return
+	}
+
+	// fault injection
+	if cfg.faultAdmin != "" && !fault.Enabled {
+		log.Println(fault.ErrNotEnabled)
+		pass = false
+		return
+	}
+
 	// password
-	if password == "" {
+	if cfg.password == "" {
 		log.Println("Password must be specified.")
 		pass = false
 		return
 	}
-	if password == DefaultPassword {
+	if cfg.password == DefaultPassword {
 		log.Println("Password must be changed instead of default password.")
 		pass = false
 		return
 	}
 
 	// listen, dest, tunnelN
-	if mode == ClientMode {
-		if listen == "" {
-			log.Println("Listen address must be specified in client mode.")
+	if cfg.mode == ClientMode {
+		if cfg.listen == "" && cfg.remoteListen == "" {
+			log.Println("Listen or remote listen address must be specified in client mode.")
 			pass = false
 		}
-		if dest == "" {
+		if cfg.dest == "" && cfg.transparent == "" {
 			log.Println("Destination address must be specified in client mode.")
 			pass = false
 		}
-		if tunnelN == 0 {
+		if cfg.tunnelN == 0 {
 			log.Println("Tunnel number must be positive.")
 			pass = false
 		}
@@ -83,18 +170,100 @@ func parseFlags() (pass bool, mode int, password string, addr string, listen str
 	return
 }
 
+func openAccessLog(path string) (io.WriteCloser, error) {
+	if path == "syslog" {
+		return accesslog.DialSyslog("rabbit-tcp")
+	}
+	return accesslog.OpenRotatingFile(path, accesslog.DefaultMaxSize, accesslog.DefaultMaxBackups)
+}
+
 func main() {
-	pass, mode, password, addr, listen, dest, tunnelN, verbose := parseFlags()
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	cfg, pass := parseFlags()
 	if !pass {
 		return
 	}
-	cipher, _ := tunnel.NewAEADCipher("CHACHA20-IETF-POLY1305", nil, password)
-	logger.LEVEL = verbose
-	if mode == ClientMode {
-		c := client.NewClient(tunnelN, addr, cipher)
-		c.ServeForward(listen, dest)
+	cipher, _ := tunnel.NewAEADCipher("CHACHA20-IETF-POLY1305", nil, cfg.password)
+	logger.SetLevel(int32(cfg.verbose))
+	if cfg.logFormat == "json" {
+		logger.SetSink(logger.NewJSONSink(os.Stdout))
+	}
+	if cfg.faultAdmin != "" {
+		go func() {
+			log.Println(http.ListenAndServe(cfg.faultAdmin, fault.Handler()))
+		}()
+	}
+	if cfg.mode == ClientMode {
+		runClient(&cfg, cipher)
+	} else {
+		runServer(&cfg, cipher)
+	}
+}
+
+func runClient(cfg *config, cipher tunnel.Cipher) {
+	c := client.NewClient(cfg.tunnelN, cfg.addr, cipher, nil)
+	if cfg.compress != "" {
+		if err := c.SetCompression(strings.Split(cfg.compress, ",")...); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if cfg.remoteListen != "" {
+		log.Println(c.ServeReverse(cfg.remoteListen, cfg.dest))
+	} else if cfg.transparent != "" {
+		log.Println(c.ServeTransparent(cfg.listen, cfg.transparent))
 	} else {
-		s := server.NewServer(cipher)
-		s.Serve(addr)
+		if cfg.udp {
+			go func() {
+				log.Println(c.ServeUDPForward(cfg.listen, cfg.dest))
+			}()
+		}
+		c.ServeForward(cfg.listen, cfg.dest)
+	}
+}
+
+func runServer(cfg *config, cipher tunnel.Cipher) {
+	s := server.NewServer(cipher, nil)
+	if cfg.allowListen {
+		s.EnableListen()
+	}
+	if cfg.allowUDP {
+		s.EnableDatagram()
+	}
+	if cfg.refuseUnproven {
+		s.RefuseUnprovenTunnels()
+	}
+	if cfg.dnsConfig != nil {
+		res, err := resolver.New(*cfg.dnsConfig)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		s.SetDial(res.Dial)
+		s.SetBindDial(res.DialBind)
+	}
+	s.SetPolicy(&server.Policy{BindRules: cfg.bindRules})
+	if cfg.benchTarget {
+		if err := s.EnableBenchTarget(); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if cfg.accessLog != "" {
+		writer, err := openAccessLog(cfg.accessLog)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer writer.Close()
+		if cfg.logFormat == "json" {
+			s.SetAccessLog(accesslog.NewLogger(logger.NewJSONSink(writer)))
+		} else {
+			s.SetAccessLog(accesslog.NewLogger(logger.NewTextSink(writer)))
+		}
 	}
+	s.Serve(cfg.addr)
 }
@@ -0,0 +1,44 @@
+package connection
+
+import (
+	"context"
+
+	"github.com/ihciah/rabbit-tcp/block"
+	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
+	"go.uber.org/atomic"
+)
+
+// AcceptedConnection is an InboundConnection initiated by the other side.
+// Instead of dialing the requested address like OutboundConnection, it is handed to accept
+// once the connect block arrives, and the requested address is available from RemoteAddr.
+type AcceptedConnection struct {
+	InboundConnection
+	accept   func(Connection)
+	accepted *atomic.Bool
+}
+
+func NewAcceptedConnection(connectionID uint32, accept func(Connection), sendQueue chan<- block.Block, opts *options.Options, ctx context.Context, removeFromPool context.CancelFunc) Connection {
+	c := AcceptedConnection{
+		InboundConnection: newInboundConnection(connectionID, sendQueue, opts, ctx, removeFromPool),
+		accept:            accept,
+		accepted:          atomic.NewBool(false),
+	}
+	c.logger = logger.NewLogger("AcceptedConnection").With("conn_id", connectionID)
+	c.logger.Infof("AcceptedConnection %d created.\n", connectionID)
+	return &c
+}
+
+func (ac *AcceptedConnection) RecvBlock(blk block.Block) {
+	if blk.Type == block.TypeConnect && ac.accepted.CAS(false, true) {
+		address, options := blk.ParseConnect()
+		if options&block.ConnectOptionCompress != 0 {
+			ac.EnableCompression()
+		}
+		ac.remoteAddr.Address = address
+		ac.access.start(address)
+		ac.logger.Debug("Connection accepted.", "remote", ac.remoteAddr.Address)
+		go ac.accept(ac)
+	}
+	ac.InboundConnection.RecvBlock(blk)
+}
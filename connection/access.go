@@ -0,0 +1,98 @@
+package connection
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/accesslog"
+	"go.uber.org/atomic"
+)
+
+// accessRecorder collects the access record of a connection and logs it once the connection ends.
+// A nil *accessRecorder records nothing.
+type accessRecorder struct {
+	log      *accesslog.Logger
+	record   accesslog.Record // Guarded by the order of start and finish
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	reasonOnce sync.Once
+	reason     string
+	finishOnce sync.Once
+}
+
+func newAccessRecorder(log *accesslog.Logger, record accesslog.Record) *accessRecorder {
+	return &accessRecorder{
+		log:    log,
+		record: record,
+	}
+}
+
+func (r *accessRecorder) start(destination string) {
+	if r == nil {
+		return
+	}
+	r.record.Destination = destination
+	r.record.Start = time.Now()
+}
+
+func (r *accessRecorder) addIn(n int) {
+	if r != nil {
+		r.bytesIn.Add(int64(n))
+	}
+}
+
+func (r *accessRecorder) addOut(n int) {
+	if r != nil {
+		r.bytesOut.Add(int64(n))
+	}
+}
+
+// Only the first reason is kept, which is the cause of later ones
+func (r *accessRecorder) setReason(reason string) {
+	if r == nil {
+		return
+	}
+	r.reasonOnce.Do(func() {
+		r.reason = reason
+	})
+}
+
+// Log the record when the connection ends, it's logged once and only if started
+func (r *accessRecorder) finish() {
+	if r == nil {
+		return
+	}
+	r.finishOnce.Do(func() {
+		if r.record.Start.IsZero() {
+			return
+		}
+		r.setReason(accesslog.ReasonShutdown)
+		record := r.record
+		record.BytesIn = r.bytesIn.Load()
+		record.BytesOut = r.bytesOut.Load()
+		record.Duration = time.Since(record.Start)
+		record.Reason = r.reason
+		r.log.Log(record)
+	})
+}
+
+func ioErrorReason(err error) string {
+	switch {
+	case errors.Is(err, io.EOF):
+		return accesslog.ReasonEOF
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return accesslog.ReasonReset
+	}
+	return accesslog.ReasonError
+}
+
+func dialErrorReason(err error) string {
+	if errors.Is(err, ErrDenied) {
+		return accesslog.ReasonDeny
+	}
+	return accesslog.ReasonDialError
+}
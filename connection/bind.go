@@ -0,0 +1,63 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Bind tells how a connection is dialed out of a server with several addresses or interfaces
+type Bind struct {
+	LocalIPs []net.IP // Source addresses, the first one of the destination's family is used
+	Device   string   // Bind to this interface by SO_BINDTODEVICE, linux only
+	Mark     uint32   // Set fwmark by SO_MARK for policy routing, linux only
+}
+
+// BindPolicy selects the bind of a connection by the requested address, nil is returned to dial from the default route
+type BindPolicy func(address string) *Bind
+
+// BindDialFunc is like DialFunc, but dials with bind
+type BindDialFunc func(address string, bind *Bind) (HalfOpenConn, error)
+
+var ErrBindNotSupported = errors.New("binding to device or mark is not supported on this platform")
+
+// A dialer to the resolved remote with the bind applied, a nil bind dials from the default route.
+// The source address is the first local IP of the remote's family, or taken by the route if there is none.
+func (b *Bind) Dialer(remote net.IP) *net.Dialer {
+	dialer := &net.Dialer{}
+	if b == nil {
+		return dialer
+	}
+	for _, ip := range b.LocalIPs {
+		if (ip.To4() == nil) == (remote.To4() == nil) {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+			break
+		}
+	}
+	if b.Device != "" || b.Mark != 0 {
+		dialer.Control = b.control
+	}
+	return dialer
+}
+
+// Dial address over TCP with bind, see Bind.Dialer. A host name is looked up first, so the source address
+// of each of its addresses is picked by the family of that address; they are tried in order until one connects.
+func DialTCPBind(address string, bind *Bind) (HalfOpenConn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = net.DefaultResolver.LookupIP(context.Background(), "ip", host); err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = bind.Dialer(ip).Dial("tcp", net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn.(*net.TCPConn), nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package connection
+
+import (
+	"syscall"
+)
+
+func (b *Bind) control(network, address string, c syscall.RawConn) error {
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		if b.Device != "" {
+			if err = syscall.BindToDevice(int(fd), b.Device); err != nil {
+				return
+			}
+		}
+		if b.Mark != 0 {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(b.Mark))
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package connection
+
+import (
+	"syscall"
+)
+
+func (b *Bind) control(network, address string, c syscall.RawConn) error {
+	return ErrBindNotSupported
+}
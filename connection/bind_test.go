@@ -0,0 +1,47 @@
+package connection_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ihciah/rabbit-tcp/connection"
+)
+
+func TestBindDialer(t *testing.T) {
+	bind := &connection.Bind{LocalIPs: []net.IP{net.ParseIP("2001:db8::10"), net.ParseIP("192.0.2.10")}}
+	for _, c := range []struct {
+		remote string
+		local  string
+	}{
+		{"198.51.100.1", "192.0.2.10"},
+		{"2001:db8::1", "2001:db8::10"},
+	} {
+		addr, ok := bind.Dialer(net.ParseIP(c.remote)).LocalAddr.(*net.TCPAddr)
+		if !ok || !addr.IP.Equal(net.ParseIP(c.local)) {
+			t.Errorf("Dial %s from %v, want %s.", c.remote, addr, c.local)
+		}
+	}
+	if addr := (&connection.Bind{LocalIPs: []net.IP{net.ParseIP("192.0.2.10")}}).Dialer(net.ParseIP("::1")).LocalAddr; addr != nil {
+		t.Errorf("Dial ::1 from %v, want the route to pick.", addr)
+	}
+}
+
+// The source address for a host name is picked by the family of the address it's looked up to
+func TestDialTCPBindHostName(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	bind := &connection.Bind{LocalIPs: []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}}
+	conn, err := connection.DialTCPBind(net.JoinHostPort("localhost", port), bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if local := conn.LocalAddr().(*net.TCPAddr); !local.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("Dial from %s, want 127.0.0.1.", local)
+	}
+}
@@ -2,13 +2,40 @@ package connection
 
 import (
 	"context"
+	"errors"
 	"time"
 
+	"github.com/ihciah/rabbit-tcp/accesslog"
 	"github.com/ihciah/rabbit-tcp/block"
 	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
 	"go.uber.org/atomic"
 )
 
+var (
+	ErrReorderBufferFull       = errors.New("too many out-of-order blocks in connection")
+	ErrGlobalReorderBufferFull = errors.New("too many out-of-order blocks in all connections")
+)
+
+// Out-of-order blocks cached by all connections, each of them holds a buffer of block.MaxSize
+var (
+	reorderBlocks atomic.Int64
+	reorderBytes  atomic.Int64 // Payload bytes
+)
+
+type ReorderStats struct {
+	Blocks int64 // Out-of-order blocks cached now
+	Bytes  int64 // Payload bytes of them
+}
+
+// Gauges of blocks waiting for their predecessors in all connections
+func GetReorderStats() ReorderStats {
+	return ReorderStats{
+		Blocks: reorderBlocks.Load(),
+		Bytes:  reorderBytes.Load(),
+	}
+}
+
 // 1. Join blocks from chan to connection orderedRecvQueue
 // 2. Send bytes or control block
 type blockProcessor struct {
@@ -16,18 +43,23 @@ type blockProcessor struct {
 	logger         *logger.Logger
 	relayCtx       context.Context
 	removeFromPool context.CancelFunc
+	opts           *options.Options
 
 	sendBlockID     atomic.Uint32
 	recvBlockID     uint32
 	lastRecvBlockID uint32
+
+	compress bool        // Set before any data block is packed
+	paused   func() bool // If not nil and it returns true, waiting for blocks doesn't time out
 }
 
-func newBlockProcessor(ctx context.Context, removeFromPool context.CancelFunc) blockProcessor {
+func newBlockProcessor(opts *options.Options, ctx context.Context, removeFromPool context.CancelFunc) blockProcessor {
 	return blockProcessor{
+		opts:           opts,
 		cache:          make(map[uint32]block.Block),
 		relayCtx:       ctx,
 		removeFromPool: removeFromPool,
-		logger:         logger.NewLogger("[BlockProcessor]"),
+		logger:         logger.NewLogger("BlockProcessor"),
 	}
 }
 
@@ -35,46 +67,63 @@ func newBlockProcessor(ctx context.Context, removeFromPool context.CancelFunc) b
 // TODO: If waiting a packet for TIMEOUT, break the connection; otherwise re-countdown for next waiting packet.
 func (x *blockProcessor) OrderedRelay(connection Connection) {
 	x.logger.Infof("Ordered Relay of Connection %d started.\n", connection.GetConnectionID())
+	defer x.dropCache()
 	for {
 		select {
 		case blk := <-connection.getRecvQueue():
-			if blk.BlockID+1 > x.lastRecvBlockID {
+			if idAfter(blk.BlockID+1, x.lastRecvBlockID) {
 				// Update lastRecvBlockID
 				x.lastRecvBlockID = blk.BlockID + 1
 			}
 			if x.recvBlockID == blk.BlockID {
 				// Can send directly
 				x.logger.Debugf("Send Block %d directly\n", blk.BlockID)
-				connection.getOrderedRecvQueue() <- blk
+				if !x.deliver(connection, blk) {
+					blk.Release()
+					return
+				}
 				x.recvBlockID++
 				for {
-					blk, ok := x.cache[x.recvBlockID]
+					blk, ok := x.uncache(x.recvBlockID)
 					if !ok {
 						break
 					}
 					x.logger.Debugf("Send Block %d from cache\n", blk.BlockID)
-					connection.getOrderedRecvQueue() <- blk
-					delete(x.cache, x.recvBlockID)
+					if !x.deliver(connection, blk) {
+						blk.Release()
+						return
+					}
 					x.recvBlockID++
 				}
 			} else {
 				// Cannot send directly
-				if blk.BlockID < x.recvBlockID {
+				if idAfter(x.recvBlockID, blk.BlockID) {
 					// We don't need this old block
 					x.logger.Debugf("Block %d is too old to cache\n", blk.BlockID)
+					blk.Release()
 					continue
 				}
 				x.logger.Debugf("Put Block %d to cache\n", blk.BlockID)
-				x.cache[blk.BlockID] = blk
+				if err := x.cacheBlock(blk); err != nil {
+					x.logger.Warnf("Connection %d is going to be reset: %v.\n", connection.GetConnectionID(), err)
+					connection.setCloseReason(accesslog.ReasonReorderOverflow)
+					connection.SendReset(block.ResetReasonError)
+					return
+				}
 			}
-		case <-time.After(PacketWaitTimeoutSec * time.Second):
+		case <-time.After(x.opts.PacketWaitTimeout):
 			x.logger.Debugf("Packet wait time exceed of Connection %d.\n", connection.GetConnectionID())
 			if x.recvBlockID == x.lastRecvBlockID {
 				x.logger.Debugf("recvBlockId == lastRecvBlockID(%d), but Connection %d is not in waiting status, continue.\n", x.recvBlockID, connection.GetConnectionID())
 				continue
 			}
+			if x.paused != nil && x.paused() {
+				x.logger.Debugf("Connection %d keeps waiting since timeout is paused.\n", connection.GetConnectionID())
+				continue
+			}
 			x.logger.Warnf("Connection %d is going to be killed due to timeout.\n", connection.GetConnectionID())
-			x.removeFromPool()
+			connection.setCloseReason(accesslog.ReasonTimeout)
+			connection.SendReset(block.ResetReasonTimeout)
 		case <-x.relayCtx.Done():
 			x.logger.Infof("Ordered Relay of Connection %d stopped.\n", connection.GetConnectionID())
 			return
@@ -82,12 +131,81 @@ func (x *blockProcessor) OrderedRelay(connection Connection) {
 	}
 }
 
+// Put an out-of-order block to cache, the block is released if it exceeds budgets
+func (x *blockProcessor) cacheBlock(blk block.Block) error {
+	if duplicated, ok := x.uncache(blk.BlockID); ok {
+		duplicated.Release()
+	}
+	if len(x.cache) >= x.opts.ReorderBufferBlocks {
+		blk.Release()
+		return ErrReorderBufferFull
+	}
+	if reorderBlocks.Inc() > int64(x.opts.GlobalReorderBufferBlocks) {
+		reorderBlocks.Dec()
+		blk.Release()
+		return ErrGlobalReorderBufferFull
+	}
+	reorderBytes.Add(int64(len(blk.BlockData)))
+	x.cache[blk.BlockID] = blk
+	return nil
+}
+
+func (x *blockProcessor) uncache(blockID uint32) (block.Block, bool) {
+	blk, ok := x.cache[blockID]
+	if ok {
+		delete(x.cache, blockID)
+		reorderBlocks.Dec()
+		reorderBytes.Sub(int64(len(blk.BlockData)))
+	}
+	return blk, ok
+}
+
+// Release all cached blocks when the relay is stopped
+func (x *blockProcessor) dropCache() {
+	for blockID := range x.cache {
+		blk, _ := x.uncache(blockID)
+		blk.Release()
+	}
+}
+
+// Block IDs wrap around, so they are compared by serial number arithmetic(RFC 1982).
+// It is correct as long as blocks in flight span less than 2^31 IDs.
+func idAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// Put block to orderedRecvQueue; return false if the relay is stopped before that
+func (x *blockProcessor) deliver(connection Connection, blk block.Block) bool {
+	select {
+	case connection.getOrderedRecvQueue() <- blk:
+		return true
+	case <-x.relayCtx.Done():
+		x.logger.Infof("Ordered Relay of Connection %d stopped.\n", connection.GetConnectionID())
+		return false
+	}
+}
+
 func (x *blockProcessor) packData(data []byte, connectionID uint32) []block.Block {
+	if x.compress {
+		return block.NewCompressedDataBlocks(connectionID, &x.sendBlockID, data)
+	}
 	return block.NewDataBlocks(connectionID, &x.sendBlockID, data)
 }
 
 func (x *blockProcessor) packConnect(address string, connectionID uint32) block.Block {
-	return block.NewConnectBlock(connectionID, x.sendBlockID.Inc()-1, address)
+	var options uint8
+	if x.compress {
+		options |= block.ConnectOptionCompress
+	}
+	return block.NewConnectBlockWithOptions(connectionID, x.sendBlockID.Inc()-1, address, options)
+}
+
+func (x *blockProcessor) packListen(address string, connectionID uint32) block.Block {
+	return block.NewListenBlock(connectionID, x.sendBlockID.Inc()-1, address)
+}
+
+func (x *blockProcessor) packReset(connectionID uint32, reason uint8) block.Block {
+	return block.NewResetBlock(connectionID, x.sendBlockID.Inc()-1, reason)
 }
 
 func (x *blockProcessor) packDisconnect(connectionID uint32, shutdownType uint8) block.Block {
@@ -0,0 +1,69 @@
+package connection_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ihciah/rabbit-tcp/block"
+	"github.com/ihciah/rabbit-tcp/connection"
+	"github.com/ihciah/rabbit-tcp/options"
+)
+
+// Feed full blocks to a connection with every depth blocks arriving in reverse order, and read them in order.
+// Depth 1 is the in-order path, others exercise the reorder cache.
+func BenchmarkOrderedRelay(b *testing.B) {
+	for _, depth := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			benchmarkOrderedRelay(b, depth)
+		})
+	}
+}
+
+func benchmarkOrderedRelay(b *testing.B, depth int) {
+	opts := (&options.Options{ReorderBufferBlocks: depth}).WithDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := connection.NewInboundConnection(1, make(chan block.Block, 1), opts, ctx, cancel)
+	go conn.OrderedRelay(conn)
+
+	data := make([]byte, block.DataSize)
+	total := int64(b.N) * int64(len(data))
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, block.MaxSize)
+		for read := int64(0); read < total; {
+			n, err := conn.Read(buf)
+			if err != nil {
+				done <- err
+				return
+			}
+			read += int64(n)
+		}
+		done <- nil
+	}()
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for start := 0; start < b.N; start += depth {
+		end := start + depth
+		if end > b.N {
+			end = b.N
+		}
+		for id := end - 1; id >= start; id-- {
+			conn.RecvBlock(block.Block{
+				Type:         block.TypeData,
+				ConnectionID: 1,
+				BlockID:      uint32(id),
+				BlockLength:  uint32(len(data)),
+				BlockData:    data,
+			})
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	conn.Close()
+}
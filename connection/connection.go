@@ -1,8 +1,10 @@
 package connection
 
 import (
+	"errors"
 	"net"
 
+	"github.com/ihciah/rabbit-tcp/accesslog"
 	"github.com/ihciah/rabbit-tcp/block"
 	"github.com/ihciah/rabbit-tcp/logger"
 	"go.uber.org/atomic"
@@ -22,6 +24,20 @@ type CloseRead interface {
 	CloseRead() error
 }
 
+// DialFunc is used by OutboundConnection to connect to the requested address
+type DialFunc func(address string) (HalfOpenConn, error)
+
+// DialFunc may return an error wrapping ErrDenied if the address is rejected by access control
+var ErrDenied = errors.New("denied by access control")
+
+func DialTCP(address string) (HalfOpenConn, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
 type Connection interface {
 	HalfOpenConn
 	GetConnectionID() uint32
@@ -30,10 +46,15 @@ type Connection interface {
 
 	RecvBlock(block.Block)
 
+	EnableCompression() // Compress data blocks of both directions, must be called before SendConnect
 	SendConnect(address string)
+	SendListen(address string)
 	SendDisconnect(uint8)
+	SendReset(reason uint8) // Abort, the other side resets its real connection
 
 	OrderedRelay(connection Connection) // Run orderedRelay infinitely
+	PauseTimeout(paused func() bool)    // Waiting for blocks doesn't time out while paused returns true, call it before OrderedRelay
+	setCloseReason(reason string)       // Tell the access log why the connection is going to end
 	Stop()                              // Stop all related relay and remove itself from connectionPool
 }
 
@@ -45,6 +66,7 @@ type baseConnection struct {
 	recvQueue        chan block.Block
 	orderedRecvQueue chan block.Block
 	logger           *logger.Logger
+	access           *accessRecorder // Nil if access log is disabled
 }
 
 func (bc *baseConnection) Stop() {
@@ -56,6 +78,20 @@ func (bc *baseConnection) OrderedRelay(connection Connection) {
 	bc.blockProcessor.OrderedRelay(connection)
 }
 
+func (bc *baseConnection) PauseTimeout(paused func() bool) {
+	bc.blockProcessor.paused = paused
+}
+
+// Log an access record when the connection ends, record should have kind and peer fields filled.
+// It must be called before any block is received.
+func (bc *baseConnection) EnableAccessLog(log *accesslog.Logger, record accesslog.Record) {
+	bc.access = newAccessRecorder(log, record)
+}
+
+func (bc *baseConnection) setCloseReason(reason string) {
+	bc.access.setReason(reason)
+}
+
 func (bc *baseConnection) GetConnectionID() uint32 {
 	return bc.connectionID
 }
@@ -69,7 +105,16 @@ func (bc *baseConnection) getOrderedRecvQueue() chan block.Block {
 }
 
 func (bc *baseConnection) RecvBlock(blk block.Block) {
-	bc.recvQueue <- blk
+	select {
+	case bc.recvQueue <- blk:
+	case <-bc.blockProcessor.relayCtx.Done():
+		// Connection has been removed, nobody will consume the block
+		blk.Release()
+	}
+}
+
+func (bc *baseConnection) EnableCompression() {
+	bc.blockProcessor.compress = true
 }
 
 func (bc *baseConnection) SendConnect(address string) {
@@ -78,6 +123,12 @@ func (bc *baseConnection) SendConnect(address string) {
 	bc.sendQueue <- blk
 }
 
+func (bc *baseConnection) SendListen(address string) {
+	bc.logger.Debugf("Send listen on %s block.\n", address)
+	blk := bc.blockProcessor.packListen(address, bc.connectionID)
+	bc.sendQueue <- blk
+}
+
 func (bc *baseConnection) SendDisconnect(shutdownType uint8) {
 	bc.logger.Debugf("Send disconnect block: %v\n", shutdownType)
 	blk := bc.blockProcessor.packDisconnect(bc.connectionID, shutdownType)
@@ -87,6 +138,20 @@ func (bc *baseConnection) SendDisconnect(shutdownType uint8) {
 	}
 }
 
+// Nothing is sent if the connection is closed already
+func (bc *baseConnection) SendReset(reason uint8) {
+	if bc.closed.CAS(false, true) {
+		bc.sendReset(reason)
+	}
+	bc.Stop()
+}
+
+func (bc *baseConnection) sendReset(reason uint8) {
+	bc.logger.Debugf("Send reset block: %v\n", reason)
+	blk := bc.blockProcessor.packReset(bc.connectionID, reason)
+	bc.sendQueue <- blk
+}
+
 func (bc *baseConnection) sendData(data []byte) {
 	bc.logger.Debugln("Send data block.")
 	blocks := bc.blockProcessor.packData(data, bc.connectionID)
@@ -0,0 +1,328 @@
+package connection
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/accesslog"
+	"github.com/ihciah/rabbit-tcp/block"
+	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
+	"go.uber.org/atomic"
+)
+
+// Datagram is a UDP session carried by tunnels. Its blocks skip blockProcessor, since
+// datagrams need no ordering; when queues are full, datagrams are dropped instead of blocking.
+type Datagram interface {
+	GetSessionID() uint32
+	RecvBlock(block.Block)
+}
+
+// DatagramConn is the client side of a UDP session, datagrams written to it are sent
+// from the server side to the given address.
+type DatagramConn struct {
+	sessionID     uint32
+	sendQueue     chan<- block.Block
+	recvQueue     chan block.Block
+	readDeadline  deadline
+	writeDeadline deadline
+	closeOnce     sync.Once
+	localAddr     Addr
+	logger        *logger.Logger
+
+	ctx            context.Context
+	removeFromPool context.CancelFunc
+}
+
+func NewDatagramConn(sessionID uint32, sendQueue chan<- block.Block, ctx context.Context, removeFromPool context.CancelFunc) *DatagramConn {
+	dc := DatagramConn{
+		sessionID:      sessionID,
+		sendQueue:      sendQueue,
+		recvQueue:      make(chan block.Block, DatagramQueueSize),
+		readDeadline:   makeDeadline(),
+		writeDeadline:  makeDeadline(),
+		localAddr:      Addr{ConnectionID: sessionID},
+		logger:         logger.NewLogger("DatagramConn").With("session_id", sessionID),
+		ctx:            ctx,
+		removeFromPool: removeFromPool,
+	}
+	dc.logger.Infof("DatagramConn %d created.\n", sessionID)
+	return &dc
+}
+
+func (dc *DatagramConn) GetSessionID() uint32 {
+	return dc.sessionID
+}
+
+func (dc *DatagramConn) RecvBlock(blk block.Block) {
+	select {
+	case dc.recvQueue <- blk:
+	default:
+		dc.logger.Debugln("Datagram dropped because recv queue is full.")
+		blk.Release()
+	}
+}
+
+// ReadFrom returns a datagram and the address it comes from
+func (dc *DatagramConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		select {
+		case blk := <-dc.recvQueue:
+			address, data, err := blk.ParseDatagram()
+			if err != nil {
+				dc.logger.Warnf("Error when parse datagram: %v.\n", err)
+				blk.Release()
+				continue
+			}
+			n = copy(p, data)
+			blk.Release()
+			return n, &Addr{ConnectionID: dc.sessionID, Address: address}, nil
+		case <-dc.readDeadline.wait():
+			return 0, nil, dc.opError("read", nil, os.ErrDeadlineExceeded)
+		case <-dc.ctx.Done():
+			return 0, nil, dc.opError("read", nil, net.ErrClosed)
+		}
+	}
+}
+
+// WriteTo sends a datagram to addr, which will be resolved by the server side
+func (dc *DatagramConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	blk, err := block.NewDatagramBlock(dc.sessionID, addr.String(), p)
+	if err != nil {
+		return 0, dc.opError("write", addr, err)
+	}
+	select {
+	case <-dc.ctx.Done():
+		return 0, dc.opError("write", addr, net.ErrClosed)
+	case <-dc.writeDeadline.wait():
+		return 0, dc.opError("write", addr, os.ErrDeadlineExceeded)
+	default:
+	}
+	select {
+	case dc.sendQueue <- blk:
+		return len(p), nil
+	case <-dc.writeDeadline.wait():
+		return 0, dc.opError("write", addr, os.ErrDeadlineExceeded)
+	case <-dc.ctx.Done():
+		return 0, dc.opError("write", addr, net.ErrClosed)
+	}
+}
+
+func (dc *DatagramConn) Close() error {
+	err := dc.opError("close", nil, net.ErrClosed)
+	dc.closeOnce.Do(func() {
+		err = nil
+		dc.logger.Debugln("DatagramConn closed.")
+		dc.removeFromPool()
+	})
+	return err
+}
+
+func (dc *DatagramConn) LocalAddr() net.Addr {
+	return &dc.localAddr
+}
+
+func (dc *DatagramConn) SetDeadline(t time.Time) error {
+	dc.readDeadline.set(t)
+	dc.writeDeadline.set(t)
+	return nil
+}
+
+func (dc *DatagramConn) SetReadDeadline(t time.Time) error {
+	dc.readDeadline.set(t)
+	return nil
+}
+
+func (dc *DatagramConn) SetWriteDeadline(t time.Time) error {
+	dc.writeDeadline.set(t)
+	return nil
+}
+
+func (dc *DatagramConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    dc.localAddr.Network(),
+		Source: &dc.localAddr,
+		Addr:   addr,
+		Err:    err,
+	}
+}
+
+// OutboundDatagram is the server side of a UDP session, a UDP socket sending datagrams
+// to the requested addresses. Its relays start with the first block received,
+// and it is closed after idle for DatagramSessionTimeout of options.
+type OutboundDatagram struct {
+	sessionID  uint32
+	conn       *net.UDPConn
+	sendQueue  chan<- block.Block
+	recvQueue  chan block.Block
+	addrCache  map[string]*net.UDPAddr // Only accessed by SendRelay
+	lastActive *atomic.Int64           // Unix time in nanoseconds of the latest datagram of either direction
+	relayOnce  sync.Once
+	access     *accessRecorder // Nil if access log is disabled
+	opts       *options.Options
+	logger     *logger.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewOutboundDatagram(sessionID uint32, sendQueue chan<- block.Block, opts *options.Options, ctx context.Context, removeFromPool context.CancelFunc) (*OutboundDatagram, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	od := OutboundDatagram{
+		sessionID:  sessionID,
+		conn:       conn,
+		sendQueue:  sendQueue,
+		recvQueue:  make(chan block.Block, DatagramQueueSize),
+		addrCache:  make(map[string]*net.UDPAddr),
+		lastActive: atomic.NewInt64(time.Now().UnixNano()),
+		opts:       opts,
+		logger:     logger.NewLogger("OutboundDatagram").With("session_id", sessionID),
+		ctx:        ctx,
+		cancel:     removeFromPool,
+	}
+	od.logger.Infof("OutboundDatagram %d created on %s.\n", sessionID, conn.LocalAddr())
+	return &od, nil
+}
+
+// Log an access record when the session ends, record should have kind and peer fields filled.
+// It must be called before any block is received.
+func (od *OutboundDatagram) EnableAccessLog(log *accesslog.Logger, record accesslog.Record) {
+	od.access = newAccessRecorder(log, record)
+}
+
+// Start relays, the destination of the first block is logged as the destination of the session
+func (od *OutboundDatagram) startRelays(first block.Block) {
+	if od.access == nil {
+		go od.RecvRelay()
+		go od.SendRelay()
+		return
+	}
+	address, _, _ := first.ParseDatagram()
+	od.access.start(address)
+	// Log after both relays end, so all bytes are counted
+	var relays sync.WaitGroup
+	relays.Add(2)
+	go func() {
+		defer relays.Done()
+		od.RecvRelay()
+	}()
+	go func() {
+		defer relays.Done()
+		od.SendRelay()
+	}()
+	go func() {
+		relays.Wait()
+		od.access.finish()
+	}()
+}
+
+func (od *OutboundDatagram) GetSessionID() uint32 {
+	return od.sessionID
+}
+
+func (od *OutboundDatagram) RecvBlock(blk block.Block) {
+	od.relayOnce.Do(func() {
+		od.startRelays(blk)
+	})
+	select {
+	case od.recvQueue <- blk:
+	default:
+		od.logger.Debugln("Datagram dropped because recv queue is full.")
+		blk.Release()
+	}
+}
+
+func (od *OutboundDatagram) closeThenCancel() {
+	od.conn.Close()
+	od.cancel()
+}
+
+// UDP socket -> ConnectionPool's SendQueue -> TunnelPool
+func (od *OutboundDatagram) RecvRelay() {
+	recvBuffer := make([]byte, DatagramRecvBuffer)
+	for {
+		od.conn.SetReadDeadline(time.Now().Add(od.opts.OutboundBlockTimeout))
+		n, addr, err := od.conn.ReadFromUDP(recvBuffer)
+		if err == nil {
+			od.lastActive.Store(time.Now().UnixNano())
+			od.access.addOut(n)
+			blk, err := block.NewDatagramBlock(od.sessionID, addr.String(), recvBuffer[:n])
+			if err != nil {
+				od.logger.Debugf("Datagram of %d bytes from %s dropped: %v.\n", n, addr, err)
+				continue
+			}
+			select {
+			case od.sendQueue <- blk:
+			default:
+				od.logger.Debugln("Datagram dropped because send queue is full.")
+				blk.Release()
+			}
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if time.Since(time.Unix(0, od.lastActive.Load())) > od.opts.DatagramSessionTimeout {
+				od.logger.Infoln("Session idle timeout.")
+				od.access.setReason(accesslog.ReasonIdle)
+				od.closeThenCancel()
+				return
+			}
+		} else {
+			od.logger.Debugf("Error when recv from UDP socket: %v.\n", err)
+			if od.ctx.Err() == nil {
+				// Not closed by SendRelay
+				od.access.setReason(accesslog.ReasonError)
+			}
+			od.closeThenCancel()
+			return
+		}
+		select {
+		case <-od.ctx.Done():
+			od.closeThenCancel()
+			return
+		default:
+		}
+	}
+}
+
+// recvQueue -> UDP socket
+func (od *OutboundDatagram) SendRelay() {
+	for {
+		select {
+		case blk := <-od.recvQueue:
+			od.sendOut(blk)
+		case <-od.ctx.Done():
+			od.closeThenCancel()
+			return
+		}
+	}
+}
+
+// Send a datagram block to its destination, the block is released after that
+func (od *OutboundDatagram) sendOut(blk block.Block) {
+	defer blk.Release()
+	address, data, err := blk.ParseDatagram()
+	if err != nil {
+		od.logger.Warnf("Error when parse datagram: %v.\n", err)
+		return
+	}
+	addr, ok := od.addrCache[address]
+	if !ok {
+		addr, err = net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			od.logger.Warnf("Error when resolve %s: %v.\n", address, err)
+			return
+		}
+		od.addrCache[address] = addr
+	}
+	od.lastActive.Store(time.Now().UnixNano())
+	n, err := od.conn.WriteToUDP(data, addr)
+	od.access.addIn(n)
+	if err != nil {
+		od.logger.Debugf("Error when send datagram to %s: %v.\n", address, err)
+	}
+}
@@ -2,52 +2,93 @@ package connection
 
 import (
 	"context"
-	"fmt"
 	"io"
-	"math/rand"
 	"net"
+	"os"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/ihciah/rabbit-tcp/accesslog"
 	"github.com/ihciah/rabbit-tcp/block"
 	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
 	"go.uber.org/atomic"
 )
 
 type InboundConnection struct {
 	baseConnection
 	dataBuffer ByteRingBuffer
+	ctx        context.Context
 
-	writeCtx context.Context
-	readCtx  context.Context
+	readLock      sync.Mutex // Guards dataBuffer and keeps Read atomic
+	writeLock     sync.Mutex // Keeps blocks of one Write contiguous
+	readDeadline  deadline
+	writeDeadline deadline
+	closeOnce     sync.Once
+	closeSignal   chan struct{} // Closed when Close is called locally
 
-	readClosed  *atomic.Bool
-	writeClosed *atomic.Bool
+	localAddr  Addr
+	remoteAddr Addr
+
+	readClosed        *atomic.Bool  // CloseRead is called, blocks received later are discarded
+	writeClosed       *atomic.Bool  // CloseWrite is called, ShutdownWrite has been sent
+	remoteWriteClosed *atomic.Bool  // ShutdownWrite received, Read returns EOF after data left
+	resetErr          *atomic.Error // Reset received, Read and Write fail with it
+}
+
+// opts should have defaults filled, see options.Options.WithDefaults
+func NewInboundConnection(connectionID uint32, sendQueue chan<- block.Block, opts *options.Options, ctx context.Context, removeFromPool context.CancelFunc) Connection {
+	c := newInboundConnection(connectionID, sendQueue, opts, ctx, removeFromPool)
+	c.logger.Infof("InboundConnection %d created.\n", connectionID)
+	return &c
 }
 
-func NewInboundConnection(sendQueue chan<- block.Block, ctx context.Context, removeFromPool context.CancelFunc) Connection {
-	connectionID := rand.Uint32()
-	c := InboundConnection{
+func newInboundConnection(connectionID uint32, sendQueue chan<- block.Block, opts *options.Options, ctx context.Context, removeFromPool context.CancelFunc) InboundConnection {
+	return InboundConnection{
 		baseConnection: baseConnection{
-			blockProcessor:   newBlockProcessor(ctx, removeFromPool),
+			blockProcessor:   newBlockProcessor(opts, ctx, removeFromPool),
 			connectionID:     connectionID,
 			closed:           atomic.NewBool(false),
 			sendQueue:        sendQueue,
 			recvQueue:        make(chan block.Block, RecvQueueSize),
 			orderedRecvQueue: make(chan block.Block, OrderedRecvQueueSize),
-			logger:           logger.NewLogger(fmt.Sprintf("[InboundConnection-%d]", connectionID)),
+			logger:           logger.NewLogger("InboundConnection").With("conn_id", connectionID),
 		},
-		dataBuffer:  NewByteRingBuffer(block.MaxSize),
-		readCtx:     ctx,
-		writeCtx:    ctx,
-		readClosed:  atomic.NewBool(false),
-		writeClosed: atomic.NewBool(false),
+		dataBuffer:        NewByteRingBuffer(block.MaxSize),
+		ctx:               ctx,
+		readDeadline:      makeDeadline(),
+		writeDeadline:     makeDeadline(),
+		closeSignal:       make(chan struct{}),
+		localAddr:         Addr{ConnectionID: connectionID},
+		remoteAddr:        Addr{ConnectionID: connectionID},
+		readClosed:        atomic.NewBool(false),
+		writeClosed:       atomic.NewBool(false),
+		remoteWriteClosed: atomic.NewBool(false),
+		resetErr:          atomic.NewError(nil),
 	}
-	c.logger.Infof("InboundConnection %d created.\n", connectionID)
-	return &c
 }
 
 func (c *InboundConnection) Read(b []byte) (n int, err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	defer func() {
+		c.access.addIn(n)
+	}()
+
+	if isClosedChan(c.closeSignal) {
+		return 0, c.opError("read", net.ErrClosed)
+	}
+	if c.readClosed.Load() {
+		return 0, io.EOF
+	}
+	if isClosedChan(c.readDeadline.wait()) {
+		return 0, c.opError("read", os.ErrDeadlineExceeded)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
 	readN := 0
 
 	if !c.dataBuffer.Empty() {
@@ -59,7 +100,7 @@ func (c *InboundConnection) Read(b []byte) (n int, err error) {
 		}
 	}
 
-	if c.closed.Load() || c.readClosed.Load() {
+	if c.closed.Load() || c.remoteWriteClosed.Load() {
 		// Connection is closed, should read all data left in channel
 		for {
 			select {
@@ -71,6 +112,8 @@ func (c *InboundConnection) Read(b []byte) (n int, err error) {
 			default:
 				if readN != 0 {
 					return readN, nil
+				} else if err := c.resetErr.Load(); err != nil {
+					return 0, c.opError("read", err)
 				} else {
 					return 0, io.EOF
 				}
@@ -79,63 +122,64 @@ func (c *InboundConnection) Read(b []byte) (n int, err error) {
 	}
 
 	// Read at lease something
-	if readN == 0 {
+	for readN == 0 {
 		select {
 		case blk := <-c.orderedRecvQueue:
 			c.logger.Debugln("Read in a block.")
-			err := c.readBlock(&blk, &readN, b)
-			if err == io.EOF || readN == len(b) {
-				if readN != 0 {
-					return readN, nil
-				} else {
-					return 0, err
-				}
+			if err := c.readBlock(&blk, &readN, b); err != nil {
+				return 0, err
 			}
-		case <-c.readCtx.Done():
-			c.logger.Infoln("ReadDeadline exceeded.")
-			if readN != 0 {
-				return readN, nil
-			} else {
-				return 0, io.EOF
+		case <-c.ctx.Done():
+			if isClosedChan(c.closeSignal) {
+				return 0, c.opError("read", net.ErrClosed)
 			}
+			// Aborted without reset from the other side, e.g. peer is gone or blocks are lost
+			c.logger.Infoln("Connection removed from pool.")
+			return 0, c.opError("read", syscall.ECONNRESET)
+		case <-c.readDeadline.wait():
+			c.logger.Debugln("ReadDeadline exceeded.")
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		case <-c.closeSignal:
+			return 0, c.opError("read", net.ErrClosed)
 		}
 	}
 
-	if readN == 0 {
-		c.logger.Errorln("Unknown error.")
-	}
-
-	for {
+	for readN < len(b) {
 		select {
 		case blk := <-c.orderedRecvQueue:
-			err := c.readBlock(&blk, &readN, b)
 			c.logger.Debugln("Read in a block.")
-			if err == io.EOF || readN == len(b) {
+			if err := c.readBlock(&blk, &readN, b); err != nil {
 				return readN, nil
 			}
-		case <-c.readCtx.Done():
-			c.logger.Infoln("ReadDeadline exceeded.")
-			return readN, nil
 		default:
 			return readN, nil
 		}
 	}
+	return readN, nil
 }
 
+// Read data or control info from block, the block is released after that
 func (c *InboundConnection) readBlock(blk *block.Block, readN *int, b []byte) (err error) {
+	defer blk.Release()
 	switch blk.Type {
 	case block.TypeDisconnect:
-		// TODO: decide shutdown type
 		if blk.BlockData[0] == block.ShutdownBoth {
+			c.setCloseReason(accesslog.ReasonPeerClose)
 			c.closed.Store(true)
 			return io.EOF
 		} else if blk.BlockData[0] == block.ShutdownWrite {
-			c.readClosed.Store(true)
+			c.remoteWriteClosed.Store(true)
 			return io.EOF
-		} else if blk.BlockData[0] == block.ShutdownRead {
-			c.writeClosed.Store(true)
-			return nil
 		}
+		// ShutdownRead is not visible to the writer, like shutdown(SHUT_RD) of TCP
+		return nil
+	case block.TypeReset:
+		err := resetError(blk.BlockData[0])
+		c.logger.Debugf("Connection reset by the other side: %v.\n", err)
+		c.setCloseReason(resetAccessReason(blk.BlockData[0]))
+		c.resetErr.Store(err)
+		c.closed.Store(true)
+		return c.opError("read", err)
 	case block.TypeData:
 		dst := b[*readN:]
 		if len(dst) < len(blk.BlockData) {
@@ -151,55 +195,189 @@ func (c *InboundConnection) readBlock(blk *block.Block, readN *int, b []byte) (e
 }
 
 func (c *InboundConnection) Write(b []byte) (n int, err error) {
-	// TODO: tag all blocks from b using WaitGroup
-	// TODO: and wait all blocks sent?
-	if c.writeClosed.Load() || c.closed.Load() {
-		return 0, syscall.EINVAL
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	defer func() {
+		c.access.addOut(n)
+	}()
+
+	switch {
+	case isClosedChan(c.closeSignal):
+		return 0, c.opError("write", net.ErrClosed)
+	case c.resetErr.Load() != nil:
+		return 0, c.opError("write", c.resetErr.Load())
+	case c.writeClosed.Load() || c.closed.Load():
+		return 0, c.opError("write", syscall.EPIPE)
+	case isClosedChan(c.writeDeadline.wait()):
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	}
+
+	blocks := c.blockProcessor.packData(b, c.connectionID)
+	for i, blk := range blocks {
+		select {
+		case c.sendQueue <- blk:
+			continue
+		case <-c.writeDeadline.wait():
+			err = c.opError("write", os.ErrDeadlineExceeded)
+		case <-c.closeSignal:
+			err = c.opError("write", net.ErrClosed)
+		case <-c.ctx.Done():
+			err = c.opError("write", syscall.EPIPE)
+		}
+		// Block IDs of unsent blocks are taken, fill them or the other side will wait for them
+		go c.fillHoles(blocks[i:])
+		// Blocks except the last one are full, BlockData cannot be counted since it may be compressed
+		return i * block.DataSize, err
 	}
-	c.sendData(b)
 	return len(b), nil
 }
 
-func (c *InboundConnection) Close() error {
-	if c.closed.CAS(false, true) {
-		c.SendDisconnect(block.ShutdownBoth)
+// Send empty data blocks in place of blocks which have been packed but not sent
+func (c *InboundConnection) fillHoles(blocks []block.Block) {
+	for _, blk := range blocks {
+		filler := block.Block{
+			Type:         block.TypeData,
+			ConnectionID: blk.ConnectionID,
+			BlockID:      blk.BlockID,
+		}
+		blk.Release()
+		select {
+		case c.sendQueue <- filler:
+		case <-time.After(c.blockProcessor.opts.PacketWaitTimeout):
+			// The other side must have given up waiting
+			return
+		}
 	}
+}
+
+func (c *InboundConnection) SendConnect(address string) {
+	c.remoteAddr.Address = address
+	c.baseConnection.SendConnect(address)
+}
+
+func (c *InboundConnection) Close() error {
+	err := c.opError("close", net.ErrClosed)
+	c.closeOnce.Do(func() {
+		err = nil
+		close(c.closeSignal)
+		c.setCloseReason(accesslog.ReasonEOF)
+		c.access.finish()
+		// Both sides have finished writing, and the other side removes its end on our ShutdownWrite
+		finished := c.writeClosed.Load() && c.remoteWriteClosed.Load()
+		if c.closed.CAS(false, true) && !finished {
+			// Don't block Close if the pool is congested
+			go c.SendDisconnect(block.ShutdownBoth)
+		}
+	})
 	c.Stop()
-	return nil
+	return err
+}
+
+// Abort the connection like closing TCP with SO_LINGER 0, the other side resets its real connection.
+// reason is one of block.ResetReason.
+func (c *InboundConnection) Reset(reason uint8) error {
+	err := c.opError("close", net.ErrClosed)
+	c.closeOnce.Do(func() {
+		err = nil
+		close(c.closeSignal)
+		c.setCloseReason(resetAccessReason(reason))
+		c.access.finish()
+		// Don't block if the pool is congested
+		go c.SendReset(reason)
+	})
+	return err
 }
 
+// Read returns EOF after CloseRead. The other side stops reading its real connection,
+// but like TCP, its writer is not notified.
 func (c *InboundConnection) CloseRead() error {
+	if isClosedChan(c.closeSignal) {
+		return c.opError("close", net.ErrClosed)
+	}
+	if !c.readClosed.CAS(false, true) || c.remoteWriteClosed.Load() || c.closed.Load() {
+		// Nothing more is coming
+		return nil
+	}
 	c.SendDisconnect(block.ShutdownRead)
+	go c.discard()
 	return nil
 }
 
+// Release blocks nobody will read after CloseRead, until the other side finishes writing
+func (c *InboundConnection) discard() {
+	for {
+		select {
+		case blk := <-c.orderedRecvQueue:
+			if blk.Type != block.TypeDisconnect && blk.Type != block.TypeReset {
+				blk.Release()
+				continue
+			}
+			readN := 0
+			if err := c.readBlock(&blk, &readN, nil); err != nil {
+				return
+			}
+		case <-c.ctx.Done():
+			return
+		case <-c.closeSignal:
+			return
+		}
+	}
+}
+
+// Send FIN, data written before is delivered first. Write fails with EPIPE after that.
 func (c *InboundConnection) CloseWrite() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if isClosedChan(c.closeSignal) {
+		return c.opError("close", net.ErrClosed)
+	}
+	if c.closed.Load() || !c.writeClosed.CAS(false, true) {
+		return nil
+	}
+	c.setCloseReason(accesslog.ReasonEOF)
 	c.SendDisconnect(block.ShutdownWrite)
 	return nil
 }
 
 func (c *InboundConnection) LocalAddr() net.Addr {
-	// TODO
-	return nil
+	return &c.localAddr
 }
 
 func (c *InboundConnection) RemoteAddr() net.Addr {
-	// TODO
-	return nil
+	return &c.remoteAddr
 }
 
 func (c *InboundConnection) SetDeadline(t time.Time) error {
-	_ = c.SetReadDeadline(t)
-	_ = c.SetWriteDeadline(t)
+	if isClosedChan(c.closeSignal) {
+		return c.opError("set", net.ErrClosed)
+	}
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
 	return nil
 }
 
 func (c *InboundConnection) SetReadDeadline(t time.Time) error {
-	c.readCtx, _ = context.WithDeadline(context.Background(), t)
+	if isClosedChan(c.closeSignal) {
+		return c.opError("set", net.ErrClosed)
+	}
+	c.readDeadline.set(t)
 	return nil
 }
 
 func (c *InboundConnection) SetWriteDeadline(t time.Time) error {
-	c.writeCtx, _ = context.WithDeadline(context.Background(), t)
+	if isClosedChan(c.closeSignal) {
+		return c.opError("set", net.ErrClosed)
+	}
+	c.writeDeadline.set(t)
 	return nil
 }
+
+func (c *InboundConnection) opError(op string, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    c.localAddr.Network(),
+		Source: &c.localAddr,
+		Addr:   &c.remoteAddr,
+		Err:    err,
+	}
+}
@@ -0,0 +1,45 @@
+package connection_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ihciah/rabbit-tcp/client"
+	"github.com/ihciah/rabbit-tcp/netsim"
+	"github.com/ihciah/rabbit-tcp/options"
+	"github.com/ihciah/rabbit-tcp/server"
+	"github.com/ihciah/rabbit-tcp/tunnel"
+	"golang.org/x/net/nettest"
+)
+
+// Dial an InboundConnection from a client, and take the AcceptedConnection of a listener server as the other end
+func makeClientServerPipe() (c1, c2 net.Conn, stop func(), err error) {
+	network := netsim.NewNetwork(1)
+	serverListener, err := network.Listen(netsim.ServerAddress)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cipher, err := tunnel.NewAEADCipher("CHACHA20-IETF-POLY1305", nil, "nettest")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s := server.NewListenerServer(cipher, nil)
+	go s.ServeListener(serverListener)
+	c := client.NewClient(2, netsim.ServerAddress, cipher, &options.Options{DialTunnel: network.Dial})
+	stop = func() {
+		c.Close()
+		network.Close()
+	}
+
+	c1 = c.Dial("nettest:1")
+	c2, err = s.Listener().Accept()
+	if err != nil {
+		stop()
+		return nil, nil, nil, err
+	}
+	return c1, c2, stop, nil
+}
+
+func TestInboundConnection(t *testing.T) {
+	nettest.TestConn(t, makeClientServerPipe)
+}
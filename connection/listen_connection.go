@@ -0,0 +1,202 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/accesslog"
+	"github.com/ihciah/rabbit-tcp/block"
+	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
+	"go.uber.org/atomic"
+)
+
+// ErrNoStream is returned by Write of ListenConnection, which carries no bytes itself
+var ErrNoStream = errors.New("listen connection carries no bytes")
+
+// ListenConnection listens on the address requested by the other side, and carries
+// every accepted connection back to it through a new InboundConnection.
+// It lives until either side sends disconnect.
+type ListenConnection struct {
+	baseConnection
+	listenerLock  sync.Mutex // Guards listener
+	listener      net.Listener
+	newConnection func() Connection // Create a pooled InboundConnection
+	localAddr     Addr
+	ctx           context.Context
+	cancel        context.CancelFunc
+}
+
+func NewListenConnection(connectionID uint32, newConnection func() Connection, sendQueue chan<- block.Block, opts *options.Options, ctx context.Context, removeFromPool context.CancelFunc) Connection {
+	c := ListenConnection{
+		baseConnection: baseConnection{
+			blockProcessor:   newBlockProcessor(opts, ctx, removeFromPool),
+			connectionID:     connectionID,
+			closed:           atomic.NewBool(true),
+			sendQueue:        sendQueue,
+			recvQueue:        make(chan block.Block, RecvQueueSize),
+			orderedRecvQueue: make(chan block.Block, OrderedRecvQueueSize),
+			logger:           logger.NewLogger("ListenConnection").With("conn_id", connectionID),
+		},
+		newConnection: newConnection,
+		localAddr:     Addr{ConnectionID: connectionID},
+		ctx:           ctx,
+		cancel:        removeFromPool,
+	}
+	c.logger.Infof("ListenConnection %d created.\n", connectionID)
+	return &c
+}
+
+func (lc *ListenConnection) RecvBlock(blk block.Block) {
+	if blk.Type == block.TypeListen {
+		address := string(blk.BlockData)
+		go lc.listen(address)
+	}
+	lc.baseConnection.RecvBlock(blk)
+}
+
+func (lc *ListenConnection) listen(address string) {
+	lc.listenerLock.Lock()
+	if !lc.closed.Load() || lc.listener != nil {
+		lc.listenerLock.Unlock()
+		return
+	}
+	lc.access.start(address)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		lc.access.setReason(accesslog.ReasonListenError)
+		lc.access.finish()
+		lc.listenerLock.Unlock()
+		lc.logger.Warnf("Error when listen on %s: %v.\n", address, err)
+		lc.SendDisconnect(block.ShutdownBoth)
+		return
+	}
+	lc.logger.Infof("Listen on %s successfully.\n", address)
+	lc.listener = listener
+	lc.closed.Toggle()
+	lc.listenerLock.Unlock()
+	go lc.acceptRelay(listener, address)
+	go lc.controlRelay()
+}
+
+// Accept connections and carry them back with connect block of the listen address
+func (lc *ListenConnection) acceptRelay(listener net.Listener, address string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			lc.logger.Infof("Stop accepting on %s: %v.\n", address, err)
+			if lc.ctx.Err() == nil {
+				// Not closed by ourselves
+				lc.access.setReason(accesslog.ReasonError)
+			}
+			lc.closeThenCancelWithOnceSend()
+			return
+		}
+		go func() {
+			lc.logger.Infof("Accepted a connection from %s.\n", conn.RemoteAddr())
+			upper := lc.newConnection()
+			if lc.access != nil {
+				// Logged once both directions are relayed and upper is closed
+				record := lc.access.record
+				record.Kind = accesslog.KindReverse
+				record.Remote = conn.RemoteAddr().String()
+				upper.(*InboundConnection).EnableAccessLog(lc.access.log, record)
+				upper.(*InboundConnection).access.start(address)
+			}
+			upper.SendConnect(address)
+			BiRelay(conn.(*net.TCPConn), upper, lc.logger)
+		}()
+	}
+}
+
+// Wait for disconnect from the other side, or the connection removed from pool
+func (lc *ListenConnection) controlRelay() {
+	for {
+		select {
+		case blk := <-lc.orderedRecvQueue:
+			blk.Release()
+			if blk.Type == block.TypeDisconnect || blk.Type == block.TypeReset {
+				lc.logger.Debugln("Remote listener closed by the other side.")
+				lc.access.setReason(accesslog.ReasonPeerClose)
+				lc.closed.Store(true)
+				lc.closeListener()
+				lc.cancel()
+				return
+			}
+		case <-lc.ctx.Done():
+			lc.closeThenCancelWithOnceSend()
+			return
+		}
+	}
+}
+
+func (lc *ListenConnection) closeThenCancelWithOnceSend() {
+	lc.closeListener()
+	lc.cancel()
+	if lc.closed.CAS(false, true) {
+		lc.SendDisconnect(block.ShutdownBoth)
+	}
+}
+
+// The access record is logged along, it's started under the lock as well
+func (lc *ListenConnection) closeListener() {
+	lc.listenerLock.Lock()
+	defer lc.listenerLock.Unlock()
+	if lc.listener != nil {
+		lc.listener.Close()
+	}
+	lc.access.finish()
+}
+
+// Stop listening and tell the other side
+func (lc *ListenConnection) Close() error {
+	lc.closeThenCancelWithOnceSend()
+	return nil
+}
+
+// ListenConnection carries no bytes, so Read always returns EOF
+func (lc *ListenConnection) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (lc *ListenConnection) Write(b []byte) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: lc.localAddr.Network(), Source: &lc.localAddr, Err: ErrNoStream}
+}
+
+func (lc *ListenConnection) CloseRead() error {
+	return nil
+}
+
+func (lc *ListenConnection) CloseWrite() error {
+	return nil
+}
+
+// Address listened on, or the connection address before listening
+func (lc *ListenConnection) LocalAddr() net.Addr {
+	lc.listenerLock.Lock()
+	defer lc.listenerLock.Unlock()
+	if lc.listener != nil {
+		return lc.listener.Addr()
+	}
+	return &lc.localAddr
+}
+
+func (lc *ListenConnection) RemoteAddr() net.Addr {
+	return &lc.localAddr
+}
+
+func (lc *ListenConnection) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (lc *ListenConnection) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (lc *ListenConnection) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -2,41 +2,72 @@ package connection
 
 import (
 	"context"
-	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/ihciah/rabbit-tcp/accesslog"
 	"github.com/ihciah/rabbit-tcp/block"
+	"github.com/ihciah/rabbit-tcp/fault"
 	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
 	"go.uber.org/atomic"
 )
 
 type OutboundConnection struct {
 	baseConnection
 	HalfOpenConn
+	dial   DialFunc
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	bindPolicy BindPolicy // If not nil, addresses bound by it are dialed by bindDial instead
+	bindDial   BindDialFunc
+
+	// Directions of the real connection, it's closed once both are shut down
+	readShutdown  *atomic.Bool // EOF read, ShutdownWrite has been sent
+	writeShutdown *atomic.Bool // ShutdownWrite received, CloseWrite has been called
+	aborted       *atomic.Bool // Real connection is closed with RST
 }
 
-func NewOutboundConnection(connectionID uint32, sendQueue chan<- block.Block, ctx context.Context, removeFromPool context.CancelFunc) Connection {
+func NewOutboundConnection(connectionID uint32, dial DialFunc, sendQueue chan<- block.Block, opts *options.Options, ctx context.Context, removeFromPool context.CancelFunc) Connection {
 	c := OutboundConnection{
 		baseConnection: baseConnection{
-			blockProcessor:   newBlockProcessor(ctx, removeFromPool),
+			blockProcessor:   newBlockProcessor(opts, ctx, removeFromPool),
 			connectionID:     connectionID,
 			closed:           atomic.NewBool(true),
 			sendQueue:        sendQueue,
 			recvQueue:        make(chan block.Block, RecvQueueSize),
 			orderedRecvQueue: make(chan block.Block, OrderedRecvQueueSize),
-			logger:           logger.NewLogger(fmt.Sprintf("[OutboundConnection-%d]", connectionID)),
+			logger:           logger.NewLogger("OutboundConnection").With("conn_id", connectionID),
 		},
-		ctx:    ctx,
-		cancel: removeFromPool,
+		dial:          dial,
+		ctx:           ctx,
+		cancel:        removeFromPool,
+		readShutdown:  atomic.NewBool(false),
+		writeShutdown: atomic.NewBool(false),
+		aborted:       atomic.NewBool(false),
 	}
 	c.logger.Infof("OutboundConnection %d created.\n", connectionID)
 	return &c
 }
 
+// Dial addresses bound by policy with dial instead, it must be called before any block is received
+func (oc *OutboundConnection) EnableBind(policy BindPolicy, dial BindDialFunc) {
+	oc.bindPolicy, oc.bindDial = policy, dial
+}
+
+func (oc *OutboundConnection) dialOut(address string) (HalfOpenConn, error) {
+	if oc.bindPolicy != nil {
+		if bind := oc.bindPolicy(address); bind != nil {
+			oc.logger.Debug("Dial with bind.", "remote", address, "device", bind.Device, "mark", bind.Mark)
+			return oc.bindDial(address, bind)
+		}
+	}
+	return oc.dial(address)
+}
+
 func (oc *OutboundConnection) closeThenCancelWithOnceSend() {
 	oc.HalfOpenConn.Close()
 	oc.cancel()
@@ -46,28 +77,59 @@ func (oc *OutboundConnection) closeThenCancelWithOnceSend() {
 }
 
 func (oc *OutboundConnection) closeThenCancel() {
-	oc.HalfOpenConn.Close()
+	if oc.aborted.Load() {
+		abort(oc.HalfOpenConn, nil)
+	} else {
+		oc.HalfOpenConn.Close()
+	}
 	oc.cancel()
 }
 
+// The real connection is reset once relays stop
+func (oc *OutboundConnection) SendReset(reason uint8) {
+	oc.aborted.Store(true)
+	oc.baseConnection.SendReset(reason)
+}
+
+// Reset both the real connection and the other side due to err
+func (oc *OutboundConnection) abortWith(err error) {
+	oc.access.setReason(ioErrorReason(err))
+	oc.SendReset(resetReason(err))
+	oc.closeThenCancel()
+}
+
+// Shut down one direction, the connection is closed without disconnect block once both are shut down,
+// since the other side has sent and received ShutdownWrite as well.
+func (oc *OutboundConnection) shutdown(direction *atomic.Bool) {
+	direction.Store(true)
+	if oc.readShutdown.Load() && oc.writeShutdown.Load() && oc.closed.CAS(false, true) {
+		oc.logger.Debugln("Both directions are shut down.")
+		oc.closeThenCancel()
+	}
+}
+
 // real connection -> ConnectionPool's SendQueue -> TunnelPool
 func (oc *OutboundConnection) RecvRelay() {
-	recvBuffer := make([]byte, OutboundRecvBuffer)
+	recvBuffer := make([]byte, oc.blockProcessor.opts.OutboundRecvBuffer)
 	for {
-		oc.HalfOpenConn.SetReadDeadline(time.Now().Add(OutboundBlockTimeoutSec * time.Second))
+		oc.HalfOpenConn.SetReadDeadline(time.Now().Add(oc.blockProcessor.opts.OutboundBlockTimeout))
 		n, err := oc.HalfOpenConn.Read(recvBuffer)
 		if err == nil {
+			oc.access.addOut(n)
 			oc.sendData(recvBuffer[:n])
 			oc.HalfOpenConn.SetReadDeadline(time.Time{})
 		} else if err == io.EOF {
+			// The other direction keeps going until the other side shuts down its write as well
 			oc.logger.Debugln("EOF received from outbound connection.")
-			oc.closeThenCancelWithOnceSend()
+			oc.access.setReason(accesslog.ReasonEOF)
+			oc.SendDisconnect(block.ShutdownWrite)
+			oc.shutdown(oc.readShutdown)
 			return
 		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 			oc.logger.Debugln("Receive timeout from outbound connection.")
 		} else {
 			oc.logger.Errorf("Error when recv relay outbound connection: %v\n.", err)
-			oc.closeThenCancelWithOnceSend()
+			oc.abortWith(err)
 			return
 		}
 		select {
@@ -77,6 +139,7 @@ func (oc *OutboundConnection) RecvRelay() {
 				n, err := oc.HalfOpenConn.Read(recvBuffer)
 				if err == nil {
 					oc.logger.Debugln("Data received from outbound connection successfully after close.")
+					oc.access.addOut(n)
 					oc.sendData(recvBuffer[:n])
 				} else {
 					oc.logger.Debugf("Error when receiving data from outbound connection after close: %v.\n", err)
@@ -95,32 +158,7 @@ func (oc *OutboundConnection) SendRelay() {
 	for {
 		select {
 		case blk := <-oc.orderedRecvQueue:
-			switch blk.Type {
-			case block.TypeConnect:
-				// Will do nothing!
-				continue
-			case block.TypeData:
-				oc.logger.Debugln("Send out DATA bytes.")
-				oc.HalfOpenConn.SetWriteDeadline(time.Now().Add(OutboundBlockTimeoutSec * time.Second))
-				_, err := oc.HalfOpenConn.Write(blk.BlockData)
-				if err == nil {
-					oc.HalfOpenConn.SetWriteDeadline(time.Time{})
-				} else {
-					oc.logger.Errorf("Error when send relay outbound connection: %v\n.", err)
-					oc.closeThenCancelWithOnceSend()
-				}
-			case block.TypeDisconnect:
-				if blk.BlockData[0] == block.ShutdownRead {
-					oc.logger.Debugf("CloseRead for remote connection\n")
-					oc.HalfOpenConn.CloseRead()
-				} else if blk.BlockData[0] == block.ShutdownWrite {
-					oc.logger.Debugf("CloseWrite for remote connection\n")
-					oc.HalfOpenConn.CloseWrite()
-				} else {
-					oc.logger.Debugln("Send out DISCONNECT action.")
-					oc.closeThenCancel()
-				}
-			}
+			oc.sendOut(blk)
 		case <-oc.ctx.Done():
 			oc.closeThenCancelWithOnceSend()
 			return
@@ -128,12 +166,56 @@ func (oc *OutboundConnection) SendRelay() {
 	}
 }
 
+// Apply a block to real connection, the block is released after that
+func (oc *OutboundConnection) sendOut(blk block.Block) {
+	defer blk.Release()
+	switch blk.Type {
+	case block.TypeConnect:
+		// Will do nothing!
+	case block.TypeData:
+		oc.logger.Debugln("Send out DATA bytes.")
+		oc.HalfOpenConn.SetWriteDeadline(time.Now().Add(oc.blockProcessor.opts.OutboundBlockTimeout))
+		n, err := oc.HalfOpenConn.Write(blk.BlockData)
+		oc.access.addIn(n)
+		if err == nil {
+			oc.HalfOpenConn.SetWriteDeadline(time.Time{})
+		} else {
+			oc.logger.Errorf("Error when send relay outbound connection: %v\n.", err)
+			oc.abortWith(err)
+		}
+	case block.TypeDisconnect:
+		if blk.BlockData[0] == block.ShutdownRead {
+			// Reading returns EOF after that, which shuts down the read direction
+			oc.logger.Debugf("CloseRead for remote connection\n")
+			oc.HalfOpenConn.CloseRead()
+		} else if blk.BlockData[0] == block.ShutdownWrite {
+			oc.logger.Debugf("CloseWrite for remote connection\n")
+			oc.HalfOpenConn.CloseWrite()
+			oc.shutdown(oc.writeShutdown)
+		} else {
+			oc.logger.Debugln("Send out DISCONNECT action.")
+			oc.access.setReason(accesslog.ReasonPeerClose)
+			oc.closed.Store(true)
+			oc.closeThenCancel()
+		}
+	case block.TypeReset:
+		oc.logger.Debugf("Reset remote connection, reason: %d.\n", blk.BlockData[0])
+		oc.access.setReason(resetAccessReason(blk.BlockData[0]))
+		oc.closed.Store(true)
+		oc.aborted.Store(true)
+		oc.closeThenCancel()
+	}
+}
+
 func (oc *OutboundConnection) RecvBlock(blk block.Block) {
 	if blk.Type == block.TypeConnect {
-		address := string(blk.BlockData)
+		address, options := blk.ParseConnect()
+		if options&block.ConnectOptionCompress != 0 {
+			oc.EnableCompression()
+		}
 		go oc.connect(address)
 	}
-	oc.recvQueue <- blk
+	oc.baseConnection.RecvBlock(blk)
 }
 
 func (oc *OutboundConnection) connect(address string) {
@@ -141,15 +223,41 @@ func (oc *OutboundConnection) connect(address string) {
 	if !oc.closed.Load() || oc.HalfOpenConn != nil {
 		return
 	}
-	rawConn, err := net.Dial("tcp", address)
+	if delay := fault.ConnectDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
+	oc.access.start(address)
+	rawConn, err := oc.dialOut(address)
 	if err == nil {
-		oc.logger.Infof("Dial to %s successfully.\n", address)
-		oc.HalfOpenConn = rawConn.(*net.TCPConn)
+		oc.logger.Info("Dial successfully.", "remote", address)
+		oc.HalfOpenConn = rawConn
 		oc.closed.Toggle()
-		go oc.RecvRelay()
-		go oc.SendRelay()
+		if oc.access == nil {
+			go oc.RecvRelay()
+			go oc.SendRelay()
+			return
+		}
+		// Log after both relays end, so all bytes are counted
+		var relays sync.WaitGroup
+		relays.Add(2)
+		go func() {
+			defer relays.Done()
+			oc.RecvRelay()
+		}()
+		go func() {
+			defer relays.Done()
+			oc.SendRelay()
+		}()
+		go func() {
+			relays.Wait()
+			oc.access.finish()
+		}()
 	} else {
-		oc.logger.Warnf("Error when dial to %s: %v.\n", address, err)
-		oc.SendDisconnect(block.ShutdownBoth)
+		oc.logger.Warn("Error when dial.", "remote", address, "error", err)
+		oc.access.setReason(dialErrorReason(err))
+		// Not connected yet, so closed is still true
+		oc.sendReset(resetReason(err))
+		oc.Stop()
+		oc.access.finish()
 	}
 }
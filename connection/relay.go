@@ -0,0 +1,39 @@
+package connection
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/logger"
+)
+
+// Relay bytes between two connections until both directions are finished, then close them
+func BiRelay(left, right HalfOpenConn, logger *logger.Logger) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go relay(left, right, &wg, logger, "left <- right")
+	wg.Add(1)
+	go relay(right, left, &wg, logger, "left -> right")
+	wg.Wait()
+	_ = left.Close()
+	_ = right.Close()
+}
+
+func relay(dst, src HalfOpenConn, wg *sync.WaitGroup, logger *logger.Logger, label string) {
+	defer wg.Done()
+	_, err := io.Copy(dst, src)
+	if err != nil {
+		// Reproduce the abort on both sides, so it's not mistaken for a graceful close
+		_ = dst.SetDeadline(time.Now())
+		_ = src.SetDeadline(time.Now())
+		abort(dst, err)
+		abort(src, err)
+		if err != io.EOF {
+			logger.Errorf("Error when relay %s: %v.\n", label, err)
+		}
+	} else {
+		dst.CloseWrite()
+		src.CloseRead()
+	}
+}
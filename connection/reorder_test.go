@@ -0,0 +1,116 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/block"
+	"github.com/ihciah/rabbit-tcp/options"
+)
+
+// Start OrderedRelay of an InboundConnection waiting for firstBlockID, its reset blocks are sent to the returned queue
+func newRelayedConnection(t *testing.T, opts *options.Options, firstBlockID uint32) (*InboundConnection, chan block.Block) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	sendQueue := make(chan block.Block, 16)
+	c := newInboundConnection(1, sendQueue, opts.WithDefaults(), ctx, cancel)
+	c.blockProcessor.recvBlockID = firstBlockID
+	c.blockProcessor.lastRecvBlockID = firstBlockID
+	go c.OrderedRelay(&c)
+	return &c, sendQueue
+}
+
+func dataBlock(blockID uint32, data byte) block.Block {
+	return block.Block{Type: block.TypeData, ConnectionID: 1, BlockID: blockID, BlockLength: 1, BlockData: []byte{data}}
+}
+
+func TestOrderedRelayWrapAround(t *testing.T) {
+	first := uint32(math.MaxUint32 - 2)
+	c, _ := newRelayedConnection(t, nil, first)
+	// Blocks first..first+5 carry 0..5, the ones after MaxUint32 wrap around to 0..2
+	for _, n := range []int{3, 1, -1, 5, 4, 0, 4, 2} {
+		c.RecvBlock(dataBlock(first+uint32(n), byte(n)))
+	}
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 6)
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range got {
+		if b != byte(i) {
+			t.Fatalf("Read %v, want blocks in order.", got)
+		}
+	}
+	// Neither the block before the first one nor the duplicate is delivered
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := c.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read %d more bytes, error %v.", n, err)
+	}
+}
+
+// Wait for a reset block in sendQueue, whose reason must be block.ResetReasonError
+func waitReset(t *testing.T, sendQueue chan block.Block) {
+	t.Helper()
+	select {
+	case blk := <-sendQueue:
+		if blk.Type != block.TypeReset || blk.BlockData[0] != block.ResetReasonError {
+			t.Fatalf("Block of type %d, data %v is sent, want reset.", blk.Type, blk.BlockData)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection is not reset.")
+	}
+}
+
+func waitReorderStats(t *testing.T, want ReorderStats) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for GetReorderStats() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Reorder stats %+v, want %+v.", GetReorderStats(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReorderBufferFull(t *testing.T) {
+	c, sendQueue := newRelayedConnection(t, &options.Options{ReorderBufferBlocks: 4}, 0)
+	// Block 0 never comes
+	for id := uint32(1); id <= 4; id++ {
+		c.RecvBlock(dataBlock(id, 0))
+	}
+	waitReorderStats(t, ReorderStats{Blocks: 4, Bytes: 4})
+	c.RecvBlock(dataBlock(5, 0))
+	waitReset(t, sendQueue)
+	waitReorderStats(t, ReorderStats{})
+}
+
+func TestGlobalReorderBufferFull(t *testing.T) {
+	opts := &options.Options{ReorderBufferBlocks: 4, GlobalReorderBufferBlocks: 6}
+	c1, sendQueue1 := newRelayedConnection(t, opts, 0)
+	c2, sendQueue2 := newRelayedConnection(t, opts, 0)
+	for id := uint32(1); id <= 3; id++ {
+		c1.RecvBlock(dataBlock(id, 0))
+		c2.RecvBlock(dataBlock(id, 0))
+	}
+	waitReorderStats(t, ReorderStats{Blocks: 6, Bytes: 6})
+	// Within the limit of the connection but not the global one
+	c2.RecvBlock(dataBlock(4, 0))
+	waitReset(t, sendQueue2)
+	waitReorderStats(t, ReorderStats{Blocks: 3, Bytes: 3})
+	select {
+	case blk := <-sendQueue1:
+		t.Fatalf("Block of type %d is sent by the other connection.", blk.Type)
+	default:
+	}
+
+	// Blocks are released when the relay stops
+	c1.Stop()
+	waitReorderStats(t, ReorderStats{})
+}
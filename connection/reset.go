@@ -0,0 +1,66 @@
+package connection
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/ihciah/rabbit-tcp/accesslog"
+	"github.com/ihciah/rabbit-tcp/block"
+)
+
+// Classify an error of real connection into reset reason sent to the other side
+func resetReason(err error) uint8 {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, ErrDenied):
+		return block.ResetReasonDenied
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return block.ResetReasonPeer
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return block.ResetReasonRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return block.ResetReasonUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return block.ResetReasonTimeout
+	}
+	return block.ResetReasonError
+}
+
+// Error returned by reading or writing a connection reset by the other side
+func resetError(reason uint8) error {
+	switch reason {
+	case block.ResetReasonTimeout:
+		return syscall.ETIMEDOUT
+	case block.ResetReasonRefused, block.ResetReasonDenied:
+		return syscall.ECONNREFUSED
+	case block.ResetReasonUnreachable:
+		return syscall.EHOSTUNREACH
+	}
+	return syscall.ECONNRESET
+}
+
+func resetAccessReason(reason uint8) string {
+	switch reason {
+	case block.ResetReasonTimeout:
+		return accesslog.ReasonTimeout
+	case block.ResetReasonRefused, block.ResetReasonUnreachable:
+		return accesslog.ReasonDialError
+	case block.ResetReasonDenied:
+		return accesslog.ReasonDeny
+	}
+	return accesslog.ReasonReset
+}
+
+// Close conn with RST instead of FIN where supported, err tells why it's aborted
+func abort(conn HalfOpenConn, err error) {
+	switch c := conn.(type) {
+	case interface{ Reset(reason uint8) error }:
+		c.Reset(resetReason(err))
+		return
+	case interface{ SetLinger(sec int) error }:
+		c.SetLinger(0)
+	}
+	conn.Close()
+}
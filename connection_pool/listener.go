@@ -0,0 +1,85 @@
+package connection_pool
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/ihciah/rabbit-tcp/connection"
+	"github.com/ihciah/rabbit-tcp/logger"
+)
+
+const (
+	AcceptQueueSize = 32 // Accepted connections waiting for Accept
+)
+
+// Listener is a net.Listener yielding connections initiated by the other side.
+// When a ConnectionPool is created with a Listener, it hands new connections to it instead of dialing out.
+type Listener struct {
+	acceptQueue chan connection.Connection
+	addrLock    sync.RWMutex
+	addr        net.Addr
+	logger      *logger.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewListener() *Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Listener{
+		acceptQueue: make(chan connection.Connection, AcceptQueueSize),
+		addr:        &connection.Addr{},
+		logger:      logger.NewLogger("Listener"),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	return l
+}
+
+// Accept waits for and returns the next connection. The address requested by the other side
+// can be read from RemoteAddr.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.acceptQueue:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, &net.OpError{Op: "accept", Net: l.Addr().Network(), Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// Close stops accepting. Connections arrived after that will be closed.
+func (l *Listener) Close() error {
+	l.cancel()
+	for {
+		select {
+		case conn := <-l.acceptQueue:
+			_ = conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (l *Listener) Addr() net.Addr {
+	l.addrLock.RLock()
+	defer l.addrLock.RUnlock()
+	return l.addr
+}
+
+// SetAddr sets the address reported by Addr, usually the address tunnels listen on
+func (l *Listener) SetAddr(addr net.Addr) {
+	l.addrLock.Lock()
+	defer l.addrLock.Unlock()
+	l.addr = addr
+}
+
+func (l *Listener) accept(conn connection.Connection) {
+	select {
+	case l.acceptQueue <- conn:
+		l.logger.Debugf("Connection %d is ready to be accepted.\n", conn.GetConnectionID())
+	case <-l.ctx.Done():
+		l.logger.Warnf("Connection %d closed because listener is closed.\n", conn.GetConnectionID())
+		_ = conn.Close()
+	}
+}
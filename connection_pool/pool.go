@@ -2,83 +2,268 @@ package connection_pool
 
 import (
 	"context"
+	"fmt"
+	"github.com/ihciah/rabbit-tcp/accesslog"
 	"github.com/ihciah/rabbit-tcp/block"
 	"github.com/ihciah/rabbit-tcp/connection"
 	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
 	"github.com/ihciah/rabbit-tcp/tunnel_pool"
 	"sync"
+	"time"
 )
 
 const (
-	SendQueueSize = 48 // SendQueue channel cap
+	// Connection IDs are allocated sequentially by the side opening the connection. IDs allocated by
+	// servers have this bit set and those allocated by clients don't, so they never collide.
+	ServerConnectionIDBit = 1 << 31
 )
 
+// Handler decides how connections initiated by the other side are served
+type Handler struct {
+	Dial          connection.DialFunc // Dial the requested address of new connections
+	Listener      *Listener           // If not nil, hand new connections to it instead of dialing out
+	AllowListen   bool                // Listen on the requested address for reverse forwarding
+	AllowDatagram bool                // Open UDP sessions for datagrams of unknown sessions
+	AccessLog     *accesslog.Logger   // If not nil, log connections and UDP sessions initiated by the other side when they end
+
+	// If Bind is not nil, connections it binds are dialed by BindDial instead of Dial,
+	// eg: from another source address, interface or fwmark
+	Bind     connection.BindPolicy
+	BindDial connection.BindDialFunc
+}
+
 type ConnectionPool struct {
-	connectionMapping   map[uint32]connection.Connection
-	mappingLock         sync.RWMutex
-	tunnelPool          *tunnel_pool.TunnelPool
-	sendQueue           chan block.Block
-	acceptNewConnection bool
-	logger              *logger.Logger
+	connectionMapping map[uint32]connection.Connection
+	datagramMapping   map[uint32]connection.Datagram
+	mappingLock       sync.RWMutex
+	tunnelPool        *tunnel_pool.TunnelPool
+	sendQueue         chan block.Block
+	handler           *Handler // If nil, connections initiated by the other side will be rejected
+	nextID            uint32   // Guarded by mappingLock
+	idBit             uint32   // ServerConnectionIDBit or 0
+	opts              *options.Options
+	logger            *logger.Logger
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-func NewConnectionPool(pool *tunnel_pool.TunnelPool, acceptNewConnection bool, backgroundCtx context.Context) *ConnectionPool {
+// The server side of a peer should set server, so IDs allocated by both sides don't collide
+func NewConnectionPool(pool *tunnel_pool.TunnelPool, handler *Handler, server bool, opts *options.Options, backgroundCtx context.Context) *ConnectionPool {
 	ctx, cancel := context.WithCancel(backgroundCtx)
+	opts = opts.WithDefaults()
+	var idBit uint32
+	if server {
+		idBit = ServerConnectionIDBit
+	}
 	cp := &ConnectionPool{
-		connectionMapping:   make(map[uint32]connection.Connection),
-		tunnelPool:          pool,
-		sendQueue:           make(chan block.Block, SendQueueSize),
-		acceptNewConnection: acceptNewConnection,
-		logger:              logger.NewLogger("[ConnectionPool]"),
-		ctx:                 ctx,
-		cancel:              cancel,
+		connectionMapping: make(map[uint32]connection.Connection),
+		datagramMapping:   make(map[uint32]connection.Datagram),
+		tunnelPool:        pool,
+		sendQueue:         make(chan block.Block, opts.PoolSendQueueSize),
+		handler:           handler,
+		nextID:            1,
+		idBit:             idBit,
+		opts:              opts,
+		logger:            logger.NewLogger("ConnectionPool").With("peer_id", pool.GetPeerID()),
+		ctx:               ctx,
+		cancel:            cancel,
 	}
 	cp.logger.Infoln("Connection Pool created.")
+	pool.OnSessionReset(cp.stopConnections)
 	go cp.sendRelay()
 	go cp.recvRelay()
 	return cp
 }
 
-// Create InboundConnection, and it to ConnectionPool and return
+// Create InboundConnection with a new ID, and it to ConnectionPool and return
 func (cp *ConnectionPool) NewPooledInboundConnection() connection.Connection {
+	for {
+		connCtx, removeConnFromPool := context.WithCancel(cp.ctx)
+		c := connection.NewInboundConnection(cp.allocateID(), cp.sendQueue, cp.opts, connCtx, removeConnFromPool)
+		if cp.addConnection(c, connCtx) {
+			return c
+		}
+		// The ID is just taken by the other side, which can happen only with legacy peers
+		removeConnFromPool()
+	}
+}
+
+// Create OutboundConnection, and it to ConnectionPool and return; return nil if the ID is taken
+func (cp *ConnectionPool) NewPooledOutboundConnection(connectionID uint32) connection.Connection {
 	connCtx, removeConnFromPool := context.WithCancel(cp.ctx)
-	c := connection.NewInboundConnection(cp.sendQueue, connCtx, removeConnFromPool)
-	cp.addConnection(c)
-	go func() {
-		<-connCtx.Done()
-		cp.removeConnection(c)
-	}()
+	c := connection.NewOutboundConnection(connectionID, cp.handler.Dial, cp.sendQueue, cp.opts, connCtx, removeConnFromPool)
+	if cp.handler.AccessLog != nil {
+		c.(*connection.OutboundConnection).EnableAccessLog(cp.handler.AccessLog, cp.accessRecord(accesslog.KindConnect))
+	}
+	if cp.handler.Bind != nil {
+		c.(*connection.OutboundConnection).EnableBind(cp.handler.Bind, cp.handler.BindDial)
+	}
+	if !cp.addConnection(c, connCtx) {
+		removeConnFromPool()
+		return nil
+	}
 	return c
 }
 
-// Create OutboundConnection, and it to ConnectionPool and return
-func (cp *ConnectionPool) NewPooledOutboundConnection(connectionID uint32) connection.Connection {
+// Create AcceptedConnection, and it to ConnectionPool and return; return nil if the ID is taken
+func (cp *ConnectionPool) NewPooledAcceptedConnection(connectionID uint32) connection.Connection {
 	connCtx, removeConnFromPool := context.WithCancel(cp.ctx)
-	c := connection.NewOutboundConnection(connectionID, cp.sendQueue, connCtx, removeConnFromPool)
-	cp.addConnection(c)
+	c := connection.NewAcceptedConnection(connectionID, cp.handler.Listener.accept, cp.sendQueue, cp.opts, connCtx, removeConnFromPool)
+	if cp.handler.AccessLog != nil {
+		c.(*connection.AcceptedConnection).EnableAccessLog(cp.handler.AccessLog, cp.accessRecord(accesslog.KindAccept))
+	}
+	if !cp.addConnection(c, connCtx) {
+		removeConnFromPool()
+		return nil
+	}
+	return c
+}
+
+// Create ListenConnection, and it to ConnectionPool and return; return nil if the ID is taken
+func (cp *ConnectionPool) NewPooledListenConnection(connectionID uint32) connection.Connection {
+	connCtx, removeConnFromPool := context.WithCancel(cp.ctx)
+	c := connection.NewListenConnection(connectionID, cp.NewPooledInboundConnection, cp.sendQueue, cp.opts, connCtx, removeConnFromPool)
+	if cp.handler.AccessLog != nil {
+		// Connections accepted by it are logged as well
+		c.(*connection.ListenConnection).EnableAccessLog(cp.handler.AccessLog, cp.accessRecord(accesslog.KindListen))
+	}
+	if !cp.addConnection(c, connCtx) {
+		removeConnFromPool()
+		return nil
+	}
+	return c
+}
+
+// Create DatagramConn with a new session ID, and it to ConnectionPool and return
+func (cp *ConnectionPool) NewPooledDatagramConn() *connection.DatagramConn {
+	for {
+		connCtx, removeConnFromPool := context.WithCancel(cp.ctx)
+		dc := connection.NewDatagramConn(cp.allocateID(), cp.sendQueue, connCtx, removeConnFromPool)
+		if cp.addDatagram(dc, connCtx) {
+			return dc
+		}
+		removeConnFromPool()
+	}
+}
+
+// Create OutboundDatagram, and it to ConnectionPool and return
+func (cp *ConnectionPool) NewPooledOutboundDatagram(sessionID uint32) (*connection.OutboundDatagram, error) {
+	connCtx, removeConnFromPool := context.WithCancel(cp.ctx)
+	od, err := connection.NewOutboundDatagram(sessionID, cp.sendQueue, cp.opts, connCtx, removeConnFromPool)
+	if err != nil {
+		removeConnFromPool()
+		return nil, err
+	}
+	if cp.handler.AccessLog != nil {
+		od.EnableAccessLog(cp.handler.AccessLog, cp.accessRecord(accesslog.KindUDP))
+	}
+	if !cp.addDatagram(od, connCtx) {
+		removeConnFromPool()
+		return nil, fmt.Errorf("datagram session %d exists", sessionID)
+	}
+	return od, nil
+}
+
+// Access record with peer fields filled
+func (cp *ConnectionPool) accessRecord(kind string) accesslog.Record {
+	return accesslog.Record{
+		Kind:   kind,
+		PeerID: cp.tunnelPool.GetPeerID(),
+		Source: cp.tunnelPool.GetRemoteAddr(),
+	}
+}
+
+// Allocate an ID unused by connections and datagram sessions of this side.
+// IDs are not reused until the counter wraps around.
+func (cp *ConnectionPool) allocateID() uint32 {
+	cp.mappingLock.Lock()
+	defer cp.mappingLock.Unlock()
+	for {
+		id := cp.nextID&^ServerConnectionIDBit | cp.idBit
+		cp.nextID++
+		_, connectionExists := cp.connectionMapping[id]
+		_, datagramExists := cp.datagramMapping[id]
+		if !connectionExists && !datagramExists {
+			return id
+		}
+	}
+}
+
+// Add datagram session to pool until connCtx is done; return false if its ID is taken
+func (cp *ConnectionPool) addDatagram(dg connection.Datagram, connCtx context.Context) bool {
+	cp.mappingLock.Lock()
+	defer cp.mappingLock.Unlock()
+	if _, ok := cp.datagramMapping[dg.GetSessionID()]; ok {
+		cp.logger.Errorf("Datagram session %d exists, duplicated one rejected.\n", dg.GetSessionID())
+		return false
+	}
+	cp.logger.Infof("Datagram session %d added to connection pool.\n", dg.GetSessionID())
+	cp.datagramMapping[dg.GetSessionID()] = dg
 	go func() {
 		<-connCtx.Done()
-		cp.removeConnection(c)
+		cp.removeDatagram(dg)
 	}()
-	return c
+	return true
 }
 
-func (cp *ConnectionPool) addConnection(conn connection.Connection) {
-	cp.logger.Infof("Connection %d added to connection pool.\n", conn.GetConnectionID())
+func (cp *ConnectionPool) removeDatagram(dg connection.Datagram) {
+	cp.logger.Infof("Datagram session %d removed from connection pool.\n", dg.GetSessionID())
 	cp.mappingLock.Lock()
 	defer cp.mappingLock.Unlock()
+	if cp.datagramMapping[dg.GetSessionID()] == dg {
+		delete(cp.datagramMapping, dg.GetSessionID())
+	}
+}
+
+// Deliver datagram block to its session, datagram blocks are not ordered
+func (cp *ConnectionPool) recvDatagram(blk block.Block) {
+	cp.mappingLock.RLock()
+	dg, ok := cp.datagramMapping[blk.ConnectionID]
+	cp.mappingLock.RUnlock()
+	if !ok {
+		if cp.handler == nil || !cp.handler.AllowDatagram {
+			cp.logger.Debugln("Unknown datagram session.")
+			blk.Release()
+			return
+		}
+		var err error
+		if dg, err = cp.NewPooledOutboundDatagram(blk.ConnectionID); err != nil {
+			cp.logger.Errorf("Error when create datagram session: %v.\n", err)
+			blk.Release()
+			return
+		}
+	}
+	dg.RecvBlock(blk)
+}
+
+// Add connection to pool until connCtx is done; return false if its ID is taken
+func (cp *ConnectionPool) addConnection(conn connection.Connection, connCtx context.Context) bool {
+	cp.mappingLock.Lock()
+	defer cp.mappingLock.Unlock()
+	if _, ok := cp.connectionMapping[conn.GetConnectionID()]; ok {
+		cp.logger.Errorf("Connection %d exists, duplicated one rejected.\n", conn.GetConnectionID())
+		return false
+	}
+	cp.logger.Infof("Connection %d added to connection pool.\n", conn.GetConnectionID())
 	cp.connectionMapping[conn.GetConnectionID()] = conn
+	// Blocks are kept for replay while tunnels are reattaching
+	conn.PauseTimeout(cp.tunnelPool.Stalled)
 	go conn.OrderedRelay(conn)
+	go func() {
+		<-connCtx.Done()
+		cp.removeConnection(conn)
+	}()
+	return true
 }
 
+// Only remove conn itself, a rejected duplicate must not remove the one with the same ID
 func (cp *ConnectionPool) removeConnection(conn connection.Connection) {
 	cp.logger.Infof("Connection %d removed from connection pool.\n", conn.GetConnectionID())
 	cp.mappingLock.Lock()
 	defer cp.mappingLock.Unlock()
-	if _, ok := cp.connectionMapping[conn.GetConnectionID()]; ok {
+	if cp.connectionMapping[conn.GetConnectionID()] == conn {
 		delete(cp.connectionMapping, conn.GetConnectionID())
 	}
 }
@@ -89,6 +274,10 @@ func (cp *ConnectionPool) recvRelay() {
 	for {
 		select {
 		case blk := <-cp.tunnelPool.GetRecvQueue():
+			if blk.Type == block.TypeDatagram {
+				cp.recvDatagram(blk)
+				continue
+			}
 			connID := blk.ConnectionID
 			var conn connection.Connection
 			var ok bool
@@ -96,13 +285,46 @@ func (cp *ConnectionPool) recvRelay() {
 			conn, ok = cp.connectionMapping[connID]
 			cp.mappingLock.RUnlock()
 			if !ok {
-				if cp.acceptNewConnection {
+				if cp.handler == nil {
+					cp.logger.Errorln("Unknown connection.")
+					blk.Release()
+					continue
+				} else if blk.Type == block.TypeListen && cp.handler.AllowListen {
+					conn = cp.NewPooledListenConnection(blk.ConnectionID)
+					cp.logger.Infoln("Listen connection created and added to connectionPool.")
+				} else if blk.Type == block.TypeListen {
+					cp.logger.Warnf("Listen of connection %d is not allowed.\n", connID)
+					if cp.handler.AccessLog != nil {
+						record := cp.accessRecord(accesslog.KindListen)
+						record.Destination = string(blk.BlockData)
+						record.Start = time.Now()
+						record.Reason = accesslog.ReasonDeny
+						cp.handler.AccessLog.Log(record)
+					}
+					blk.Release()
+					go cp.refuse(connID)
+					continue
+				} else if cp.handler.Listener != nil {
+					conn = cp.NewPooledAcceptedConnection(blk.ConnectionID)
+					cp.logger.Infoln("Connection accepted and added to connectionPool.")
+				} else if cp.handler.Dial != nil {
 					conn = cp.NewPooledOutboundConnection(blk.ConnectionID)
 					cp.logger.Infoln("Connection created and added to connectionPool.")
 				} else {
 					cp.logger.Errorln("Unknown connection.")
+					blk.Release()
+					continue
+				}
+				if conn == nil {
+					blk.Release()
 					continue
 				}
+			} else if _, local := conn.(*connection.InboundConnection); local &&
+				(blk.Type == block.TypeConnect || blk.Type == block.TypeListen) {
+				// The other side opens a connection with the ID of ours, which only legacy peers may do
+				cp.logger.Errorf("Connection %d is opened by both sides, block dropped.\n", connID)
+				blk.Release()
+				continue
 			}
 			conn.RecvBlock(blk)
 			cp.logger.Debugf("Block %d(type: %d) put to connRecvQueue.\n", blk.BlockID, blk.Type)
@@ -113,6 +335,14 @@ func (cp *ConnectionPool) recvRelay() {
 	}
 }
 
+// Reset a connection opened by the other side without creating it, like a dial denied by access control
+func (cp *ConnectionPool) refuse(connectionID uint32) {
+	select {
+	case cp.sendQueue <- block.NewResetBlock(connectionID, 0, block.ResetReasonDenied):
+	case <-cp.ctx.Done():
+	}
+}
+
 // Deliver blocks from connPool's sendQueue to tunnelPool
 // TODO: Maybe QOS can be implemented here
 func (cp *ConnectionPool) sendRelay() {
@@ -120,6 +350,11 @@ func (cp *ConnectionPool) sendRelay() {
 	for {
 		select {
 		case blk := <-cp.sendQueue:
+			if blk.Type == block.TypeReset && cp.tunnelPool.Features()&tunnel_pool.FeatureReset == 0 {
+				// Peers without reset support close the connection gracefully instead
+				blk = block.NewDisconnectBlock(blk.ConnectionID, blk.BlockID, block.ShutdownBoth)
+			}
+			cp.tunnelPool.WaitWindow()
 			cp.tunnelPool.GetSendQueue() <- blk
 			cp.logger.Debugf("Block %d(type: %d) put to connSendQueue.\n", blk.BlockID, blk.Type)
 		case <-cp.ctx.Done():
@@ -129,6 +364,16 @@ func (cp *ConnectionPool) sendRelay() {
 	}
 }
 
+// Stop all connections, which are lost with the session of tunnel pool.
+// Datagram sessions are kept since the other side creates them again on demand.
+func (cp *ConnectionPool) stopConnections() {
+	cp.mappingLock.RLock()
+	defer cp.mappingLock.RUnlock()
+	for _, conn := range cp.connectionMapping {
+		conn.Stop()
+	}
+}
+
 func (cp *ConnectionPool) stopRelay() {
 	cp.logger.Infoln("Stop all ConnectionPool Relay.")
 	cp.cancel()
@@ -0,0 +1,72 @@
+package connection_pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ihciah/rabbit-tcp/connection"
+	"github.com/ihciah/rabbit-tcp/tunnel_pool"
+)
+
+var errDialed = errors.New("dialed")
+
+func newTestPool(t *testing.T, server bool) *ConnectionPool {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	manager := tunnel_pool.NewServerManager(cancel)
+	tp := tunnel_pool.NewTunnelPool(1, &manager, nil, ctx)
+	handler := &Handler{Dial: func(address string) (connection.HalfOpenConn, error) {
+		t.Errorf("%s is dialed", address)
+		return nil, errDialed
+	}}
+	return NewConnectionPool(tp, handler, server, nil, ctx)
+}
+
+func (cp *ConnectionPool) connection(id uint32) connection.Connection {
+	cp.mappingLock.Lock()
+	defer cp.mappingLock.Unlock()
+	return cp.connectionMapping[id]
+}
+
+// A connection with the ID of an existing one is rejected, and the existing one is kept
+func TestDuplicateConnectionID(t *testing.T) {
+	cp := newTestPool(t, true)
+	first := cp.NewPooledOutboundConnection(5)
+	if first == nil {
+		t.Fatal("Connection 5 is rejected.")
+	}
+	if c := cp.NewPooledOutboundConnection(5); c != nil {
+		t.Fatal("Duplicated connection 5 is added.")
+	}
+	if c := cp.connection(5); c != first {
+		t.Fatalf("Connection 5 is %v after the duplicate is rejected.", c)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := connection.NewInboundConnection(5, cp.sendQueue, cp.opts, ctx, cancel)
+	if cp.addConnection(c, ctx) {
+		t.Fatal("Duplicated inbound connection 5 is added.")
+	}
+	if c := cp.connection(5); c != first {
+		t.Fatalf("Connection 5 is %v after the duplicate is rejected.", c)
+	}
+}
+
+// IDs taken by the other side are skipped when allocating, which can happen only with legacy peers
+func TestAllocateTakenID(t *testing.T) {
+	cp := newTestPool(t, false)
+	taken := cp.NewPooledOutboundConnection(1)
+	if taken == nil {
+		t.Fatal("Connection 1 is rejected.")
+	}
+	c := cp.NewPooledInboundConnection()
+	if c.GetConnectionID() != 2 {
+		t.Fatalf("Connection %d is allocated, want 2.", c.GetConnectionID())
+	}
+	if cp.connection(1) != taken || cp.connection(2) != c {
+		t.Fatal("Connections are replaced.")
+	}
+}
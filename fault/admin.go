@@ -0,0 +1,82 @@
+package fault
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Handler serves the fault injection API for staging, all faults are triggered by POST:
+//
+//	GET  /tunnels                                  IDs of tunnels, one per line
+//	POST /tunnel/kill?id=<id>[&after=<bytes>]      KillTunnel
+//	POST /tunnel/stall?id=<id>&duration=<5s>       StallTunnel
+//	POST /tunnel/corrupt?id=<id>                   CorruptTunnel
+//	POST /connect/delay?duration=<2s>              SetConnectDelay, 0 to stop it
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		for _, id := range Tunnels() {
+			fmt.Fprintln(w, id)
+		}
+	})
+	mux.HandleFunc("/tunnel/kill", post(func(r *http.Request) error {
+		id, err := tunnelID(r)
+		if err != nil {
+			return err
+		}
+		after := 0
+		if s := r.FormValue("after"); s != "" {
+			if after, err = strconv.Atoi(s); err != nil {
+				return err
+			}
+		}
+		return KillTunnel(id, after)
+	}))
+	mux.HandleFunc("/tunnel/stall", post(func(r *http.Request) error {
+		id, err := tunnelID(r)
+		if err != nil {
+			return err
+		}
+		duration, err := time.ParseDuration(r.FormValue("duration"))
+		if err != nil {
+			return err
+		}
+		return StallTunnel(id, duration)
+	}))
+	mux.HandleFunc("/tunnel/corrupt", post(func(r *http.Request) error {
+		id, err := tunnelID(r)
+		if err != nil {
+			return err
+		}
+		return CorruptTunnel(id)
+	}))
+	mux.HandleFunc("/connect/delay", post(func(r *http.Request) error {
+		duration, err := time.ParseDuration(r.FormValue("duration"))
+		if err != nil {
+			return err
+		}
+		return SetConnectDelay(duration)
+	}))
+	return mux
+}
+
+func post(handle func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := handle(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+func tunnelID(r *http.Request) (uint32, error) {
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	return uint32(id), err
+}
@@ -0,0 +1,40 @@
+//go:build !faultinject
+// +build !faultinject
+
+package fault
+
+import (
+	"net"
+	"time"
+)
+
+// Faults are not injected without -tags faultinject
+const Enabled = false
+
+func WrapTunnelConn(tunnelID uint32, conn net.Conn) net.Conn {
+	return conn
+}
+
+func ConnectDelay() time.Duration {
+	return 0
+}
+
+func Tunnels() []uint32 {
+	return nil
+}
+
+func KillTunnel(tunnelID uint32, afterBytes int) error {
+	return ErrNotEnabled
+}
+
+func StallTunnel(tunnelID uint32, duration time.Duration) error {
+	return ErrNotEnabled
+}
+
+func CorruptTunnel(tunnelID uint32) error {
+	return ErrNotEnabled
+}
+
+func SetConnectDelay(delay time.Duration) error {
+	return ErrNotEnabled
+}
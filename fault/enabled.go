@@ -0,0 +1,187 @@
+//go:build faultinject
+// +build faultinject
+
+package fault
+
+import (
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+const Enabled = true
+
+var (
+	tunnelsLock  sync.Mutex
+	tunnels      = make(map[uint32]*faultConn)
+	connectDelay atomic.Duration
+)
+
+// faultConn wraps the raw connection of a tunnel, so faults apply to ciphertext
+type faultConn struct {
+	net.Conn
+	tunnelID uint32
+
+	lock          sync.Mutex
+	changed       chan struct{} // Closed and replaced when faults change
+	kill          bool
+	killAfter     int // Bytes of the next write sent before the tunnel is killed, half of it if not positive
+	stallUntil    time.Time
+	corrupt       bool
+	writeDeadline time.Time
+}
+
+// Make faults of the tunnel controllable by KillTunnel, StallTunnel and CorruptTunnel until conn is closed
+func WrapTunnelConn(tunnelID uint32, conn net.Conn) net.Conn {
+	fc := &faultConn{
+		Conn:     conn,
+		tunnelID: tunnelID,
+		changed:  make(chan struct{}),
+	}
+	tunnelsLock.Lock()
+	tunnels[tunnelID] = fc
+	tunnelsLock.Unlock()
+	return fc
+}
+
+// Delay before OutboundConnection handles a connect block
+func ConnectDelay() time.Duration {
+	return connectDelay.Load()
+}
+
+// IDs of tunnels which faults can be injected into
+func Tunnels() []uint32 {
+	tunnelsLock.Lock()
+	defer tunnelsLock.Unlock()
+	ids := make([]uint32, 0, len(tunnels))
+	for id := range tunnels {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func update(tunnelID uint32, f func(fc *faultConn)) error {
+	tunnelsLock.Lock()
+	fc, ok := tunnels[tunnelID]
+	tunnelsLock.Unlock()
+	if !ok {
+		return ErrUnknownTunnel
+	}
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	f(fc)
+	close(fc.changed)
+	fc.changed = make(chan struct{})
+	return nil
+}
+
+// Close the tunnel in the middle of its next write, after afterBytes of it are sent
+func KillTunnel(tunnelID uint32, afterBytes int) error {
+	return update(tunnelID, func(fc *faultConn) {
+		fc.kill = true
+		fc.killAfter = afterBytes
+	})
+}
+
+// Block writes of the tunnel for duration, they fail if the write deadline comes first
+func StallTunnel(tunnelID uint32, duration time.Duration) error {
+	return update(tunnelID, func(fc *faultConn) {
+		fc.stallUntil = time.Now().Add(duration)
+	})
+}
+
+// Flip a ciphertext byte of the next write, so the other side fails to open the record
+func CorruptTunnel(tunnelID uint32) error {
+	return update(tunnelID, func(fc *faultConn) {
+		fc.corrupt = true
+	})
+}
+
+// Delay handling of connect blocks by OutboundConnection, 0 to stop it
+func SetConnectDelay(delay time.Duration) error {
+	connectDelay.Store(delay)
+	return nil
+}
+
+// Wait for stall to end and take faults of this write
+func (fc *faultConn) takeFaults() (kill bool, killAfter int, corrupt bool, err error) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	for {
+		now := time.Now()
+		if !fc.writeDeadline.IsZero() && !now.Before(fc.writeDeadline) {
+			return false, 0, false, os.ErrDeadlineExceeded
+		}
+		if !now.Before(fc.stallUntil) {
+			break
+		}
+		wakeAt := fc.stallUntil
+		if !fc.writeDeadline.IsZero() && fc.writeDeadline.Before(wakeAt) {
+			wakeAt = fc.writeDeadline
+		}
+		changed := fc.changed
+		fc.lock.Unlock()
+		timer := time.NewTimer(time.Until(wakeAt))
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+		fc.lock.Lock()
+	}
+	kill, killAfter, corrupt = fc.kill, fc.killAfter, fc.corrupt
+	fc.kill, fc.corrupt = false, false
+	return
+}
+
+func (fc *faultConn) Write(b []byte) (int, error) {
+	kill, killAfter, corrupt, err := fc.takeFaults()
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: "fault", Source: fc.LocalAddr(), Addr: fc.RemoteAddr(), Err: err}
+	}
+	if corrupt && len(b) > 0 {
+		b = append([]byte(nil), b...)
+		b[len(b)/2] ^= 0xff
+	}
+	if kill {
+		if killAfter <= 0 || killAfter >= len(b) {
+			killAfter = len(b) / 2
+		}
+		n, _ := fc.Conn.Write(b[:killAfter])
+		fc.Close()
+		return n, ErrKilled
+	}
+	return fc.Conn.Write(b)
+}
+
+func (fc *faultConn) SetDeadline(t time.Time) error {
+	fc.setWriteDeadline(t)
+	return fc.Conn.SetDeadline(t)
+}
+
+func (fc *faultConn) SetWriteDeadline(t time.Time) error {
+	fc.setWriteDeadline(t)
+	return fc.Conn.SetWriteDeadline(t)
+}
+
+func (fc *faultConn) setWriteDeadline(t time.Time) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.writeDeadline = t
+	close(fc.changed)
+	fc.changed = make(chan struct{})
+}
+
+func (fc *faultConn) Close() error {
+	tunnelsLock.Lock()
+	if tunnels[fc.tunnelID] == fc {
+		delete(tunnels, fc.tunnelID)
+	}
+	tunnelsLock.Unlock()
+	return fc.Conn.Close()
+}
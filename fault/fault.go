@@ -0,0 +1,12 @@
+// Package fault injects faults into tunnels and connections to verify recovery behaviour.
+// Faults are injected only by binaries built with -tags faultinject, otherwise hooks are no-ops
+// and the control functions return ErrNotEnabled.
+package fault
+
+import "errors"
+
+var (
+	ErrNotEnabled    = errors.New("fault injection is not enabled, build with -tags faultinject")
+	ErrUnknownTunnel = errors.New("unknown tunnel")
+	ErrKilled        = errors.New("tunnel killed by fault injection")
+)
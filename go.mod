@@ -1,8 +1,10 @@
 module github.com/ihciah/rabbit-tcp
 
-go 1.13
+go 1.16
 
 require (
+	github.com/golang/snappy v1.0.0
 	go.uber.org/atomic v1.6.0
 	golang.org/x/crypto v0.0.0-20200221231518-2aa609cf4a9d
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
 )
@@ -1,12 +1,18 @@
 package logger
 
 import (
-	"log"
-	"os"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
 )
 
+type Level = int32
+
 const (
-	LogLevelOff = iota
+	LogLevelOff Level = iota
 	LogLevelFatal
 	LogLevelError
 	LogLevelWarn
@@ -14,76 +20,238 @@ const (
 	LogLevelDebug
 )
 
-var LEVEL int = LogLevelOff
+const inheritLevel = -1 // Component level which follows the global level
+
+var (
+	globalLevel    = atomic.NewInt32(LogLevelOff)
+	componentsLock sync.Mutex
+	components     = make(map[string]*componentConfig)
+)
+
+// Level and sink shared by loggers of a component
+type componentConfig struct {
+	level atomic.Int32
+	sink  atomic.Value // sinkHolder, whose sink is nil if the component follows the global sink
+}
+
+func (c *componentConfig) getSink() Sink {
+	if s := c.sink.Load().(sinkHolder).sink; s != nil {
+		return s
+	}
+	return getSink()
+}
+
+// Set level of all components except those set by SetComponentLevel, it takes effect immediately
+func SetLevel(level Level) {
+	globalLevel.Store(level)
+}
+
+func GetLevel() Level {
+	return globalLevel.Load()
+}
+
+// Set level of loggers created with the component name, eg: "Tunnel", it takes effect immediately
+func SetComponentLevel(component string, level Level) {
+	getComponent(component).level.Store(level)
+}
+
+// Make the component follow the global level again
+func ResetComponentLevel(component string) {
+	getComponent(component).level.Store(inheritLevel)
+}
+
+// Replace the sink of loggers created with the component name, eg: to write entries of "Tunnel" to another file.
+// nil discards all entries of the component. It takes effect immediately.
+func SetComponentSink(component string, s Sink) {
+	if s == nil {
+		s = discardSink
+	}
+	getComponent(component).sink.Store(sinkHolder{s})
+}
+
+// Make the component follow the global sink again
+func ResetComponentSink(component string) {
+	getComponent(component).sink.Store(sinkHolder{})
+}
+
+func getComponent(component string) *componentConfig {
+	componentsLock.Lock()
+	defer componentsLock.Unlock()
+	config, ok := components[component]
+	if !ok {
+		config = &componentConfig{}
+		config.level.Store(inheritLevel)
+		config.sink.Store(sinkHolder{})
+		components[component] = config
+	}
+	return config
+}
+
+// Field is a key/value pair attached to log entries
+type Field struct {
+	Key   string
+	Value interface{}
+}
 
 type Logger struct {
-	logger *log.Logger
-	level  int
+	component string
+	config    *componentConfig // Shared by loggers of the component
+	sink      Sink             // If not nil, entries are sent to it instead of the sink of the component
+	fields    []Field
+}
+
+func NewLogger(component string) *Logger {
+	return &Logger{
+		component: component,
+		config:    getComponent(component),
+	}
+}
+
+// WithSink returns a logger which sends its entries to s, whatever sink its component has.
+// It injects a sink into one logger, eg: to capture entries of an object in tests.
+func (l *Logger) WithSink(s Sink) *Logger {
+	if s == nil {
+		s = discardSink
+	}
+	return &Logger{
+		component: l.component,
+		config:    l.config,
+		sink:      s,
+		fields:    l.fields,
+	}
 }
 
-func NewLogger(prefix string) *Logger {
+// With returns a logger which attaches the key/value pair to all of its entries, eg: With("conn_id", id)
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]Field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
 	return &Logger{
-		logger: log.New(os.Stdout, prefix, log.LstdFlags),
-		level:  LEVEL,
+		component: l.component,
+		config:    l.config,
+		sink:      l.sink,
+		fields:    append(fields, Field{Key: key, Value: value}),
+	}
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	current := l.config.level.Load()
+	if current == inheritLevel {
+		current = globalLevel.Load()
+	}
+	return current >= level
+}
+
+func (l *Logger) log(level Level, msg string, keysAndValues []interface{}) {
+	entry := Entry{
+		Time:      time.Now(),
+		Level:     level,
+		Component: l.component,
+		Message:   strings.TrimRight(msg, "\n"),
+		Fields:    l.fields,
+	}
+	if len(keysAndValues) > 0 {
+		entry.Fields = make([]Field, len(l.fields), len(l.fields)+len(keysAndValues)/2+1)
+		copy(entry.Fields, l.fields)
+		for i := 0; i < len(keysAndValues); i += 2 {
+			key := fmt.Sprint(keysAndValues[i])
+			var value interface{} = "(MISSING)"
+			if i+1 < len(keysAndValues) {
+				value = keysAndValues[i+1]
+			}
+			entry.Fields = append(entry.Fields, Field{Key: key, Value: value})
+		}
+	}
+	if l.sink != nil {
+		l.sink.Log(entry)
+	} else {
+		l.config.getSink().Log(entry)
 	}
 }
 
+// Structured logging, keysAndValues are pairs like "remote", address
+
+func (l *Logger) Debug(msg string, keysAndValues ...interface{}) {
+	if l.Enabled(LogLevelDebug) {
+		l.log(LogLevelDebug, msg, keysAndValues)
+	}
+}
+
+func (l *Logger) Info(msg string, keysAndValues ...interface{}) {
+	if l.Enabled(LogLevelInfo) {
+		l.log(LogLevelInfo, msg, keysAndValues)
+	}
+}
+
+func (l *Logger) Warn(msg string, keysAndValues ...interface{}) {
+	if l.Enabled(LogLevelWarn) {
+		l.log(LogLevelWarn, msg, keysAndValues)
+	}
+}
+
+func (l *Logger) Error(msg string, keysAndValues ...interface{}) {
+	if l.Enabled(LogLevelError) {
+		l.log(LogLevelError, msg, keysAndValues)
+	}
+}
+
+// Printf-style logging
+
 func (l *Logger) Debugln(v string) {
-	if l.level >= LogLevelDebug {
-		l.logger.Println("[Debug] " + v)
+	if l.Enabled(LogLevelDebug) {
+		l.log(LogLevelDebug, v, nil)
 	}
 }
 
 func (l *Logger) Debugf(format string, v ...interface{}) {
-	if l.level >= LogLevelDebug {
-		l.logger.Printf("[Debug] "+format, v...)
+	if l.Enabled(LogLevelDebug) {
+		l.log(LogLevelDebug, fmt.Sprintf(format, v...), nil)
 	}
 }
 
 func (l *Logger) Infoln(v string) {
-	if l.level >= LogLevelInfo {
-		l.logger.Println("[Info] " + v)
+	if l.Enabled(LogLevelInfo) {
+		l.log(LogLevelInfo, v, nil)
 	}
 }
 
 func (l *Logger) Infof(format string, v ...interface{}) {
-	if l.level >= LogLevelInfo {
-		l.logger.Printf("[Info] "+format, v...)
+	if l.Enabled(LogLevelInfo) {
+		l.log(LogLevelInfo, fmt.Sprintf(format, v...), nil)
 	}
 }
 
 func (l *Logger) Warnln(v string) {
-	if l.level >= LogLevelWarn {
-		l.logger.Println("[Warn] " + v)
+	if l.Enabled(LogLevelWarn) {
+		l.log(LogLevelWarn, v, nil)
 	}
 }
 
 func (l *Logger) Warnf(format string, v ...interface{}) {
-	if l.level >= LogLevelWarn {
-		l.logger.Printf("[Warn] "+format, v...)
+	if l.Enabled(LogLevelWarn) {
+		l.log(LogLevelWarn, fmt.Sprintf(format, v...), nil)
 	}
 }
 
 func (l *Logger) Errorln(v string) {
-	if l.level >= LogLevelError {
-		l.logger.Println("[Error] " + v)
+	if l.Enabled(LogLevelError) {
+		l.log(LogLevelError, v, nil)
 	}
 }
 
 func (l *Logger) Errorf(format string, v ...interface{}) {
-	if l.level >= LogLevelError {
-		l.logger.Printf("[Error] "+format, v...)
+	if l.Enabled(LogLevelError) {
+		l.log(LogLevelError, fmt.Sprintf(format, v...), nil)
 	}
 }
 
 func (l *Logger) Fatalln(v string) {
-	if l.level >= LogLevelFatal {
-		l.logger.Println("[Fatal] " + v)
+	if l.Enabled(LogLevelFatal) {
+		l.log(LogLevelFatal, v, nil)
 	}
 }
 
 func (l *Logger) Fatalf(format string, v ...interface{}) {
-	if l.level >= LogLevelFatal {
-		l.logger.Printf("[Fatal] "+format, v...)
+	if l.Enabled(LogLevelFatal) {
+		l.log(LogLevelFatal, fmt.Sprintf(format, v...), nil)
 	}
 }
@@ -0,0 +1,73 @@
+package logger
+
+import (
+	"sync"
+	"testing"
+)
+
+// Collects messages of entries
+type recordSink struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (s *recordSink) Log(entry Entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.messages = append(s.messages, entry.Component+": "+entry.Message)
+}
+
+func (s *recordSink) take() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	messages := s.messages
+	s.messages = nil
+	return messages
+}
+
+func expectMessages(t *testing.T, name string, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s got %q, want %q", name, got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("%s got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestComponentSink(t *testing.T) {
+	global, component, injected := &recordSink{}, &recordSink{}, &recordSink{}
+	previousLevel, previousSink := GetLevel(), getSink()
+	t.Cleanup(func() {
+		SetLevel(previousLevel)
+		SetSink(previousSink)
+		ResetComponentSink("TestSinkA")
+		ResetComponentSink("TestSinkB")
+	})
+	SetLevel(LogLevelInfo)
+	SetSink(global)
+
+	a := NewLogger("TestSinkA")
+	b := NewLogger("TestSinkB").With("id", 1)
+	SetComponentSink("TestSinkB", component)
+	a.Info("a")
+	b.Info("b")
+	b.WithSink(injected).Info("injected")
+	b.Debug("filtered by level")
+	expectMessages(t, "global", global.take(), "TestSinkA: a")
+	expectMessages(t, "component", component.take(), "TestSinkB: b")
+	expectMessages(t, "injected", injected.take(), "TestSinkB: injected")
+
+	// Loggers created later share the sink of the component, until it's reset
+	NewLogger("TestSinkB").Info("later")
+	ResetComponentSink("TestSinkB")
+	b.Info("reset")
+	expectMessages(t, "component", component.take(), "TestSinkB: later")
+	expectMessages(t, "global", global.take(), "TestSinkB: reset")
+
+	SetComponentSink("TestSinkA", nil)
+	a.Info("discarded")
+	expectMessages(t, "global", global.take())
+}
@@ -0,0 +1,158 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// Entry is a log record passed to sinks
+type Entry struct {
+	Time      time.Time
+	Level     Level
+	Component string
+	Message   string
+	Fields    []Field
+}
+
+// Sink receives enabled log entries, it must be safe for concurrent use
+type Sink interface {
+	Log(entry Entry)
+}
+
+// SinkFunc adapts a function to Sink, eg: to forward entries to a user logger
+type SinkFunc func(entry Entry)
+
+func (f SinkFunc) Log(entry Entry) {
+	f(entry)
+}
+
+type sinkHolder struct {
+	sink Sink
+}
+
+var sink atomic.Value
+
+var discardSink = SinkFunc(func(Entry) {})
+
+func init() {
+	sink.Store(sinkHolder{NewTextSink(os.Stdout)})
+}
+
+// Replace the sink of all components except those set by SetComponentSink, nil discards all entries
+func SetSink(s Sink) {
+	if s == nil {
+		s = discardSink
+	}
+	sink.Store(sinkHolder{s})
+}
+
+func getSink() Sink {
+	return sink.Load().(sinkHolder).sink
+}
+
+func LevelName(level Level) string {
+	switch level {
+	case LogLevelFatal:
+		return "Fatal"
+	case LogLevelError:
+		return "Error"
+	case LogLevelWarn:
+		return "Warn"
+	case LogLevelInfo:
+		return "Info"
+	case LogLevelDebug:
+		return "Debug"
+	}
+	return strconv.Itoa(int(level))
+}
+
+// TextSink writes entries like: 2006/01/02 15:04:05 [Info] [Tunnel] Handshake successfully. tunnel_id=1
+type TextSink struct {
+	lock   sync.Mutex
+	writer io.Writer
+	buf    []byte
+}
+
+func NewTextSink(writer io.Writer) *TextSink {
+	return &TextSink{writer: writer}
+}
+
+func (s *TextSink) Log(entry Entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	buf := entry.Time.AppendFormat(s.buf[:0], "2006/01/02 15:04:05")
+	buf = append(buf, " ["...)
+	buf = append(buf, LevelName(entry.Level)...)
+	buf = append(buf, "] ["...)
+	buf = append(buf, entry.Component...)
+	buf = append(buf, "] "...)
+	buf = append(buf, entry.Message...)
+	for _, field := range entry.Fields {
+		buf = append(buf, ' ')
+		buf = append(buf, field.Key...)
+		buf = append(buf, '=')
+		value := fmt.Sprint(field.Value)
+		if value == "" || strings.ContainsAny(value, " \"=") {
+			buf = strconv.AppendQuote(buf, value)
+		} else {
+			buf = append(buf, value...)
+		}
+	}
+	buf = append(buf, '\n')
+	s.writer.Write(buf)
+	s.buf = buf
+}
+
+// JSONSink writes one JSON object per entry with keys time, level, component, msg and the fields
+type JSONSink struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+func NewJSONSink(writer io.Writer) *JSONSink {
+	return &JSONSink{writer: writer}
+}
+
+func (s *JSONSink) Log(entry Entry) {
+	buf := make([]byte, 0, 256)
+	buf = append(buf, `{"time":`...)
+	buf = appendJSON(buf, entry.Time.Format(time.RFC3339Nano))
+	buf = append(buf, `,"level":`...)
+	buf = appendJSON(buf, strings.ToLower(LevelName(entry.Level)))
+	buf = append(buf, `,"component":`...)
+	buf = appendJSON(buf, entry.Component)
+	buf = append(buf, `,"msg":`...)
+	buf = appendJSON(buf, entry.Message)
+	for _, field := range entry.Fields {
+		buf = append(buf, ',')
+		buf = appendJSON(buf, field.Key)
+		buf = append(buf, ':')
+		buf = appendJSON(buf, field.Value)
+	}
+	buf = append(buf, "}\n"...)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.writer.Write(buf)
+}
+
+func appendJSON(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	return append(buf, data...)
+}
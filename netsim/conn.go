@@ -0,0 +1,319 @@
+package netsim
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+type Addr string
+
+func (a Addr) Network() string {
+	return "netsim"
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
+
+type segment struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// pipe is one direction of a link. Like a TCP stream, bytes are delivered in order,
+// so a delayed segment delays all segments after it.
+type pipe struct {
+	lock    sync.Mutex
+	changed chan struct{} // Closed and replaced when anything below changes
+	network *Network
+	config  LinkConfig
+
+	segments    []segment
+	lastSendEnd time.Time // Serialization of the previous segment finishes at
+	lastDeliver time.Time
+
+	writeClosed bool  // Writer sent FIN, reader gets EOF after segments
+	readClosed  bool  // Reader called CloseRead, segments are discarded
+	closed      bool  // Reader called Close, writer gets reset
+	err         error // Link is reset
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newPipe(network *Network, config LinkConfig) *pipe {
+	return &pipe{
+		changed: make(chan struct{}),
+		network: network,
+		config:  config,
+	}
+}
+
+// Wake up all waiters, must be called with lock held
+func (p *pipe) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Wait until the pipe changes or until, must be called with lock held and returns with lock held
+func (p *pipe) wait(until time.Time) {
+	changed := p.changed
+	p.lock.Unlock()
+	defer p.lock.Lock()
+	if until.IsZero() {
+		<-changed
+		return
+	}
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	}
+}
+
+func (p *pipe) read(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for {
+		now := time.Now()
+		switch {
+		case p.err != nil:
+			return 0, p.err
+		case p.closed:
+			return 0, net.ErrClosed
+		case !p.readDeadline.IsZero() && !now.Before(p.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		case p.readClosed:
+			return 0, io.EOF
+		}
+		if len(p.segments) > 0 {
+			head := &p.segments[0]
+			if !now.Before(head.deliverAt) {
+				n := copy(b, head.data)
+				head.data = head.data[n:]
+				if len(head.data) == 0 {
+					p.segments = p.segments[1:]
+				}
+				return n, nil
+			}
+			p.wait(earliest(head.deliverAt, p.readDeadline))
+			continue
+		}
+		if p.writeClosed {
+			return 0, io.EOF
+		}
+		p.wait(p.readDeadline)
+	}
+}
+
+func (p *pipe) write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// Only one segment is being serialized at a time, which blocks writers like a full socket buffer
+	for {
+		now := time.Now()
+		switch {
+		case p.err != nil:
+			return 0, p.err
+		case p.writeClosed:
+			return 0, net.ErrClosed
+		case p.closed:
+			return 0, syscall.ECONNRESET
+		case !p.writeDeadline.IsZero() && !now.Before(p.writeDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		if !now.Before(p.lastSendEnd) {
+			break
+		}
+		p.wait(earliest(p.lastSendEnd, p.writeDeadline))
+	}
+	if p.readClosed || len(b) == 0 {
+		return len(b), nil
+	}
+
+	now := time.Now()
+	sendEnd := now
+	if p.config.Bandwidth > 0 {
+		sendEnd = now.Add(time.Duration(int64(len(b)) * int64(time.Second) / p.config.Bandwidth))
+	}
+	deliverAt := sendEnd.Add(p.config.Latency)
+	if p.config.Jitter > 0 {
+		deliverAt = deliverAt.Add(time.Duration(p.network.random() * float64(p.config.Jitter)))
+	}
+	if p.config.Loss > 0 && p.network.random() < p.config.Loss {
+		deliverAt = deliverAt.Add(p.config.RetransmitDelay)
+	}
+	if deliverAt.Before(p.lastDeliver) {
+		deliverAt = p.lastDeliver
+	}
+	p.lastSendEnd = sendEnd
+	p.lastDeliver = deliverAt
+	p.segments = append(p.segments, segment{
+		data:      append([]byte(nil), b...),
+		deliverAt: deliverAt,
+	})
+	p.notify()
+	return len(b), nil
+}
+
+func (p *pipe) update(f func()) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	f()
+	p.notify()
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// Conn is one end of a Link, it implements connection.HalfOpenConn
+type Conn struct {
+	link       *Link
+	in         *pipe
+	out        *pipe
+	localAddr  Addr
+	remoteAddr Addr
+	closeOnce  sync.Once
+	abortive   atomic.Bool // SetLinger(0) is called, Close resets the link
+}
+
+func (c *Conn) opError(op string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &net.OpError{Op: op, Net: "netsim", Source: c.localAddr, Addr: c.remoteAddr, Err: err}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.in.read(b)
+	return n, c.opError("read", err)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.out.write(b)
+	return n, c.opError("write", err)
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.abortive.Load() {
+			c.link.Reset()
+		}
+		c.out.update(func() { c.out.writeClosed = true })
+		c.in.update(func() {
+			c.in.closed = true
+			c.in.segments = nil
+		})
+		c.link.closed()
+	})
+	return nil
+}
+
+func (c *Conn) CloseRead() error {
+	c.in.update(func() {
+		c.in.readClosed = true
+		c.in.segments = nil
+	})
+	return nil
+}
+
+func (c *Conn) CloseWrite() error {
+	c.out.update(func() { c.out.writeClosed = true })
+	return nil
+}
+
+// Like net.TCPConn, Close resets the link instead of sending FIN if sec is 0
+func (c *Conn) SetLinger(sec int) error {
+	c.abortive.Store(sec == 0)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.in.update(func() { c.in.readDeadline = t })
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.out.update(func() { c.out.writeDeadline = t })
+	return nil
+}
+
+// Link connects a dialed Conn and an accepted Conn
+type Link struct {
+	network  *Network
+	address  string // Dialed address
+	client   *Conn
+	server   *Conn
+	closeCnt int // Guarded by network.lock
+}
+
+func newLink(network *Network, address string, clientAddr, serverAddr Addr, config LinkConfig) *Link {
+	toServer, toClient := newPipe(network, config), newPipe(network, config)
+	link := &Link{network: network, address: address}
+	link.client = &Conn{link: link, in: toClient, out: toServer, localAddr: clientAddr, remoteAddr: serverAddr}
+	link.server = &Conn{link: link, in: toServer, out: toClient, localAddr: serverAddr, remoteAddr: clientAddr}
+	return link
+}
+
+// The dialing end
+func (l *Link) Client() *Conn {
+	return l.client
+}
+
+// The accepted end
+func (l *Link) Server() *Conn {
+	return l.server
+}
+
+// Change the config of both directions, it applies to bytes written later
+func (l *Link) SetConfig(config LinkConfig) {
+	config = config.withDefaults()
+	l.client.out.update(func() { l.client.out.config = config })
+	l.server.out.update(func() { l.server.out.config = config })
+}
+
+// Break the link abruptly, bytes in flight are lost and both ends get ECONNRESET
+func (l *Link) Reset() {
+	for _, p := range []*pipe{l.client.out, l.server.out} {
+		p.update(func() {
+			p.err = syscall.ECONNRESET
+			p.segments = nil
+		})
+	}
+	l.network.removeLink(l)
+}
+
+// Called when one end is closed, the link is removed once both ends are closed
+func (l *Link) closed() {
+	l.network.lock.Lock()
+	l.closeCnt++
+	done := l.closeCnt == 2
+	l.network.lock.Unlock()
+	if done {
+		l.network.removeLink(l)
+	}
+}
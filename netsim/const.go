@@ -0,0 +1,15 @@
+package netsim
+
+import "time"
+
+const (
+	DefaultRetransmitDelay = 200 * time.Millisecond // Delay of lost writes if LinkConfig.RetransmitDelay is zero
+	AcceptQueueSize        = 128                    // Dial blocks if more links are not accepted
+)
+
+// Addresses listened by Harness
+const (
+	ServerAddress = "server:443"
+	EchoAddress   = "echo:7"
+	SinkAddress   = "sink:9"
+)
@@ -0,0 +1,56 @@
+//go:build faultinject
+// +build faultinject
+
+package netsim_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/fault"
+	"github.com/ihciah/rabbit-tcp/netsim"
+	"github.com/ihciah/rabbit-tcp/options"
+)
+
+// Faults are injected into the raw connection of one tunnel, either end of it, while a connection is relaying.
+// Blocks lost with the tunnel are replayed by the others, and a new tunnel takes its place.
+func TestFaultRecovery(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		inject func(tunnelID uint32) error
+	}{
+		{"kill", func(tunnelID uint32) error { return fault.KillTunnel(tunnelID, 100) }},
+		{"corrupt", fault.CorruptTunnel},
+		// Longer than TunnelBlockTimeout, so the tunnel is treated dead
+		{"stall", func(tunnelID uint32) error { return fault.StallTunnel(tunnelID, 3*time.Second) }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := newHarnessWithSetup(t, 41, 3, netsim.LinkConfig{Latency: 5 * time.Millisecond, Bandwidth: 20 << 20},
+				&options.Options{TunnelBlockTimeout: 500 * time.Millisecond}, nil)
+			// Tunnels of former tests may be closing, wait until only both ends of ours are left
+			waitFor(t, "tunnels of former tests closed", func() bool {
+				return len(fault.Tunnels()) == 6
+			})
+			faulty := fault.Tunnels()[0]
+			echo(t, h, 8<<20, func() {
+				time.Sleep(50 * time.Millisecond)
+				if err := c.inject(faulty); err != nil {
+					t.Errorf("Inject into tunnel %d: %v.", faulty, err)
+				}
+			})
+
+			waitFor(t, "faulty tunnel closed", func() bool {
+				for _, tunnelID := range fault.Tunnels() {
+					if tunnelID == faulty {
+						return false
+					}
+				}
+				return true
+			})
+			waitFor(t, "tunnel replaced", func() bool {
+				return h.Client.TunnelCount() == 3 && len(h.TunnelLinks()) == 3
+			})
+			echo(t, h, 1<<20, nil)
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package netsim_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/netsim"
+)
+
+// Serve connections to address with handle in the network of the harness
+func serve(t *testing.T, h *netsim.Harness, address string, handle func(conn *netsim.Conn)) {
+	t.Helper()
+	listener, err := h.Network.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn.(*netsim.Conn))
+		}
+	}()
+}
+
+func waitClosed(t *testing.T, h *netsim.Harness, address string) {
+	t.Helper()
+	waitFor(t, "links to "+address+" closed", func() bool {
+		return len(h.Network.Links(address)) == 0
+	})
+}
+
+// Like `nc -N`: send the request, shut down the write side, then read the response until EOF.
+// The target answers only after it reads EOF of the request.
+func TestHalfCloseRequestResponse(t *testing.T) {
+	h := newHarness(t, 11, 3, netsim.LinkConfig{Latency: time.Millisecond, Jitter: 5 * time.Millisecond})
+	serve(t, h, "reverse:1", func(conn *netsim.Conn) {
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		for i, j := 0, len(request)-1; i < j; i, j = i+1, j-1 {
+			request[i], request[j] = request[j], request[i]
+		}
+		conn.Write(request)
+	})
+
+	for _, size := range []int{1, 100, 1 << 20} {
+		request := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(request)
+		conn := h.Client.Dial("reverse:1")
+		if _, err := conn.Write(request); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte("x")); err == nil {
+			t.Fatal("Write succeeds after CloseWrite.")
+		}
+
+		conn.SetReadDeadline(time.Now().Add(ioTimeout))
+		response, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("Read %d bytes of response: %v.", len(response), err)
+		}
+		for i, j := 0, len(response)-1; i < j; i, j = i+1, j-1 {
+			response[i], response[j] = response[j], response[i]
+		}
+		if !bytes.Equal(response, request) {
+			t.Fatalf("Response of %d bytes doesn't match request of %d bytes.", len(response), size)
+		}
+		conn.Close()
+		waitClosed(t, h, "reverse:1")
+	}
+}
+
+// The target sends a banner and shuts down its write side first, the client keeps sending after reading EOF
+func TestHalfCloseTargetFirst(t *testing.T) {
+	h := newHarness(t, 12, 2, netsim.LinkConfig{})
+	received := make(chan int64, 1)
+	serve(t, h, "banner:1", func(conn *netsim.Conn) {
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		conn.CloseWrite()
+		n, _ := io.Copy(ioutil.Discard, conn)
+		received <- n
+	})
+
+	conn := h.Client.Dial("banner:1")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(ioTimeout))
+	banner, err := io.ReadAll(conn)
+	if err != nil || string(banner) != "hello" {
+		t.Fatalf("Read banner %q: %v.", banner, err)
+	}
+	data := make([]byte, 1<<20)
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.CloseWrite()
+	select {
+	case n := <-received:
+		if n != 3<<20 {
+			t.Fatalf("Target received %d bytes of %d.", n, 3<<20)
+		}
+	case <-time.After(ioTimeout):
+		t.Fatal("Timeout waiting for the target.")
+	}
+	waitClosed(t, h, "banner:1")
+}
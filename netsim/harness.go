@@ -0,0 +1,74 @@
+package netsim
+
+import (
+	"github.com/ihciah/rabbit-tcp/client"
+	"github.com/ihciah/rabbit-tcp/options"
+	"github.com/ihciah/rabbit-tcp/server"
+	"github.com/ihciah/rabbit-tcp/tunnel"
+)
+
+// Harness wires a client and a server together over a Network, with an echo target at EchoAddress
+// and a sink target at SinkAddress which the server dials in the Network.
+// Tunnels are links dialed to ServerAddress, so they can be shaped by SetLinkConfig or reset from TunnelLinks.
+type Harness struct {
+	Network *Network
+	Server  *server.Server
+	Client  *client.Client
+	Sink    *Sink
+}
+
+// Tunnel links are configured by tunnelConfig, opts may be nil for defaults
+func NewHarness(seed int64, tunnelNum int, tunnelConfig LinkConfig, opts *options.Options) (*Harness, error) {
+	return NewHarnessWithSetup(seed, tunnelNum, tunnelConfig, opts, nil)
+}
+
+// Like NewHarness, but setup is called with the server before it serves, eg: to enable listen
+func NewHarnessWithSetup(seed int64, tunnelNum int, tunnelConfig LinkConfig, opts *options.Options, setup func(s *server.Server)) (*Harness, error) {
+	network := NewNetwork(seed)
+	network.SetLinkConfig(ServerAddress, tunnelConfig)
+	serverListener, err := network.Listen(ServerAddress)
+	if err != nil {
+		return nil, err
+	}
+	echoListener, err := network.Listen(EchoAddress)
+	if err != nil {
+		return nil, err
+	}
+	sinkListener, err := network.Listen(SinkAddress)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := tunnel.NewAEADCipher("CHACHA20-IETF-POLY1305", nil, "netsim")
+	if err != nil {
+		return nil, err
+	}
+
+	s := server.NewServer(cipher, opts)
+	s.SetDial(network.DialHalfOpen)
+	if setup != nil {
+		setup(&s)
+	}
+	go s.ServeListener(serverListener)
+	go ServeEcho(echoListener)
+	sink := ServeSink(sinkListener)
+
+	clientOpts := opts.WithDefaults()
+	clientOpts.DialTunnel = network.Dial
+	c := client.NewClient(tunnelNum, ServerAddress, cipher, clientOpts)
+	return &Harness{
+		Network: network,
+		Server:  &s,
+		Client:  &c,
+		Sink:    sink,
+	}, nil
+}
+
+// Alive tunnel links
+func (h *Harness) TunnelLinks() []*Link {
+	return h.Network.Links(ServerAddress)
+}
+
+func (h *Harness) Close() {
+	h.Client.Close()
+	h.Network.Close()
+}
@@ -0,0 +1,200 @@
+package netsim_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/netsim"
+	"github.com/ihciah/rabbit-tcp/options"
+	"github.com/ihciah/rabbit-tcp/server"
+)
+
+const (
+	waitTimeout = 10 * time.Second
+	ioTimeout   = 30 * time.Second
+)
+
+func newHarness(t *testing.T, seed int64, tunnelNum int, config netsim.LinkConfig) *netsim.Harness {
+	t.Helper()
+	return newHarnessWithSetup(t, seed, tunnelNum, config, &options.Options{}, nil)
+}
+
+// Like newHarness, but with opts and setup of the server, see netsim.NewHarnessWithSetup
+func newHarnessWithSetup(t *testing.T, seed int64, tunnelNum int, config netsim.LinkConfig, opts *options.Options, setup func(s *server.Server)) *netsim.Harness {
+	t.Helper()
+	opts.ErrorWait = 100 * time.Millisecond
+	h, err := netsim.NewHarnessWithSetup(seed, tunnelNum, config, opts, setup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	waitFor(t, "tunnels established", func() bool {
+		return h.Client.TunnelCount() == tunnelNum && len(h.TunnelLinks()) == tunnelNum
+	})
+	return h
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s.", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Write random data of size to the echo target through the client, and check what's echoed.
+// during is run while data is in flight.
+func echo(t *testing.T, h *netsim.Harness, size int, during func()) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	conn := h.Client.Dial(netsim.EchoAddress)
+	defer conn.Close()
+	go func() {
+		for written := 0; written < len(data); written += 32 * 1024 {
+			end := written + 32*1024
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err := conn.Write(data[written:end]); err != nil {
+				t.Errorf("Write: %v.", err)
+				return
+			}
+		}
+		conn.CloseWrite()
+	}()
+	if during != nil {
+		go during()
+	}
+	conn.SetReadDeadline(time.Now().Add(ioTimeout))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Read %d of %d bytes: %v.", len(got), len(data), err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Echoed %d bytes differ from %d bytes written.", len(got), len(data))
+	}
+}
+
+// Tunnels of different latencies deliver blocks of a connection out of order, blockProcessor restores the order
+func TestReorder(t *testing.T) {
+	h := newHarness(t, 1, 4, netsim.LinkConfig{Bandwidth: 50 << 20})
+	for i, link := range h.TunnelLinks() {
+		link.SetConfig(netsim.LinkConfig{
+			Latency:   time.Duration(i) * 15 * time.Millisecond,
+			Jitter:    5 * time.Millisecond,
+			Bandwidth: 50 << 20,
+		})
+	}
+	echo(t, h, 4<<20, nil)
+}
+
+// Lost writes are retransmitted late, which holds back the blocks behind them in the same tunnel only
+func TestLoss(t *testing.T) {
+	h := newHarness(t, 2, 4, netsim.LinkConfig{
+		Latency:         5 * time.Millisecond,
+		Jitter:          10 * time.Millisecond,
+		Bandwidth:       20 << 20,
+		Loss:            0.05,
+		RetransmitDelay: 50 * time.Millisecond,
+	})
+	echo(t, h, 2<<20, nil)
+}
+
+// Blocks which fail to be written to a reset tunnel are sent again by other tunnels
+func TestRetryOnReset(t *testing.T) {
+	h := newHarness(t, 3, 3, netsim.LinkConfig{Latency: 5 * time.Millisecond, Bandwidth: 20 << 20})
+	echo(t, h, 8<<20, func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+			if links := h.TunnelLinks(); len(links) > 0 {
+				links[i%len(links)].Reset()
+			}
+		}
+	})
+}
+
+// ClientManager dials a new tunnel in place of a reset one
+func TestTunnelReplacement(t *testing.T) {
+	h := newHarness(t, 4, 3, netsim.LinkConfig{})
+	conn := h.Client.Dial(netsim.SinkAddress)
+	defer conn.Close()
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	reset := h.TunnelLinks()[0]
+	reset.Reset()
+	waitFor(t, "tunnel replaced", func() bool {
+		links := h.TunnelLinks()
+		for _, link := range links {
+			if link == reset {
+				return false
+			}
+		}
+		return len(links) == 3 && h.Client.TunnelCount() == 3
+	})
+
+	if _, err := conn.Write(make([]byte, 100000)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "data sunk", func() bool {
+		return h.Sink.Bytes() == 100001
+	})
+}
+
+// Tunnels are closed with the client, so the server sees them closed too
+func TestClientClose(t *testing.T) {
+	h := newHarness(t, 5, 2, netsim.LinkConfig{})
+	h.Client.Close()
+	waitFor(t, "tunnels closed", func() bool {
+		return len(h.TunnelLinks()) == 0
+	})
+}
+
+// Write through a client and a server connected by tunnelNum links, until the sink receives all bytes
+func BenchmarkTransfer(b *testing.B) {
+	for _, tunnelNum := range []int{1, 4} {
+		b.Run(fmt.Sprintf("tunnelN=%d", tunnelNum), func(b *testing.B) {
+			benchmarkTransfer(b, tunnelNum)
+		})
+	}
+}
+
+func benchmarkTransfer(b *testing.B, tunnelNum int) {
+	h, err := netsim.NewHarness(1, tunnelNum, netsim.LinkConfig{}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer h.Close()
+	for h.Client.TunnelCount() < tunnelNum {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn := h.Client.Dial(netsim.SinkAddress)
+	defer conn.Close()
+
+	chunk := make([]byte, 32*1024)
+	total := int64(b.N) * int64(len(chunk))
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(ioTimeout)
+	for h.Sink.Bytes() < total {
+		if time.Now().After(deadline) {
+			b.Fatalf("Sink received %d bytes of %d.", h.Sink.Bytes(), total)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+}
@@ -0,0 +1,197 @@
+package netsim
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/connection"
+)
+
+// LinkConfig describes both directions of a link
+type LinkConfig struct {
+	Latency         time.Duration // One-way delay
+	Jitter          time.Duration // Random extra delay up to this for every write
+	Bandwidth       int64         // Bytes per second, 0 for unlimited
+	Loss            float64       // Probability of a write to be lost, it's retransmitted after RetransmitDelay
+	RetransmitDelay time.Duration // DefaultRetransmitDelay if zero
+}
+
+func (c LinkConfig) withDefaults() LinkConfig {
+	if c.RetransmitDelay == 0 {
+		c.RetransmitDelay = DefaultRetransmitDelay
+	}
+	return c
+}
+
+// Network is an in-memory network of stream links, random decisions of links are made from seed
+// so a scenario can be replayed.
+type Network struct {
+	lock      sync.Mutex
+	rand      *rand.Rand
+	listeners map[string]*Listener
+	configs   map[string]LinkConfig // By dialed address
+	links     map[string][]*Link    // Alive links by dialed address
+	down      map[string]bool       // Unreachable addresses, see SetUnreachable
+	dialed    int
+}
+
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rand:      rand.New(rand.NewSource(seed)),
+		listeners: make(map[string]*Listener),
+		configs:   make(map[string]LinkConfig),
+		links:     make(map[string][]*Link),
+		down:      make(map[string]bool),
+	}
+}
+
+func (n *Network) random() float64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.rand.Float64()
+}
+
+// Set the config of links dialed to address later, links dialed before can be changed by Link.SetConfig
+func (n *Network) SetLinkConfig(address string, config LinkConfig) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.configs[address] = config.withDefaults()
+}
+
+// Alive links dialed to address, in the order of dialing
+func (n *Network) Links(address string) []*Link {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]*Link(nil), n.links[address]...)
+}
+
+// Partition address from the network, alive links to it are reset and dials fail until it's reachable again
+func (n *Network) SetUnreachable(address string, unreachable bool) {
+	n.lock.Lock()
+	n.down[address] = unreachable
+	var links []*Link
+	if unreachable {
+		links = append(links, n.links[address]...)
+	}
+	n.lock.Unlock()
+	for _, l := range links {
+		l.Reset()
+	}
+}
+
+func (n *Network) removeLink(link *Link) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	links := n.links[link.address]
+	for i, l := range links {
+		if l == link {
+			n.links[link.address] = append(links[:i:i], links[i+1:]...)
+			return
+		}
+	}
+}
+
+func (n *Network) Listen(address string) (*Listener, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.listeners[address]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "netsim", Addr: Addr(address), Err: syscall.EADDRINUSE}
+	}
+	listener := &Listener{
+		network: n,
+		addr:    Addr(address),
+		accept:  make(chan *Conn, AcceptQueueSize),
+		done:    make(chan struct{}),
+	}
+	n.listeners[address] = listener
+	return listener, nil
+}
+
+func (n *Network) Dial(address string) (net.Conn, error) {
+	n.lock.Lock()
+	if n.down[address] {
+		n.lock.Unlock()
+		return nil, &net.OpError{Op: "dial", Net: "netsim", Addr: Addr(address), Err: syscall.EHOSTUNREACH}
+	}
+	listener, ok := n.listeners[address]
+	if !ok {
+		n.lock.Unlock()
+		return nil, &net.OpError{Op: "dial", Net: "netsim", Addr: Addr(address), Err: syscall.ECONNREFUSED}
+	}
+	n.dialed++
+	link := newLink(n, address, Addr(fmt.Sprintf("client-%d", n.dialed)), Addr(address), n.configs[address].withDefaults())
+	n.links[address] = append(n.links[address], link)
+	n.lock.Unlock()
+
+	select {
+	case listener.accept <- link.server:
+		return link.client, nil
+	case <-listener.done:
+		n.removeLink(link)
+		return nil, &net.OpError{Op: "dial", Net: "netsim", Addr: Addr(address), Err: syscall.ECONNREFUSED}
+	}
+}
+
+// Like Dial, for server.Server.SetDial
+func (n *Network) DialHalfOpen(address string) (connection.HalfOpenConn, error) {
+	conn, err := n.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*Conn), nil
+}
+
+// Reset all alive links and close all listeners
+func (n *Network) Close() {
+	n.lock.Lock()
+	var links []*Link
+	for _, l := range n.links {
+		links = append(links, l...)
+	}
+	var listeners []*Listener
+	for _, l := range n.listeners {
+		listeners = append(listeners, l)
+	}
+	n.lock.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	for _, l := range links {
+		l.Reset()
+	}
+}
+
+type Listener struct {
+	network   *Network
+	addr      Addr
+	accept    chan *Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "netsim", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		l.network.lock.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.lock.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
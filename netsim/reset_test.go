@@ -0,0 +1,89 @@
+package netsim_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/block"
+	"github.com/ihciah/rabbit-tcp/netsim"
+)
+
+// The target aborts with SetLinger(0), the client sees ECONNRESET instead of EOF after the data sent before
+func TestResetFromTarget(t *testing.T) {
+	h := newHarness(t, 21, 2, netsim.LinkConfig{Latency: time.Millisecond})
+	serve(t, h, "abort:1", func(conn *netsim.Conn) {
+		conn.Write([]byte("partial"))
+		time.Sleep(50 * time.Millisecond)
+		conn.SetLinger(0)
+		conn.Close()
+	})
+
+	conn := h.Client.Dial("abort:1")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(ioTimeout))
+	got, err := io.ReadAll(conn)
+	if string(got) != "partial" || !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("Read %q: %v, want ECONNRESET after the data.", got, err)
+	}
+	if _, err := conn.Write([]byte("x")); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("Write: %v, want ECONNRESET.", err)
+	}
+	waitClosed(t, h, "abort:1")
+}
+
+// Unlike a reset, a graceful close of the target is EOF
+func TestCloseFromTarget(t *testing.T) {
+	h := newHarness(t, 22, 2, netsim.LinkConfig{Latency: time.Millisecond})
+	serve(t, h, "close:1", func(conn *netsim.Conn) {
+		conn.Write([]byte("complete"))
+		conn.Close()
+	})
+
+	conn := h.Client.Dial("close:1")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(ioTimeout))
+	got, err := io.ReadAll(conn)
+	if string(got) != "complete" || err != nil {
+		t.Fatalf("Read %q: %v, want EOF after the data.", got, err)
+	}
+}
+
+// Dialing a closed port fails with ECONNREFUSED
+func TestResetRefused(t *testing.T) {
+	h := newHarness(t, 23, 2, netsim.LinkConfig{})
+	conn := h.Client.Dial("nobody:1")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(ioTimeout))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("Read: %v, want ECONNREFUSED.", err)
+	}
+}
+
+// The client aborts, the target sees ECONNRESET
+func TestResetFromClient(t *testing.T) {
+	h := newHarness(t, 24, 2, netsim.LinkConfig{})
+	result := make(chan error, 1)
+	serve(t, h, "victim:1", func(conn *netsim.Conn) {
+		_, err := io.Copy(ioutil.Discard, conn)
+		result <- err
+		conn.Close()
+	})
+
+	conn := h.Client.Dial("victim:1")
+	conn.Write([]byte("hello"))
+	time.Sleep(50 * time.Millisecond)
+	conn.(interface{ Reset(reason uint8) error }).Reset(block.ResetReasonPeer)
+	select {
+	case err := <-result:
+		if !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatalf("Target read: %v, want ECONNRESET.", err)
+		}
+	case <-time.After(ioTimeout):
+		t.Fatal("Timeout waiting for the target.")
+	}
+	waitClosed(t, h, "victim:1")
+}
@@ -0,0 +1,74 @@
+package netsim_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/netsim"
+	"github.com/ihciah/rabbit-tcp/options"
+)
+
+// Connections of the client survive losing all tunnels at once, unacknowledged blocks are replayed by new tunnels
+func TestResumeAfterAllTunnelsReset(t *testing.T) {
+	h := newHarness(t, 51, 3, netsim.LinkConfig{Latency: 5 * time.Millisecond, Bandwidth: 20 << 20})
+	echo(t, h, 8<<20, func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(150 * time.Millisecond)
+			for _, link := range h.TunnelLinks() {
+				link.Reset()
+			}
+		}
+	})
+}
+
+// Write msg to conn and read the echo
+func echoMessage(t *testing.T, conn io.ReadWriter, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("Write %q: %v.", msg, err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != msg {
+		t.Fatalf("Read %q: %v, want %q.", got, err, msg)
+	}
+}
+
+// An idle connection survives the server being unreachable for a while
+func TestResumeAfterPartition(t *testing.T) {
+	h := newHarness(t, 52, 2, netsim.LinkConfig{Latency: 2 * time.Millisecond})
+	conn := h.Client.Dial(netsim.EchoAddress)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(ioTimeout))
+	echoMessage(t, conn, "hello")
+
+	h.Network.SetUnreachable(netsim.ServerAddress, true)
+	time.Sleep(500 * time.Millisecond)
+	h.Network.SetUnreachable(netsim.ServerAddress, false)
+	echoMessage(t, conn, "world")
+}
+
+// If the server destroys the session before the client reattaches, the client starts a new session,
+// and its connections of the old one fail instead of waiting forever
+func TestResumeSessionDropped(t *testing.T) {
+	h := newHarnessWithSetup(t, 53, 2, netsim.LinkConfig{Latency: 2 * time.Millisecond},
+		&options.Options{EmptyPoolDestroy: 300 * time.Millisecond}, nil)
+	conn := h.Client.Dial(netsim.EchoAddress)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(ioTimeout))
+	echoMessage(t, conn, "hello")
+
+	h.Network.SetUnreachable(netsim.ServerAddress, true)
+	time.Sleep(time.Second)
+	h.Network.SetUnreachable(netsim.ServerAddress, false)
+	conn.SetReadDeadline(time.Now().Add(waitTimeout))
+	if n, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read %d bytes: %v, want the connection to fail.", n, err)
+	}
+	waitFor(t, "tunnels of the new session", func() bool {
+		return h.Client.TunnelCount() == 2
+	})
+	echo(t, h, 1<<20, nil)
+}
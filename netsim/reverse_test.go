@@ -0,0 +1,129 @@
+package netsim_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/netsim"
+	"github.com/ihciah/rabbit-tcp/options"
+	"github.com/ihciah/rabbit-tcp/server"
+)
+
+// Reverse listeners are real sockets on the server, and reverse targets are dialed over TCP by the client
+
+// An address of loopback nothing listens on
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// Echo target on loopback for reverse connections
+func serveTCPEcho(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// Serve reverse forwarding from remote to dest in background, its result is sent to the returned channel
+func serveReverse(h *netsim.Harness, remote, dest string) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- h.Client.ServeReverse(remote, dest)
+	}()
+	return result
+}
+
+func TestReverseForward(t *testing.T) {
+	h := newHarnessWithSetup(t, 21, 3, netsim.LinkConfig{Latency: time.Millisecond, Jitter: 5 * time.Millisecond},
+		&options.Options{EmptyPoolDestroy: 200 * time.Millisecond}, (*server.Server).EnableListen)
+	remote := freeAddress(t)
+	result := serveReverse(h, remote, serveTCPEcho(t))
+
+	waitFor(t, "remote listener", func() bool {
+		conn, err := net.Dial("tcp", remote)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	for _, size := range []int{1, 100, 1 << 20} {
+		conn, err := net.Dial("tcp", remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		go conn.Write(data)
+		conn.SetReadDeadline(time.Now().Add(ioTimeout))
+		got := make([]byte, size)
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("Read of %d bytes: %v.", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("Echoed %d bytes differ.", size)
+		}
+		conn.Close()
+	}
+
+	// Tearing down the client tears down the remote listener with the peer
+	h.Client.Close()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("ServeReverse returns nil.")
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("ServeReverse doesn't return after the client is closed.")
+	}
+	waitFor(t, "remote listener closed", func() bool {
+		conn, err := net.Dial("tcp", remote)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	})
+}
+
+// Servers listen only if EnableListen is called
+func TestReverseRefused(t *testing.T) {
+	h := newHarness(t, 22, 3, netsim.LinkConfig{})
+	remote := freeAddress(t)
+	select {
+	case err := <-serveReverse(h, remote, serveTCPEcho(t)):
+		if err == nil {
+			t.Fatal("ServeReverse returns nil.")
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("ServeReverse doesn't return when listen is refused.")
+	}
+	if conn, err := net.Dial("tcp", remote); err == nil {
+		conn.Close()
+		t.Fatal("Remote address is listened.")
+	}
+}
@@ -0,0 +1,66 @@
+package netsim
+
+import (
+	"io"
+	"net"
+
+	"go.uber.org/atomic"
+)
+
+// Write back everything read from connections accepted by listener, and close the write side on EOF.
+// It returns when listener is closed.
+func ServeEcho(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+			if c, ok := conn.(interface{ CloseWrite() error }); ok {
+				c.CloseWrite()
+			}
+		}()
+	}
+}
+
+// Sink discards everything read from its connections and counts them
+type Sink struct {
+	bytes atomic.Int64
+	conns atomic.Int64
+}
+
+// Serve connections accepted by listener in background until it's closed
+func ServeSink(listener net.Listener) *Sink {
+	sink := &Sink{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			sink.conns.Inc()
+			go func() {
+				defer conn.Close()
+				io.Copy(sink, conn)
+			}()
+		}
+	}()
+	return sink
+}
+
+func (s *Sink) Write(p []byte) (int, error) {
+	s.bytes.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// Bytes read from all connections
+func (s *Sink) Bytes() int64 {
+	return s.bytes.Load()
+}
+
+// Connections accepted
+func (s *Sink) Conns() int64 {
+	return s.conns.Load()
+}
@@ -0,0 +1,143 @@
+package netsim_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/netsim"
+	"github.com/ihciah/rabbit-tcp/options"
+	"github.com/ihciah/rabbit-tcp/server"
+)
+
+// Datagrams are relayed by real UDP sockets on the server, and UDP forward listens on loopback
+
+// UDP echo target on loopback which records source addresses of the datagrams
+type udpEcho struct {
+	conn    net.PacketConn
+	lock    sync.Mutex
+	sources []string
+}
+
+func serveUDPEcho(t *testing.T) *udpEcho {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	e := &udpEcho{conn: conn}
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			e.lock.Lock()
+			e.sources = append(e.sources, addr.String())
+			e.lock.Unlock()
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return e
+}
+
+func (e *udpEcho) address() string {
+	return e.conn.LocalAddr().String()
+}
+
+// Source address of the nth datagram echoed
+func (e *udpEcho) source(n int) string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.sources[n]
+}
+
+func newUDPHarness(t *testing.T, seed int64, sessionTimeout time.Duration) *netsim.Harness {
+	return newHarnessWithSetup(t, seed, 3, netsim.LinkConfig{Latency: time.Millisecond, Jitter: 5 * time.Millisecond},
+		&options.Options{DatagramSessionTimeout: sessionTimeout, OutboundBlockTimeout: 50 * time.Millisecond},
+		(*server.Server).EnableDatagram)
+}
+
+// Write a datagram of data to address by conn and read the echo, which must come from address
+func roundTrip(t *testing.T, conn net.PacketConn, address string, data string) {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo([]byte(data), addr); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(waitTimeout))
+	buf := make([]byte, 1500)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Read echo of %q: %v.", data, err)
+	}
+	if string(buf[:n]) != data || from.String() != address {
+		t.Fatalf("Read %q from %s, want %q from %s.", buf[:n], from, data, address)
+	}
+}
+
+func TestDatagramRoundTrip(t *testing.T) {
+	h := newUDPHarness(t, 31, time.Minute)
+	echo := serveUDPEcho(t)
+	conn := h.Client.ListenPacket()
+	defer conn.Close()
+	for i, data := range []string{"ping", "pong", string(make([]byte, 1400))} {
+		roundTrip(t, conn, echo.address(), data)
+		if echo.source(i) != echo.source(0) {
+			t.Fatalf("Datagram %d is sent from %s, the session is from %s.", i, echo.source(i), echo.source(0))
+		}
+	}
+}
+
+// Sessions of UDP forward are closed on both sides after idle, the next datagram opens a new one
+func TestDatagramIdle(t *testing.T) {
+	h := newUDPHarness(t, 32, 300*time.Millisecond)
+	echo := serveUDPEcho(t)
+	listen := freeUDPAddress(t)
+	go h.Client.ServeUDPForward(listen, echo.address())
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitFor(t, "UDP forward", func() bool {
+		addr, _ := net.ResolveUDPAddr("udp", listen)
+		conn.WriteTo([]byte("hello"), addr)
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _, err := conn.ReadFrom(make([]byte, 1500))
+		return err == nil
+	})
+	// Datagrams within the timeout keep the session
+	roundTrip(t, conn, listen, "ping")
+	time.Sleep(150 * time.Millisecond)
+	roundTrip(t, conn, listen, "ping")
+	echo.lock.Lock()
+	last := len(echo.sources) - 1
+	echo.lock.Unlock()
+	if echo.source(last) != echo.source(last-1) {
+		t.Fatalf("Session is changed within the timeout, from %s to %s.", echo.source(last-1), echo.source(last))
+	}
+
+	time.Sleep(time.Second)
+	roundTrip(t, conn, listen, "ping")
+	if echo.source(last+1) == echo.source(last) {
+		t.Fatalf("Session from %s is kept after idle.", echo.source(last))
+	}
+}
+
+func freeUDPAddress(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
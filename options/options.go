@@ -0,0 +1,99 @@
+package options
+
+import (
+	"net"
+	"time"
+)
+
+// Default values of Options
+const (
+	DefaultErrorWait                 = 3 * time.Second
+	DefaultTunnelBlockTimeout        = 8 * time.Second
+	DefaultEmptyPoolDestroy          = 60 * time.Second
+	DefaultTunnelSendQueueSize       = 48
+	DefaultTunnelRecvQueueSize       = 48
+	DefaultTunnelBatchDelay          = 0
+	DefaultResumeBufferBlocks        = 1024
+	DefaultPoolSendQueueSize         = 48
+	DefaultPacketWaitTimeout         = 7 * time.Second
+	DefaultOutboundBlockTimeout      = 3 * time.Second
+	DefaultOutboundRecvBuffer        = 16 * 1024
+	DefaultReorderBufferBlocks       = 4 * 1024
+	DefaultGlobalReorderBufferBlocks = 16 * 1024
+	DefaultDatagramSessionTimeout    = 60 * time.Second
+)
+
+// Dial tunnels over TCP
+func DefaultDialTunnel(address string) (net.Conn, error) {
+	return net.Dial("tcp", address)
+}
+
+// Options are tunables of client and server, for example, a high latency link needs longer timeouts.
+// Zero fields take default values, so a nil *Options works too.
+type Options struct {
+	// Tunnel pool
+	ErrorWait           time.Duration                          // If a tunnel cannot be dialed, will wait for this period and retry infinitely
+	TunnelBlockTimeout  time.Duration                          // If a tunnel cannot send a block within the limit, will treat it a dead tunnel
+	EmptyPoolDestroy    time.Duration                          // The pool will be destroyed(server side) if no tunnel dialed in
+	TunnelSendQueueSize int                                    // SendQueue channel cap of tunnel pool
+	TunnelRecvQueueSize int                                    // RecvQueue channel cap of tunnel pool
+	TunnelBatchDelay    time.Duration                          // Wait at most this period to batch more blocks into one tunnel write
+	ResumeBufferBlocks  int                                    // Blocks kept for replay until the other side acknowledges them, senders wait if more are kept
+	DialTunnel          func(address string) (net.Conn, error) // Used by clients to dial tunnels to the server, eg: over a proxy
+
+	// Connection pool
+	PoolSendQueueSize int // SendQueue channel cap of connection pool
+
+	// Connection
+	PacketWaitTimeout         time.Duration // If block processor is waiting for a "hole", and no packet comes within this limit, the Connection will be closed
+	OutboundBlockTimeout      time.Duration // Wait the period and check exit signal
+	OutboundRecvBuffer        int           // Receive buffer for Outbound Connection
+	ReorderBufferBlocks       int           // Out-of-order blocks cached by one connection, more will reset the connection
+	GlobalReorderBufferBlocks int           // Out-of-order blocks cached by all connections of the process, more will reset the connection
+
+	// UDP session
+	DatagramSessionTimeout time.Duration // UDP sessions idle for this period will be closed
+}
+
+// Options with all fields set to default values
+func Default() *Options {
+	return (*Options)(nil).WithDefaults()
+}
+
+// Return a copy with zero fields set to default values
+func (o *Options) WithDefaults() *Options {
+	filled := Options{}
+	if o != nil {
+		filled = *o
+	}
+	setDefault(&filled.ErrorWait, DefaultErrorWait)
+	setDefault(&filled.TunnelBlockTimeout, DefaultTunnelBlockTimeout)
+	setDefault(&filled.EmptyPoolDestroy, DefaultEmptyPoolDestroy)
+	setDefaultInt(&filled.TunnelSendQueueSize, DefaultTunnelSendQueueSize)
+	setDefaultInt(&filled.TunnelRecvQueueSize, DefaultTunnelRecvQueueSize)
+	setDefault(&filled.TunnelBatchDelay, DefaultTunnelBatchDelay)
+	setDefaultInt(&filled.ResumeBufferBlocks, DefaultResumeBufferBlocks)
+	if filled.DialTunnel == nil {
+		filled.DialTunnel = DefaultDialTunnel
+	}
+	setDefaultInt(&filled.PoolSendQueueSize, DefaultPoolSendQueueSize)
+	setDefault(&filled.PacketWaitTimeout, DefaultPacketWaitTimeout)
+	setDefault(&filled.OutboundBlockTimeout, DefaultOutboundBlockTimeout)
+	setDefaultInt(&filled.OutboundRecvBuffer, DefaultOutboundRecvBuffer)
+	setDefaultInt(&filled.ReorderBufferBlocks, DefaultReorderBufferBlocks)
+	setDefaultInt(&filled.GlobalReorderBufferBlocks, DefaultGlobalReorderBufferBlocks)
+	setDefault(&filled.DatagramSessionTimeout, DefaultDatagramSessionTimeout)
+	return &filled
+}
+
+func setDefault(d *time.Duration, value time.Duration) {
+	if *d == 0 {
+		*d = value
+	}
+}
+
+func setDefaultInt(i *int, value int) {
+	if *i == 0 {
+		*i = value
+	}
+}
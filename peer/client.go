@@ -2,45 +2,125 @@ package peer
 
 import (
 	"context"
+	"fmt"
 	"github.com/ihciah/rabbit-tcp/connection"
 	"github.com/ihciah/rabbit-tcp/connection_pool"
+	"github.com/ihciah/rabbit-tcp/options"
 	"github.com/ihciah/rabbit-tcp/tunnel"
 	"github.com/ihciah/rabbit-tcp/tunnel_pool"
 	"math/rand"
+	"net"
+	"path"
+	"sync"
 )
 
 type ClientPeer struct {
 	Peer
+	reverseTargets   *reverseTargets
+	compressPatterns []string // Connections to destinations matching any of them are compressed
 }
 
-func NewClientPeer(tunnelNum int, endpoint string, cipher tunnel.Cipher) ClientPeer {
+// Map addresses listened at server side to local targets
+type reverseTargets struct {
+	lock    sync.RWMutex
+	targets map[string]string
+}
+
+// Connections carried back from the server can only reach targets registered by Listen
+func (rt *reverseTargets) dial(address string) (connection.HalfOpenConn, error) {
+	rt.lock.RLock()
+	dest, ok := rt.targets[address]
+	rt.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no reverse target registered for %s", address)
+	}
+	return connection.DialTCP(dest)
+}
+
+func NewClientPeer(tunnelNum int, endpoint string, cipher tunnel.Cipher, opts *options.Options) ClientPeer {
 	if initRand() != nil {
 		panic("Error when initialize random seed.")
 	}
 	peerID := rand.Uint32()
-	return newClientPeerWithID(peerID, tunnelNum, endpoint, cipher)
+	return newClientPeerWithID(peerID, tunnelNum, endpoint, cipher, opts)
 }
 
-func newClientPeerWithID(peerID uint32, tunnelNum int, endpoint string, cipher tunnel.Cipher) ClientPeer {
+func newClientPeerWithID(peerID uint32, tunnelNum int, endpoint string, cipher tunnel.Cipher, opts *options.Options) ClientPeer {
 	peerCtx, removePeerFunc := context.WithCancel(context.Background())
+	reverseTargets := &reverseTargets{targets: make(map[string]string)}
 
 	poolManager := tunnel_pool.NewClientManager(tunnelNum, endpoint, peerID, cipher)
-	tunnelPool := tunnel_pool.NewTunnelPool(peerID, &poolManager, peerCtx)
-	connectionPool := connection_pool.NewConnectionPool(tunnelPool, false, peerCtx)
+	tunnelPool := tunnel_pool.NewTunnelPool(peerID, &poolManager, opts, peerCtx)
+	connectionPool := connection_pool.NewConnectionPool(tunnelPool, &connection_pool.Handler{
+		Dial: reverseTargets.dial,
+	}, false, opts, peerCtx)
 
 	return ClientPeer{
 		Peer: Peer{
 			peerID:         peerID,
-			connectionPool: *connectionPool,
-			tunnelPool:     *tunnelPool,
+			connectionPool: connectionPool,
+			tunnelPool:     tunnelPool,
 			ctx:            peerCtx,
 			cancel:         removePeerFunc,
 		},
+		reverseTargets: reverseTargets,
 	}
 }
 
 func (cp *ClientPeer) Dial(address string) connection.Connection {
 	conn := cp.connectionPool.NewPooledInboundConnection()
+	if cp.shouldCompress(address) && cp.tunnelPool.Features()&tunnel_pool.FeatureCompression != 0 {
+		conn.EnableCompression()
+	}
 	conn.SendConnect(address)
 	return conn
 }
+
+// Compress connections dialed to destinations matching any of patterns, which are in the syntax of path.Match,
+// eg: "*" or "*:80". It should be called before dialing. Compression is used only if the server supports it.
+func (cp *ClientPeer) SetCompression(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid compression pattern %q: %v", pattern, err)
+		}
+	}
+	cp.compressPatterns = patterns
+	return nil
+}
+
+func (cp *ClientPeer) shouldCompress(address string) bool {
+	for _, pattern := range cp.compressPatterns {
+		if matched, _ := path.Match(pattern, address); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of tunnels established now
+func (cp *ClientPeer) TunnelCount() int {
+	return cp.tunnelPool.TunnelCount()
+}
+
+// Open a UDP session, datagrams written to it are sent to their destination from the server side
+func (cp *ClientPeer) ListenPacket() net.PacketConn {
+	return cp.connectionPool.NewPooledDatagramConn()
+}
+
+// Ask the server to listen on address, connections accepted there will be carried back to dest.
+// The remote listener is alive until the returned connection is closed or read EOF.
+func (cp *ClientPeer) Listen(address, dest string) connection.Connection {
+	cp.reverseTargets.lock.Lock()
+	cp.reverseTargets.targets[address] = dest
+	cp.reverseTargets.lock.Unlock()
+	conn := cp.connectionPool.NewPooledInboundConnection()
+	conn.SendListen(address)
+	return conn
+}
+
+// Stop carrying connections accepted at address back
+func (cp *ClientPeer) Unlisten(address string) {
+	cp.reverseTargets.lock.Lock()
+	defer cp.reverseTargets.lock.Unlock()
+	delete(cp.reverseTargets.targets, address)
+}
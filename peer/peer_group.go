@@ -2,64 +2,131 @@ package peer
 
 import (
 	"context"
+	"errors"
+	"github.com/ihciah/rabbit-tcp/connection_pool"
 	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
 	"github.com/ihciah/rabbit-tcp/tunnel"
 	"github.com/ihciah/rabbit-tcp/tunnel_pool"
 	"net"
 	"sync"
 )
 
+var ErrSessionNotFound = errors.New("session not found")
+
 type PeerGroup struct {
-	lock        sync.Mutex
-	cipher      tunnel.Cipher
-	peerMapping map[uint32]*ServerPeer
-	logger      *logger.Logger
+	lock           sync.Mutex
+	cipher         tunnel.Cipher
+	handler        *connection_pool.Handler
+	opts           *options.Options
+	peerMapping    map[uint32]*ServerPeer
+	refuseUnproven bool // See RefuseUnprovenTunnels
+	logger         *logger.Logger
 }
 
-func NewPeerGroup(cipher tunnel.Cipher) PeerGroup {
+func NewPeerGroup(cipher tunnel.Cipher, handler *connection_pool.Handler, opts *options.Options) PeerGroup {
 	if initRand() != nil {
 		panic("Error when initialize random seed.")
 	}
 	return PeerGroup{
 		cipher:      cipher,
+		handler:     handler,
+		opts:        opts.WithDefaults(),
 		peerMapping: make(map[uint32]*ServerPeer),
-		logger:      logger.NewLogger("[PeerGroup]"),
+		logger:      logger.NewLogger("PeerGroup"),
 	}
 }
 
-// Add a tunnel to it's peer; will create peer if not exists
+// Peers without resumption, eg: clients of protocol version 1, have no secret to prove, so any tunnel presenting
+// the ID of such a peer joins it by default. After this, such a peer has only one tunnel: a tunnel presenting
+// its ID is refused while the peer has a tunnel, and replaces the peer otherwise.
+// Those clients must use one tunnel then. It must be called before tunnels are added.
+func (pg *PeerGroup) RefuseUnprovenTunnels() {
+	pg.lock.Lock()
+	defer pg.lock.Unlock()
+	pg.refuseUnproven = true
+}
+
+// Add a tunnel to it's peer; will create peer if not exists.
+// Tunnels with resumption negotiated must have attached to the session of their peer, and other tunnels
+// can't join a peer with a secret. See RefuseUnprovenTunnels for peers without a secret.
 func (pg *PeerGroup) AddTunnel(tunnel *tunnel_pool.Tunnel) error {
 	// add tunnel to peer(if absent, create peer to peer_group)
 	pg.lock.Lock()
-	var peer *ServerPeer
-	var ok bool
-
+	defer pg.lock.Unlock()
 	peerID := tunnel.GetPeerID()
-	if peer, ok = pg.peerMapping[peerID]; !ok {
-		peerContext, removePeerFunc := context.WithCancel(context.Background())
-		serverPeer := NewServerPeerWithID(peerID, peerContext, removePeerFunc)
-		peer = &serverPeer
-		pg.peerMapping[peerID] = peer
-		pg.logger.Infof("Server Peer %d added to PeerGroup.\n", peerID)
-
-		go func() {
-			<-peerContext.Done()
-			pg.RemovePeer(peerID)
-		}()
+	resumable := tunnel.GetFeatures()&tunnel_pool.FeatureResume != 0
+	peer, ok := pg.peerMapping[peerID]
+	if !ok && resumable {
+		// Destroyed after attached
+		return ErrSessionNotFound
+	}
+	if ok && !resumable && (peer.secret != (tunnel_pool.Secret{}) || pg.refuseUnproven) {
+		if peer.secret != (tunnel_pool.Secret{}) || peer.tunnelPool.TunnelCount() > 0 {
+			// Someone else has taken the peer ID, or nothing proves the tunnel is of the peer
+			pg.logger.Warnf("Tunnel of Server Peer %d rejected since it cannot prove the secret.\n", peerID)
+			return tunnel_pool.ErrSessionRejected
+		}
+		// Its tunnel is gone, connections are not handed to whoever presents the ID
+		pg.logger.Infof("Server Peer %d is replaced by a new tunnel.\n", peerID)
+		peer.Stop()
+		ok = false
+	}
+	if !ok {
+		peer = pg.newPeer(peerID, tunnel_pool.Secret{})
 	}
-	pg.lock.Unlock()
 	peer.tunnelPool.AddTunnel(tunnel)
 	return nil
 }
 
+// Attach a tunnel to the session of its peer, which it must prove to know the secret of;
+// the peer is created for a new session. It implements tunnel_pool.SessionStore.
+func (pg *PeerGroup) Attach(peerID uint32, verify func(tunnel_pool.Secret) bool, secret tunnel_pool.Secret, alone bool) (bool, error) {
+	pg.lock.Lock()
+	defer pg.lock.Unlock()
+	if peer, ok := pg.peerMapping[peerID]; ok {
+		if peer.secret == (tunnel_pool.Secret{}) || !verify(peer.secret) {
+			pg.logger.Warnf("Tunnel of Server Peer %d rejected since it cannot prove the secret.\n", peerID)
+			return false, tunnel_pool.ErrSessionRejected
+		}
+		if alone {
+			// Tunnels of the client's last network are gone, drop ours so blocks sent by them are replayed
+			peer.tunnelPool.CloseTunnels()
+		}
+		pg.logger.Infof("Server Peer %d resumed.\n", peerID)
+		return true, nil
+	}
+	pg.newPeer(peerID, secret)
+	return false, nil
+}
+
+// Create a peer and add it to peer group, lock must be held
+func (pg *PeerGroup) newPeer(peerID uint32, secret tunnel_pool.Secret) *ServerPeer {
+	peerContext, removePeerFunc := context.WithCancel(context.Background())
+	serverPeer := NewServerPeerWithID(peerID, pg.handler, pg.opts, peerContext, removePeerFunc)
+	serverPeer.secret = secret
+	peer := &serverPeer
+	pg.peerMapping[peerID] = peer
+	pg.logger.Infof("Server Peer %d added to PeerGroup.\n", peerID)
+
+	go func() {
+		<-peerContext.Done()
+		pg.removePeer(peer)
+	}()
+	return peer
+}
+
 // Like AddTunnel, add a raw connection
 func (pg *PeerGroup) AddTunnelFromConn(conn net.Conn) error {
-	tun, err := tunnel_pool.NewPassiveTunnel(conn, pg.cipher)
+	tun, err := tunnel_pool.NewResumablePassiveTunnel(conn, pg.cipher, pg)
 	if err != nil {
 		conn.Close()
 		return err
 	}
-	return pg.AddTunnel(&tun)
+	if err = pg.AddTunnel(&tun); err != nil {
+		conn.Close()
+	}
+	return err
 }
 
 func (pg *PeerGroup) RemovePeer(peerID uint32) {
@@ -68,3 +135,13 @@ func (pg *PeerGroup) RemovePeer(peerID uint32) {
 	defer pg.lock.Unlock()
 	delete(pg.peerMapping, peerID)
 }
+
+// Remove peer only, a peer replacing it with the same ID is kept
+func (pg *PeerGroup) removePeer(peer *ServerPeer) {
+	pg.lock.Lock()
+	defer pg.lock.Unlock()
+	if pg.peerMapping[peer.peerID] == peer {
+		pg.logger.Infof("Server Peer %d removed from peer group.\n", peer.peerID)
+		delete(pg.peerMapping, peer.peerID)
+	}
+}
@@ -0,0 +1,181 @@
+package peer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/connection_pool"
+	"github.com/ihciah/rabbit-tcp/options"
+	"github.com/ihciah/rabbit-tcp/tunnel"
+	"github.com/ihciah/rabbit-tcp/tunnel_pool"
+)
+
+// Handshake a tunnel created by newTunnel to the peer group, the client end is returned with the error of the server
+func addTunnel(pg *PeerGroup, newTunnel func(conn net.Conn) (tunnel_pool.Tunnel, error)) (tunnel_pool.Tunnel, net.Conn, error) {
+	c, s := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- pg.AddTunnelFromConn(s)
+	}()
+	tun, err := newTunnel(c)
+	if err != nil {
+		c.Close()
+		return tun, nil, <-done
+	}
+	return tun, c, <-done
+}
+
+// Handshake a tunnel without resumption to the peer group
+func addLegacyTunnel(t *testing.T, pg *PeerGroup, ciph tunnel.Cipher, peerID uint32) (net.Conn, error) {
+	_, c, err := addTunnel(pg, func(conn net.Conn) (tunnel_pool.Tunnel, error) {
+		return tunnel_pool.NewActiveTunnel(conn, ciph, peerID)
+	})
+	return c, err
+}
+
+// Handshake a tunnel joining the session of secret to the peer group, or starting a new one if secret is zero
+func addResumableTunnel(pg *PeerGroup, ciph tunnel.Cipher, peerID uint32, secret tunnel_pool.Secret) (tunnel_pool.Tunnel, net.Conn, error) {
+	return addTunnel(pg, func(conn net.Conn) (tunnel_pool.Tunnel, error) {
+		return tunnel_pool.NewResumableActiveTunnel(conn, ciph, peerID, secret, false)
+	})
+}
+
+func newTestPeerGroup(t *testing.T) (*PeerGroup, tunnel.Cipher) {
+	t.Helper()
+	ciph, err := tunnel.NewAEADCipher("CHACHA20-IETF-POLY1305", nil, "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg := NewPeerGroup(ciph, &connection_pool.Handler{}, &options.Options{})
+	return &pg, ciph
+}
+
+func (pg *PeerGroup) peer(peerID uint32) *ServerPeer {
+	pg.lock.Lock()
+	defer pg.lock.Unlock()
+	return pg.peerMapping[peerID]
+}
+
+// Tunnels of a peer without a secret join it by their peer ID, like clients of protocol version 1 expect
+func TestLegacyPeerTunnels(t *testing.T) {
+	pg, ciph := newTestPeerGroup(t)
+	for i := 1; i <= 3; i++ {
+		conn, err := addLegacyTunnel(t, pg, ciph, 7)
+		if err != nil {
+			t.Fatalf("tunnel %d: %v", i, err)
+		}
+		defer conn.Close()
+		if count := pg.peer(7).tunnelPool.TunnelCount(); count != i {
+			t.Fatalf("peer has %d tunnels, want %d", count, i)
+		}
+	}
+	pg.peer(7).Stop()
+}
+
+// Nothing proves a tunnel presenting the ID of a peer without a secret is of it, so with RefuseUnprovenTunnels
+// it's refused while the peer has a tunnel, and takes a new peer after the tunnel is gone
+func TestRefuseUnprovenTunnels(t *testing.T) {
+	pg, ciph := newTestPeerGroup(t)
+	pg.RefuseUnprovenTunnels()
+
+	first, err := addLegacyTunnel(t, pg, ciph, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := pg.peer(7)
+	if peer == nil {
+		t.Fatal("peer is not created")
+	}
+	if _, err := addLegacyTunnel(t, pg, ciph, 7); err != tunnel_pool.ErrSessionRejected {
+		t.Fatalf("second tunnel: %v, want %v", err, tunnel_pool.ErrSessionRejected)
+	}
+	if pg.peer(7) != peer || peer.tunnelPool.TunnelCount() != 1 {
+		t.Fatal("peer is changed by the rejected tunnel")
+	}
+
+	first.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for peer.tunnelPool.TunnelCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed tunnel is not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	replacing, err := addLegacyTunnel(t, pg, ciph, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replacing.Close()
+	replaced := pg.peer(7)
+	if replaced == peer || replaced == nil || replaced.tunnelPool.TunnelCount() != 1 {
+		t.Fatal("peer is not replaced")
+	}
+	select {
+	case <-peer.ctx.Done():
+	default:
+		t.Fatal("replaced peer is not stopped")
+	}
+	// Removal of the replaced peer keeps the new one
+	time.Sleep(50 * time.Millisecond)
+	if pg.peer(7) != replaced {
+		t.Fatal("new peer is removed with the replaced one")
+	}
+	replaced.Stop()
+}
+
+// Tunnels join the session of a peer only with the proof of its secret
+func TestSessionProof(t *testing.T) {
+	pg, ciph := newTestPeerGroup(t)
+	first, conn, err := addResumableTunnel(pg, ciph, 7, tunnel_pool.Secret{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := pg.peer(7)
+	secret := first.GetSecret()
+	if peer == nil || first.IsResumed() || secret == (tunnel_pool.Secret{}) || peer.secret != secret {
+		t.Fatal("session is not created")
+	}
+
+	wrong := secret
+	wrong[0] ^= 1
+	for _, c := range []struct {
+		name string
+		add  func() (net.Conn, error)
+	}{
+		{"wrong proof", func() (net.Conn, error) {
+			_, conn, err := addResumableTunnel(pg, ciph, 7, wrong)
+			return conn, err
+		}},
+		// A new session with the ID of an existing one
+		{"missing proof", func() (net.Conn, error) {
+			_, conn, err := addResumableTunnel(pg, ciph, 7, tunnel_pool.Secret{})
+			return conn, err
+		}},
+		{"without resumption", func() (net.Conn, error) {
+			return addLegacyTunnel(t, pg, ciph, 7)
+		}},
+	} {
+		conn, err := c.add()
+		if conn != nil {
+			conn.Close()
+		}
+		if err != tunnel_pool.ErrSessionRejected {
+			t.Fatalf("%s: %v, want %v", c.name, err, tunnel_pool.ErrSessionRejected)
+		}
+		if pg.peer(7) != peer || peer.secret != secret || peer.tunnelPool.TunnelCount() != 1 {
+			t.Fatalf("%s: peer is changed by the rejected tunnel", c.name)
+		}
+	}
+
+	joined, conn, err := addResumableTunnel(pg, ciph, 7, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !joined.IsResumed() || pg.peer(7) != peer || peer.tunnelPool.TunnelCount() != 2 {
+		t.Fatal("session is not resumed")
+	}
+	peer.Stop()
+}
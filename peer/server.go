@@ -3,24 +3,26 @@ package peer
 import (
 	"context"
 	"github.com/ihciah/rabbit-tcp/connection_pool"
+	"github.com/ihciah/rabbit-tcp/options"
 	"github.com/ihciah/rabbit-tcp/tunnel_pool"
 )
 
 type ServerPeer struct {
 	Peer
+	secret tunnel_pool.Secret // Tunnels must prove they know it, zero if the peer doesn't support resumption
 }
 
-func NewServerPeerWithID(peerID uint32, peerContext context.Context, removePeerFunc context.CancelFunc) ServerPeer {
+func NewServerPeerWithID(peerID uint32, handler *connection_pool.Handler, opts *options.Options, peerContext context.Context, removePeerFunc context.CancelFunc) ServerPeer {
 	poolManager := tunnel_pool.NewServerManager(removePeerFunc)
-	tunnelPool := tunnel_pool.NewTunnelPool(peerID, &poolManager, peerContext)
+	tunnelPool := tunnel_pool.NewTunnelPool(peerID, &poolManager, opts, peerContext)
 
-	connectionPool := connection_pool.NewConnectionPool(tunnelPool, true, peerContext)
+	connectionPool := connection_pool.NewConnectionPool(tunnelPool, handler, true, opts, peerContext)
 
 	return ServerPeer{
 		Peer: Peer{
 			peerID:         peerID,
-			connectionPool: *connectionPool,
-			tunnelPool:     *tunnelPool,
+			connectionPool: connectionPool,
+			tunnelPool:     tunnelPool,
 			ctx:            peerContext,
 			cancel:         removePeerFunc,
 		},
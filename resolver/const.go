@@ -0,0 +1,20 @@
+package resolver
+
+import "time"
+
+// Default values of Config
+const (
+	DefaultTimeout            = 5 * time.Second  // Of a lookup, including retries on other servers
+	DefaultCacheSize          = 4096             // Names of each address family cached
+	DefaultMaxTTL             = time.Hour        // Records are not cached longer than this even if their TTL is
+	DefaultNegativeTTL        = 30 * time.Second // Nonexistent names are cached for this if the server tells no SOA
+	DefaultSystemTTL          = time.Minute      // The system resolver tells no TTL, so its answers are cached for this
+	DefaultHappyEyeballsDelay = 250 * time.Millisecond
+	DefaultDialTimeout        = 30 * time.Second
+)
+
+const (
+	maxMessageSize = 65535 // Of DNS over TCP, TLS and HTTPS
+	udpMessageSize = 1232  // Advertised by EDNS0, it avoids IP fragmentation
+	dohContentType = "application/dns-message"
+)
@@ -0,0 +1,117 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/connection"
+)
+
+// Dial a TCP address with its host looked up by r, for server.Server.SetDial.
+// Addresses of both families are tried alternately, preferred family first, each one is given
+// HappyEyeballsDelay before the next one is tried too, the first connected wins(RFC 8305).
+func (r *Resolver) Dial(address string) (connection.HalfOpenConn, error) {
+	return r.DialBind(address, nil)
+}
+
+// Like Dial, but dial with bind, for server.Server.SetBindDial
+func (r *Resolver) DialBind(address string, bind *connection.Bind) (connection.HalfOpenConn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.DialTimeout)
+	defer cancel()
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := r.dialParallel(ctx, interleave(ips), port, bind)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(connection.HalfOpenConn), nil
+}
+
+// Alternate families of ips, starting with the family of the first one
+func interleave(ips []net.IP) []net.IP {
+	var primary, secondary []net.IP
+	for _, ip := range ips {
+		if len(primary) == 0 || (ip.To4() == nil) == (primary[0].To4() == nil) {
+			primary = append(primary, ip)
+		} else {
+			secondary = append(secondary, ip)
+		}
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			sorted = append(sorted, primary[i])
+		}
+		if i < len(secondary) {
+			sorted = append(sorted, secondary[i])
+		}
+	}
+	return sorted
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+func (r *Resolver) dialParallel(ctx context.Context, ips []net.IP, port string, bind *connection.Bind) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	var stagger <-chan time.Time
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := r.dialContext(ctx, ip, port, bind)
+			results <- dialResult{conn: conn, err: err}
+		}()
+		stagger = nil
+		if next < len(ips) {
+			stagger = time.After(r.config.HappyEyeballsDelay)
+		}
+	}
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Losers connected before cancelled are closed
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if loser := <-results; loser.conn != nil {
+							loser.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			// A failed attempt needn't wait for the delay
+			if next < len(ips) {
+				start()
+			}
+		case <-stagger:
+			start()
+		}
+	}
+	return nil, firstErr
+}
+
+// Dial ip and port with bind, it can be replaced for tests
+func dialContext(ctx context.Context, ip net.IP, port string, bind *connection.Bind) (net.Conn, error) {
+	return bind.Dialer(ip).DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+}
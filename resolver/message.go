@@ -0,0 +1,178 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// Only what a stub resolver needs of RFC 1035 is implemented
+
+const (
+	typeA    = 1
+	typeSOA  = 6
+	typeAAAA = 28
+	typeOPT  = 41
+	classIN  = 1
+
+	flagResponse  = 1 << 15
+	flagTruncated = 1 << 9
+	flagRecursion = 1 << 8
+
+	rcodeSuccess  = 0
+	rcodeNameErr  = 3 // NXDOMAIN
+	headerSize    = 12
+	maxNameLength = 255
+)
+
+var (
+	errMalformed   = errors.New("malformed DNS message")
+	errInvalidName = errors.New("invalid domain name")
+)
+
+// Build a recursive query of qtype for name, with an EDNS0 record advertising udpMessageSize
+func newQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > maxNameLength-2 {
+		return nil, errInvalidName
+	}
+	msg := make([]byte, headerSize, headerSize+len(name)+2+4+11)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], flagRecursion)
+	binary.BigEndian.PutUint16(msg[4:], 1)  // QDCOUNT
+	binary.BigEndian.PutUint16(msg[10:], 1) // ARCOUNT
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return nil, errInvalidName
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = appendUint16(msg, qtype)
+	msg = appendUint16(msg, classIN)
+	// OPT record: root name, type, UDP payload size in class, zero TTL and no data
+	msg = append(msg, 0)
+	msg = appendUint16(msg, typeOPT)
+	msg = appendUint16(msg, udpMessageSize)
+	msg = append(msg, 0, 0, 0, 0, 0, 0)
+	return msg, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+type answer struct {
+	rcode     int
+	truncated bool
+	ips       []net.IP
+	ttl       time.Duration // Minimum of records in the answer section
+	soaTTL    time.Duration // How long the name can be taken as nonexistent, if hasSOA
+	hasSOA    bool
+}
+
+// Parse a response to the query of id and qtype
+func parseAnswer(msg []byte, id uint16, qtype uint16) (*answer, error) {
+	if len(msg) < headerSize || binary.BigEndian.Uint16(msg) != id {
+		return nil, errMalformed
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&flagResponse == 0 {
+		return nil, errMalformed
+	}
+	ans := &answer{
+		rcode:     int(flags & 0xf),
+		truncated: flags&flagTruncated != 0,
+	}
+	if ans.truncated {
+		return ans, nil
+	}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	anCount := int(binary.BigEndian.Uint16(msg[6:]))
+	nsCount := int(binary.BigEndian.Uint16(msg[8:]))
+	offset := headerSize
+	var err error
+	for i := 0; i < qdCount; i++ {
+		if offset, err = skipName(msg, offset); err != nil {
+			return nil, err
+		}
+		offset += 4
+	}
+	first := true
+	for i := 0; i < anCount+nsCount; i++ {
+		var rrType uint16
+		var ttl time.Duration
+		var data []byte
+		if rrType, ttl, data, offset, err = parseRecord(msg, offset); err != nil {
+			return nil, err
+		}
+		if i >= anCount {
+			// SOA in authority section tells how long a negative answer lasts, RFC 2308
+			if rrType == typeSOA && len(data) >= 20 {
+				minimum := time.Duration(binary.BigEndian.Uint32(data[len(data)-4:])) * time.Second
+				ans.soaTTL, ans.hasSOA = minDuration(ttl, minimum), true
+			}
+			continue
+		}
+		// CNAME records count for TTL, the recursive server has followed them
+		if first || ttl < ans.ttl {
+			ans.ttl, first = ttl, false
+		}
+		switch {
+		case rrType == typeA && qtype == typeA && len(data) == net.IPv4len:
+			ans.ips = append(ans.ips, net.IP(append([]byte(nil), data...)))
+		case rrType == typeAAAA && qtype == typeAAAA && len(data) == net.IPv6len:
+			ans.ips = append(ans.ips, net.IP(append([]byte(nil), data...)))
+		}
+	}
+	return ans, nil
+}
+
+func parseRecord(msg []byte, offset int) (rrType uint16, ttl time.Duration, data []byte, next int, err error) {
+	if offset, err = skipName(msg, offset); err != nil {
+		return
+	}
+	if offset+10 > len(msg) {
+		err = errMalformed
+		return
+	}
+	rrType = binary.BigEndian.Uint16(msg[offset:])
+	ttl = time.Duration(binary.BigEndian.Uint32(msg[offset+4:])&0x7fffffff) * time.Second
+	length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+	offset += 10
+	if offset+length > len(msg) {
+		err = errMalformed
+		return
+	}
+	return rrType, ttl, msg[offset : offset+length], offset + length, nil
+}
+
+// Skip a possibly compressed name
+func skipName(msg []byte, offset int) (int, error) {
+	for offset < len(msg) {
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0:
+			if offset+2 > len(msg) {
+				return 0, errMalformed
+			}
+			return offset + 2, nil
+		case length&0xc0 != 0:
+			return 0, errMalformed
+		}
+		offset += 1 + length
+	}
+	return 0, errMalformed
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,304 @@
+package resolver
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/connection"
+	"github.com/ihciah/rabbit-tcp/logger"
+)
+
+// Family tells which address families a Resolver looks up and which one it connects to first
+type Family int
+
+const (
+	FamilyDual       Family = iota // Both, IPv6 first
+	FamilyPreferIPv4               // Both, IPv4 first
+	FamilyIPv4                     // IPv4 only
+	FamilyIPv6                     // IPv6 only
+)
+
+// Parse a family from dual, ipv4-first, ipv4 or ipv6
+func ParseFamily(s string) (Family, error) {
+	switch strings.ToLower(s) {
+	case "", "dual":
+		return FamilyDual, nil
+	case "ipv4-first":
+		return FamilyPreferIPv4, nil
+	case "ipv4":
+		return FamilyIPv4, nil
+	case "ipv6":
+		return FamilyIPv6, nil
+	}
+	return 0, fmt.Errorf("unsupported address family %s", s)
+}
+
+// Query types looked up by f, in order of preference
+func (f Family) queryTypes() []uint16 {
+	switch f {
+	case FamilyPreferIPv4:
+		return []uint16{typeA, typeAAAA}
+	case FamilyIPv4:
+		return []uint16{typeA}
+	case FamilyIPv6:
+		return []uint16{typeAAAA}
+	}
+	return []uint16{typeAAAA, typeA}
+}
+
+// Config of a Resolver, zero fields take default values
+type Config struct {
+	// Upstream DNS servers tried in order, eg: 8.8.8.8, tcp://8.8.8.8, tls://1.1.1.1, https://dns.google/dns-query.
+	// The system resolver is used if it's empty.
+	Servers            []string
+	TLSConfig          *tls.Config   // Used to connect tls and https servers, eg: with RootCAs of a private server
+	Family             Family        // Address families looked up and dialed
+	Timeout            time.Duration // A lookup fails if no server answers within the limit
+	CacheSize          int           // Names of each address family cached
+	MaxTTL             time.Duration // Answers are cached for their TTL but at most this period
+	NegativeTTL        time.Duration // Nonexistent names are cached for this period if the server tells no SOA
+	SystemTTL          time.Duration // Answers of the system resolver are cached for this period
+	HappyEyeballsDelay time.Duration // Dial waits this period for an address before trying the next one too
+	DialTimeout        time.Duration // Dial fails if no address is connected within the limit
+}
+
+func (c *Config) setDefaults() {
+	if c.Timeout == 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = DefaultCacheSize
+	}
+	if c.MaxTTL == 0 {
+		c.MaxTTL = DefaultMaxTTL
+	}
+	if c.NegativeTTL == 0 {
+		c.NegativeTTL = DefaultNegativeTTL
+	}
+	if c.SystemTTL == 0 {
+		c.SystemTTL = DefaultSystemTTL
+	}
+	if c.HappyEyeballsDelay == 0 {
+		c.HappyEyeballsDelay = DefaultHappyEyeballsDelay
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = DefaultDialTimeout
+	}
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	done   chan struct{} // Closed when the lookup ends, concurrent lookups of the name wait for it
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+// Resolver looks up names on the server side for connections, with a cache of answers
+type Resolver struct {
+	config      Config
+	upstreams   []upstream
+	lock        sync.Mutex
+	cache       map[cacheKey]*cacheEntry
+	dialContext func(ctx context.Context, ip net.IP, port string, bind *connection.Bind) (net.Conn, error)
+	logger      *logger.Logger
+}
+
+func New(config Config) (*Resolver, error) {
+	config.setDefaults()
+	r := &Resolver{
+		config:      config,
+		cache:       make(map[cacheKey]*cacheEntry),
+		dialContext: dialContext,
+		logger:      logger.NewLogger("Resolver"),
+	}
+	for _, server := range config.Servers {
+		u, err := parseUpstream(server, config.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	return r, nil
+}
+
+// Look up addresses of host of the configured families, preferred ones first.
+// Errors are *net.DNSError, IP addresses are returned as they are.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	qtypes := r.config.Family.queryTypes()
+	ips := make([][]net.IP, len(qtypes))
+	errs := make([]error, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			ips[i], errs[i] = r.lookup(ctx, name, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+	var addrs []net.IP
+	var err error
+	for i := range qtypes {
+		addrs = append(addrs, ips[i]...)
+		// A failure is more telling than a nonexistent name of the other family
+		if dnsErr, ok := errs[i].(*net.DNSError); err == nil || (ok && !dnsErr.IsNotFound) {
+			err = errs[i]
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, err
+}
+
+// Look up name of qtype from the cache, or the upstream if it's not cached or expired
+func (r *Resolver) lookup(ctx context.Context, name string, qtype uint16) ([]net.IP, error) {
+	key := cacheKey{name: name, qtype: qtype}
+	r.lock.Lock()
+	entry, ok := r.cache[key]
+	if ok {
+		select {
+		case <-entry.done:
+			if time.Now().Before(entry.expire) {
+				r.lock.Unlock()
+				return entry.ips, entry.err
+			}
+			ok = false
+		default:
+		}
+	}
+	if !ok {
+		r.evict()
+		entry = &cacheEntry{done: make(chan struct{})}
+		r.cache[key] = entry
+		// The lookup goes on if ctx is cancelled, others may be waiting for it
+		go func() {
+			queryCtx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+			defer cancel()
+			var ttl time.Duration
+			entry.ips, ttl, entry.err = r.query(queryCtx, name, qtype)
+			entry.expire = time.Now().Add(ttl)
+			close(entry.done)
+		}()
+	}
+	r.lock.Unlock()
+	select {
+	case <-entry.done:
+		return entry.ips, entry.err
+	case <-ctx.Done():
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: name, IsTimeout: errors.Is(ctx.Err(), context.DeadlineExceeded)}
+	}
+}
+
+// Make room for an entry, expired entries are removed first. It must be called with lock held.
+func (r *Resolver) evict() {
+	if len(r.cache) < r.config.CacheSize {
+		return
+	}
+	now := time.Now()
+	for key, entry := range r.cache {
+		select {
+		case <-entry.done:
+			if !now.Before(entry.expire) {
+				delete(r.cache, key)
+			}
+		default:
+		}
+	}
+	for key := range r.cache {
+		if len(r.cache) < r.config.CacheSize {
+			break
+		}
+		delete(r.cache, key)
+	}
+}
+
+// Query name of qtype, it returns how long the answer can be cached
+func (r *Resolver) query(ctx context.Context, name string, qtype uint16) ([]net.IP, time.Duration, error) {
+	if len(r.upstreams) == 0 {
+		return r.querySystem(ctx, name, qtype)
+	}
+	var idBytes [2]byte
+	if _, err := io.ReadFull(crand.Reader, idBytes[:]); err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name}
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	query, err := newQuery(id, name, qtype)
+	if err != nil {
+		return nil, r.config.NegativeTTL, &net.DNSError{Err: err.Error(), Name: name, IsNotFound: true}
+	}
+	dnsErr := &net.DNSError{Err: "no DNS server answered", Name: name}
+	for _, u := range r.upstreams {
+		response, err := u.exchange(ctx, query)
+		var ans *answer
+		if err == nil {
+			ans, err = parseAnswer(response, id, qtype)
+		}
+		if err != nil {
+			r.logger.Debugf("Query %s of %s failed: %v.\n", name, u, err)
+			var netErr net.Error
+			dnsErr = &net.DNSError{Err: err.Error(), Name: name, Server: u.String(), IsTimeout: errors.As(err, &netErr) && netErr.Timeout()}
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		switch ans.rcode {
+		case rcodeSuccess:
+			if len(ans.ips) > 0 {
+				return ans.ips, minDuration(ans.ttl, r.config.MaxTTL), nil
+			}
+		case rcodeNameErr:
+		default:
+			// SERVFAIL, REFUSED and so on, another server may answer
+			r.logger.Debugf("Query %s of %s failed with rcode %d.\n", name, u, ans.rcode)
+			dnsErr = &net.DNSError{Err: fmt.Sprintf("server failure, rcode %d", ans.rcode), Name: name, Server: u.String(), IsTemporary: true}
+			continue
+		}
+		ttl := r.config.NegativeTTL
+		if ans.hasSOA {
+			ttl = ans.soaTTL
+		}
+		return nil, minDuration(ttl, r.config.MaxTTL), &net.DNSError{Err: "no such host", Name: name, Server: u.String(), IsNotFound: true}
+	}
+	// Failures are not cached
+	return nil, 0, dnsErr
+}
+
+func (r *Resolver) querySystem(ctx context.Context, name string, qtype uint16) ([]net.IP, time.Duration, error) {
+	network := "ip4"
+	if qtype == typeAAAA {
+		network = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, name)
+	if err != nil {
+		// No address of the family is told apart from failures by timeout and temporary
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && !dnsErr.IsTimeout && !dnsErr.IsTemporary {
+			return nil, r.config.NegativeTTL, err
+		}
+		return nil, 0, err
+	}
+	return ips, r.config.SystemTTL, nil
+}
@@ -0,0 +1,376 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/connection"
+	"go.uber.org/atomic"
+)
+
+// A DNS server answering over udp, tcp, tls and https:
+// a.test has an IPv4 and an IPv6 address, big.test too but it's truncated over udp,
+// v4.test has only an IPv4 address, fail.test fails and other names don't exist
+type mockServer struct {
+	queries atomic.Int32
+}
+
+func (m *mockServer) respond(query []byte, udp bool) []byte {
+	m.queries.Inc()
+	offset := headerSize
+	var labels []string
+	for query[offset] != 0 {
+		length := int(query[offset])
+		labels = append(labels, string(query[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+	qtype := binary.BigEndian.Uint16(query[offset+1:])
+	name := strings.Join(labels, ".")
+
+	// Header and question of the query, without the OPT record
+	msg := append([]byte(nil), query[:offset+5]...)
+	binary.BigEndian.PutUint16(msg[2:], flagResponse|flagRecursion)
+	binary.BigEndian.PutUint16(msg[10:], 0)
+	var anCount, nsCount uint16
+	record := func(rrType uint16, ttl uint32, data []byte) {
+		msg = append(msg, 0xc0, headerSize) // Pointer to the name of the question
+		msg = appendUint16(msg, rrType)
+		msg = appendUint16(msg, classIN)
+		msg = append(msg, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl))
+		msg = appendUint16(msg, uint16(len(data)))
+		msg = append(msg, data...)
+	}
+	soa := func() {
+		data := make([]byte, 22) // Root names and a minimum TTL of 1 second
+		binary.BigEndian.PutUint32(data[18:], 1)
+		record(typeSOA, 60, data)
+		nsCount++
+	}
+	switch name {
+	case "big.test", "a.test":
+		if name == "big.test" && udp {
+			binary.BigEndian.PutUint16(msg[2:], flagResponse|flagRecursion|flagTruncated)
+			break
+		}
+		record(5, 100, []byte{1, 'x', 0}) // CNAME comes first and is skipped
+		if qtype == typeA {
+			record(typeA, 300, net.IPv4(127, 0, 0, 1).To4())
+		} else {
+			record(typeAAAA, 300, net.IPv6loopback)
+		}
+		anCount = 2
+	case "v4.test":
+		if qtype != typeA {
+			soa()
+			break
+		}
+		record(typeA, 300, net.IPv4(127, 0, 0, 2).To4())
+		anCount = 1
+	case "fail.test":
+		msg[3] |= 2 // SERVFAIL
+	default:
+		msg[3] |= rcodeNameErr
+		soa()
+	}
+	binary.BigEndian.PutUint16(msg[6:], anCount)
+	binary.BigEndian.PutUint16(msg[8:], nsCount)
+	return msg
+}
+
+// Serve udp and tcp on the same port, the address is returned
+func (m *mockServer) serve(t *testing.T) string {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		packetConn.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		packetConn.Close()
+		listener.Close()
+	})
+	go func() {
+		buf := make([]byte, udpMessageSize)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packetConn.WriteTo(m.respond(buf[:n], true), addr)
+		}
+	}()
+	go m.serveStream(listener)
+	return packetConn.LocalAddr().String()
+}
+
+// Serve messages prefixed with their length, for tcp and tls
+func (m *mockServer) serveStream(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			response := m.respond(query, false)
+			conn.Write(append(appendUint16(nil, uint16(len(response))), response...))
+		}()
+	}
+}
+
+func (m *mockServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != dohContentType {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	query, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.Write(m.respond(query, false))
+}
+
+func TestLookupUDP(t *testing.T) {
+	server := &mockServer{}
+	// The first server refuses, the next one is tried
+	r, err := New(Config{Servers: []string{"udp://127.0.0.1:1", server.serve(t)}, Timeout: time.Second, MaxTTL: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	ips, err := r.LookupIP(ctx, "A.test.")
+	if err != nil || len(ips) != 2 || !ips[0].Equal(net.IPv6loopback) || !ips[1].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("a.test: %v, %v", ips, err)
+	}
+	if _, err := r.LookupIP(ctx, "a.test"); err != nil || server.queries.Load() != 2 {
+		t.Fatalf("cached a.test: %v, %d queries", err, server.queries.Load())
+	}
+	time.Sleep(250 * time.Millisecond)
+	if _, err := r.LookupIP(ctx, "a.test"); err != nil || server.queries.Load() != 4 {
+		t.Fatalf("expired a.test: %v, %d queries", err, server.queries.Load())
+	}
+
+	// An address of one family is enough
+	if ips, err := r.LookupIP(ctx, "v4.test"); err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("v4.test: %v, %v", ips, err)
+	}
+	// Truncated answers are queried again over tcp
+	if ips, err := r.LookupIP(ctx, "big.test"); err != nil || len(ips) != 2 {
+		t.Fatalf("big.test: %v, %v", ips, err)
+	}
+
+	var dnsErr *net.DNSError
+	queries := server.queries.Load()
+	if _, err := r.LookupIP(ctx, "nx.test"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("nx.test: %v", err)
+	}
+	if _, err := r.LookupIP(ctx, "nx.test"); server.queries.Load() != queries+2 {
+		t.Fatalf("nonexistent name is not cached: %v, %d queries", err, server.queries.Load()-queries)
+	}
+
+	// Failures are not cached
+	queries = server.queries.Load()
+	if _, err := r.LookupIP(ctx, "fail.test"); !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+		t.Fatalf("fail.test: %v", err)
+	}
+	if _, err := r.LookupIP(ctx, "fail.test"); server.queries.Load() != queries+4 {
+		t.Fatalf("failure is cached: %v, %d queries", err, server.queries.Load()-queries)
+	}
+}
+
+// Concurrent lookups of a name wait for the same query
+func TestLookupCoalesce(t *testing.T) {
+	server := &mockServer{}
+	r, err := New(Config{Servers: []string{server.serve(t)}, Family: FamilyIPv4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error)
+	for i := 0; i < 50; i++ {
+		go func() {
+			_, err := r.LookupIP(context.Background(), "v4.test")
+			errs <- err
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if queries := server.queries.Load(); queries != 1 {
+		t.Fatalf("%d queries", queries)
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	server := &mockServer{}
+	r, err := New(Config{Servers: []string{server.serve(t)}, Family: FamilyIPv4, CacheSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.test", "v4.test", "x.test", "y.test", "z.test"} {
+		r.LookupIP(context.Background(), name)
+	}
+	if len(r.cache) > 3 {
+		t.Fatalf("%d names cached", len(r.cache))
+	}
+}
+
+// Certificate of a test server for 127.0.0.1, and a pool trusting it
+func testCertificate() (tls.Certificate, *x509.CertPool) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return server.TLS.Certificates[0], pool
+}
+
+func TestLookupTLS(t *testing.T) {
+	cert, pool := testCertificate()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go (&mockServer{}).serveStream(listener)
+
+	servers := []string{"tls://" + listener.Addr().String()}
+	r, err := New(Config{Servers: servers, TLSConfig: &tls.Config{RootCAs: pool}, Family: FamilyPreferIPv4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips, err := r.LookupIP(context.Background(), "a.test"); err != nil || len(ips) != 2 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("a.test: %v, %v", ips, err)
+	}
+
+	// Certificates are verified
+	r, err = New(Config{Servers: servers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.LookupIP(context.Background(), "a.test"); err == nil {
+		t.Fatal("untrusted certificate is accepted")
+	}
+}
+
+func TestLookupHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(&mockServer{})
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	r, err := New(Config{Servers: []string{server.URL + "/dns-query"}, TLSConfig: &tls.Config{RootCAs: pool}, Family: FamilyIPv6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips, err := r.LookupIP(context.Background(), "a.test"); err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv6loopback) {
+		t.Fatalf("a.test: %v, %v", ips, err)
+	}
+}
+
+type halfOpenPipe struct {
+	net.Conn
+}
+
+func (p halfOpenPipe) CloseRead() error  { return nil }
+func (p halfOpenPipe) CloseWrite() error { return nil }
+
+// An address which doesn't connect in HappyEyeballsDelay is raced by the next one,
+// and a failed address is followed by the next one at once
+func TestDialParallel(t *testing.T) {
+	r, err := New(Config{HappyEyeballsDelay: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialed := make(chan string, 4)
+	r.dialContext = func(ctx context.Context, ip net.IP, port string, _ *connection.Bind) (net.Conn, error) {
+		dialed <- ip.String()
+		switch ip.String() {
+		case "::1":
+			<-ctx.Done() // Blackholed
+			return nil, ctx.Err()
+		case "::2":
+			return nil, errors.New("refused")
+		}
+		conn, peer := net.Pipe()
+		peer.Close()
+		return halfOpenPipe{conn}, nil
+	}
+	ips := interleave([]net.IP{net.ParseIP("::1"), net.ParseIP("::2"), net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")})
+	start := time.Now()
+	conn, err := r.dialParallel(context.Background(), ips, "80", nil)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if first, second := <-dialed, <-dialed; first != "::1" || second != "10.0.0.1" {
+		t.Fatalf("dialed %s then %s", first, second)
+	}
+	if elapsed < 90*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("connected in %v", elapsed)
+	}
+
+	r.dialContext = func(ctx context.Context, ip net.IP, port string, _ *connection.Bind) (net.Conn, error) {
+		return nil, errors.New("refused " + ip.String())
+	}
+	start = time.Now()
+	if _, err := r.dialParallel(context.Background(), ips, "80", nil); err == nil || err.Error() != "refused ::1" {
+		t.Fatalf("error %v, want the one of the first address", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("failed in %v", elapsed)
+	}
+}
+
+func TestDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	r, err := New(Config{Servers: []string{(&mockServer{}).serve(t)}, Family: FamilyIPv4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := r.Dial(net.JoinHostPort("a.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	var dnsErr *net.DNSError
+	if _, err := r.Dial("nx.test:80"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("nx.test: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// An upstream DNS server, exchange sends a query and returns the response
+type upstream interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+var errResponseID = errors.New("DNS response of another query")
+
+// Parse a server of Config.Servers, which is an address with a scheme of udp, tcp, tls(DoT) or https(DoH).
+// An address without a scheme is taken as udp, the port is the default of the scheme if omitted.
+func parseUpstream(server string, tlsConfig *tls.Config) (upstream, error) {
+	if !strings.Contains(server, "://") {
+		if ip := net.ParseIP(server); ip != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		server = "udp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	address := func(port string) string {
+		if u.Port() != "" {
+			return u.Host
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in DNS server %s", server)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{address: address("53"), fallback: &streamUpstream{address: address("53")}}, nil
+	case "tcp":
+		return &streamUpstream{address: address("53")}, nil
+	case "tls":
+		return &streamUpstream{address: address("853"), tlsConfig: tlsConfig}, nil
+	case "https":
+		return &httpsUpstream{
+			url: u.String(),
+			client: &http.Client{Transport: &http.Transport{
+				Proxy:             http.ProxyFromEnvironment,
+				TLSClientConfig:   tlsConfig,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			}},
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported scheme of DNS server %s", server)
+}
+
+// Set the deadline of conn by ctx
+func setDeadline(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+}
+
+type udpUpstream struct {
+	address  string
+	fallback upstream // Retried with if the response is truncated
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.address
+}
+
+func (u *udpUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	response := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		// Responses of other queries are ignored, they may be spoofed
+		if n < headerSize || !bytes.Equal(response[:2], query[:2]) {
+			continue
+		}
+		if binary.BigEndian.Uint16(response[2:])&flagTruncated != 0 {
+			return u.fallback.exchange(ctx, query)
+		}
+		return response[:n], nil
+	}
+}
+
+// DNS over TCP or TLS, a connection is used for one query
+type streamUpstream struct {
+	address   string
+	tlsConfig *tls.Config // nil for TCP
+}
+
+func (u *streamUpstream) String() string {
+	if u.tlsConfig != nil {
+		return "tls://" + u.address
+	}
+	return "tcp://" + u.address
+}
+
+func (u *streamUpstream) dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	if u.tlsConfig == nil {
+		return dialer.DialContext(ctx, "tcp", u.address)
+	}
+	// TLS is handshaked by the first write, within the deadline
+	conn, err := dialer.DialContext(ctx, "tcp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	config := u.tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(u.address)
+	}
+	return tls.Client(conn, config), nil
+}
+
+func (u *streamUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := u.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+	message := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	copy(message[2:], query)
+	if _, err := conn.Write(message); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	if len(response) < headerSize || !bytes.Equal(response[:2], query[:2]) {
+		return nil, errResponseID
+	}
+	return response, nil
+}
+
+// DNS over HTTPS, RFC 8484
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+func (u *httpsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS status %s", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != dohContentType {
+		return nil, fmt.Errorf("DNS over HTTPS content type %s", contentType)
+	}
+	response, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < headerSize || !bytes.Equal(response[:2], query[:2]) {
+		return nil, errResponseID
+	}
+	return response, nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ihciah/rabbit-tcp/connection"
+)
+
+// BindRule binds connections to destinations matching it
+type BindRule struct {
+	Destinations []string // Patterns of host:port matched by path.Match, or CIDRs matching IP hosts; any destination if empty
+	Bind         connection.Bind
+}
+
+// Policy of dialing out connections requested by peers
+type Policy struct {
+	BindRules []BindRule // The first rule matching a connection applies, connections matching none dial from the default route
+}
+
+// Select the bind of a connection, see connection.BindPolicy
+func (p *Policy) Bind(address string) *connection.Bind {
+	for i := range p.BindRules {
+		if p.BindRules[i].match(address) {
+			return &p.BindRules[i].Bind
+		}
+	}
+	return nil
+}
+
+func (r *BindRule) match(address string) bool {
+	if len(r.Destinations) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	for _, dest := range r.Destinations {
+		if _, network, err := net.ParseCIDR(dest); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+		} else if matched, _ := path.Match(dest, address); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse bind rules separated by semicolon. A rule is comma separated key=value of
+// dest(repeatable, a host:port pattern or CIDR), ip(repeatable, source address), dev(interface) and mark(fwmark, a decimal uint32),
+// eg: dest=*:25,ip=192.0.2.10,ip=2001:db8::10;dest=10.0.0.0/8,dev=wg0,mark=51820
+func ParseBindRules(s string) ([]BindRule, error) {
+	var rules []BindRule
+	for _, ruleString := range strings.Split(s, ";") {
+		if ruleString = strings.TrimSpace(ruleString); ruleString == "" {
+			continue
+		}
+		var rule BindRule
+		for _, field := range strings.Split(ruleString, ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid bind rule field %q", field)
+			}
+			key, value := kv[0], kv[1]
+			switch key {
+			case "dest":
+				if _, _, err := net.ParseCIDR(value); err != nil {
+					if _, err := path.Match(value, ""); err != nil {
+						return nil, fmt.Errorf("invalid bind destination %q: %v", value, err)
+					}
+				}
+				rule.Destinations = append(rule.Destinations, value)
+			case "ip":
+				ip := net.ParseIP(value)
+				if ip == nil {
+					return nil, fmt.Errorf("invalid bind ip %q", value)
+				}
+				rule.Bind.LocalIPs = append(rule.Bind.LocalIPs, ip)
+			case "dev":
+				rule.Bind.Device = value
+			case "mark":
+				mark, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid bind mark %q", value)
+				}
+				rule.Bind.Mark = uint32(mark)
+			default:
+				return nil, fmt.Errorf("unknown bind rule key %q", key)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPolicyBind(t *testing.T) {
+	rules, err := ParseBindRules("dest=*:25,ip=192.0.2.10,ip=2001:db8::10; dest=10.0.0.0/8,dev=wg0,mark=4294967295")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Policy{BindRules: rules}
+	if bind := p.Bind("mail.example.com:25"); bind == nil || len(bind.LocalIPs) != 2 || !bind.LocalIPs[0].Equal(net.ParseIP("192.0.2.10")) {
+		t.Fatalf("mail.example.com:25 bound by %+v", bind)
+	}
+	if bind := p.Bind("10.1.2.3:80"); bind == nil || bind.Device != "wg0" || bind.Mark != 4294967295 {
+		t.Fatalf("10.1.2.3:80 bound by %+v", bind)
+	}
+	// Hosts match CIDRs only if they are IP addresses
+	for _, address := range []string{"example.com:80", "10.example.com:80"} {
+		if bind := p.Bind(address); bind != nil {
+			t.Fatalf("%s bound by %+v", address, bind)
+		}
+	}
+}
+
+func TestParseBindRulesInvalid(t *testing.T) {
+	for _, s := range []string{
+		"dest",
+		"dest=[",
+		"ip=192.0.2",
+		"mark=-1",
+		"mark=4294967296",
+		"mark=0x10",
+		"user=alice",
+	} {
+		if _, err := ParseBindRules(s); err == nil {
+			t.Errorf("%q is accepted", s)
+		}
+	}
+}
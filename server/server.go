@@ -1,7 +1,13 @@
 package server
 
 import (
+	"errors"
+	"github.com/ihciah/rabbit-tcp/accesslog"
+	"github.com/ihciah/rabbit-tcp/bench"
+	"github.com/ihciah/rabbit-tcp/connection"
+	"github.com/ihciah/rabbit-tcp/connection_pool"
 	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
 	"github.com/ihciah/rabbit-tcp/peer"
 	"github.com/ihciah/rabbit-tcp/tunnel"
 	"net"
@@ -9,23 +15,136 @@ import (
 
 type Server struct {
 	peerGroup peer.PeerGroup
+	handler   *connection_pool.Handler
+	listener  *connection_pool.Listener
 	logger    *logger.Logger
 }
 
-func NewServer(cipher tunnel.Cipher) Server {
+// Create a server which dials the requested address for every connection, opts may be nil for defaults
+func NewServer(cipher tunnel.Cipher, opts *options.Options) Server {
+	handler := connection_pool.Handler{
+		Dial:     connection.DialTCP,
+		BindDial: connection.DialTCPBind,
+	}
+	return Server{
+		peerGroup: peer.NewPeerGroup(cipher, &handler, opts),
+		handler:   &handler,
+		logger:    logger.NewLogger("Server"),
+	}
+}
+
+// Create a server which yields connections from Listener instead of dialing,
+// so they can be handled in-process
+func NewListenerServer(cipher tunnel.Cipher, opts *options.Options) Server {
+	listener := connection_pool.NewListener()
+	handler := connection_pool.Handler{
+		Listener: listener,
+	}
 	return Server{
-		peerGroup: peer.NewPeerGroup(cipher),
-		logger:    logger.NewLogger("[Server]"),
+		peerGroup: peer.NewPeerGroup(cipher, &handler, opts),
+		handler:   &handler,
+		listener:  listener,
+		logger:    logger.NewLogger("Server"),
+	}
+}
+
+// Listener returns the listener of a server created by NewListenerServer, or nil
+func (s *Server) Listener() net.Listener {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener
+}
+
+// Listen on addresses requested by clients for reverse forwarding, it must be called before Serve.
+// It's disabled by default, since clients can listen on any port of the server then.
+func (s *Server) EnableListen() {
+	s.handler.AllowListen = true
+}
+
+// Relay UDP datagrams of clients to their destinations, it must be called before Serve.
+// It's disabled by default. Servers created by NewListenerServer don't relay datagrams.
+func (s *Server) EnableDatagram() {
+	if s.listener == nil {
+		s.handler.AllowDatagram = true
+	}
+}
+
+// Refuse more than one tunnel of a client without session resumption, eg: of protocol version 1, it must be
+// called before Serve. Nothing proves such a tunnel is of the peer it claims, so by default a client knowing the
+// password and the peer ID of another one can join its peer and receive a share of its connections.
+// Such clients must run with one tunnel then, see peer.PeerGroup.RefuseUnprovenTunnels.
+func (s *Server) RefuseUnprovenTunnels() {
+	s.peerGroup.RefuseUnprovenTunnels()
+}
+
+// Log connections, reverse listeners and UDP sessions of clients when they end, it must be called before Serve.
+// Connections of a server created by NewListenerServer are logged once closed by the user of its Listener.
+func (s *Server) SetAccessLog(log *accesslog.Logger) {
+	s.handler.AccessLog = log
+}
+
+// Dial the requested address of connections with dial instead of connection.DialTCP, it must be called before Serve
+func (s *Server) SetDial(dial connection.DialFunc) {
+	s.handler.Dial = dial
+}
+
+// Dial connections bound by the policy with dial instead of connection.DialTCPBind, it must be called before Serve
+func (s *Server) SetBindDial(dial connection.BindDialFunc) {
+	s.handler.BindDial = dial
+}
+
+// Dial out connections by policy, it must be called before Serve.
+// Connections of a server created by NewListenerServer are not affected.
+func (s *Server) SetPolicy(policy *Policy) {
+	s.handler.Bind = nil
+	if len(policy.BindRules) > 0 {
+		s.handler.Bind = policy.Bind
 	}
 }
 
+// Serve connections to bench.TargetAddress with an in-process target for `rabbit bench`, it must be called after SetDial
+// and SetBindDial and before Serve. Connections of a server created by NewListenerServer are not affected.
+func (s *Server) EnableBenchTarget() error {
+	listener, err := bench.ListenTarget()
+	if err != nil {
+		return err
+	}
+	go bench.ServeTarget(listener)
+	dial, bindDial, target := s.handler.Dial, s.handler.BindDial, listener.Addr().String()
+	s.handler.Dial = func(address string) (connection.HalfOpenConn, error) {
+		if address == bench.TargetAddress {
+			return connection.DialTCP(target)
+		}
+		return dial(address)
+	}
+	s.handler.BindDial = func(address string, bind *connection.Bind) (connection.HalfOpenConn, error) {
+		if address == bench.TargetAddress {
+			return connection.DialTCP(target)
+		}
+		return bindDial(address, bind)
+	}
+	return nil
+}
+
 func (s *Server) Serve(address string) error {
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
+	return s.ServeListener(listener)
+}
+
+// Like Serve, but accept tunnels from listener, it returns when listener is closed
+func (s *Server) ServeListener(listener net.Listener) error {
+	if s.listener != nil {
+		s.listener.SetAddr(listener.Addr())
+	}
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
 		if err != nil {
 			s.logger.Errorf("Error when accept connection: %v.\n", err)
 			continue
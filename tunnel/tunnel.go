@@ -1,7 +1,6 @@
 package tunnel
 
 import (
-	"bytes"
 	"crypto/cipher"
 	"crypto/rand"
 	"io"
@@ -11,6 +10,9 @@ import (
 // payloadSizeMask is the maximum size of payload in bytes.
 const payloadSizeMask = 0x3FFF // 16*1024 - 1
 
+// MaxPayloadSize is the maximum size of payload sealed in one record, larger writes are split.
+const MaxPayloadSize = payloadSizeMask
+
 type writer struct {
 	io.Writer
 	cipher.AEAD
@@ -31,9 +33,16 @@ func newWriter(w io.Writer, aead cipher.AEAD) *writer {
 }
 
 // Write encrypts b and writes to the embedded io.Writer.
-func (w *writer) Write(b []byte) (int, error) {
-	n, err := w.ReadFrom(bytes.NewBuffer(b))
-	return int(n), err
+func (w *writer) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		nr := copy(w.payloadBuf(), b)
+		b = b[nr:]
+		if err = w.writeRecord(nr); err != nil {
+			break
+		}
+		n += nr
+	}
+	return n, err
 }
 
 // ReadFrom reads from the given io.Reader until EOF or error, encrypts and
@@ -41,23 +50,11 @@ func (w *writer) Write(b []byte) (int, error) {
 // any error encountered.
 func (w *writer) ReadFrom(r io.Reader) (n int64, err error) {
 	for {
-		buf := w.buf
-		payloadBuf := buf[2+w.Overhead() : 2+w.Overhead()+payloadSizeMask]
-		nr, er := r.Read(payloadBuf)
+		nr, er := r.Read(w.payloadBuf())
 
 		if nr > 0 {
 			n += int64(nr)
-			buf = buf[:2+w.Overhead()+nr+w.Overhead()]
-			payloadBuf = payloadBuf[:nr]
-			buf[0], buf[1] = byte(nr>>8), byte(nr) // big-endian payload size
-			w.Seal(buf[:0], w.nonce, buf[:2], nil)
-			increment(w.nonce)
-
-			w.Seal(payloadBuf[:0], w.nonce, payloadBuf, nil)
-			increment(w.nonce)
-
-			_, ew := w.Writer.Write(buf)
-			if ew != nil {
+			if ew := w.writeRecord(nr); ew != nil {
 				err = ew
 				break
 			}
@@ -74,6 +71,26 @@ func (w *writer) ReadFrom(r io.Reader) (n int64, err error) {
 	return n, err
 }
 
+// payloadBuf returns the part of internal buffer where the payload of next record should be put.
+func (w *writer) payloadBuf() []byte {
+	return w.buf[2+w.Overhead() : 2+w.Overhead()+payloadSizeMask]
+}
+
+// writeRecord encrypts nr bytes in payloadBuf as a record and writes to the embedded io.Writer.
+func (w *writer) writeRecord(nr int) error {
+	buf := w.buf[:2+w.Overhead()+nr+w.Overhead()]
+	payloadBuf := w.payloadBuf()[:nr]
+	buf[0], buf[1] = byte(nr>>8), byte(nr) // big-endian payload size
+	w.Seal(buf[:0], w.nonce, buf[:2], nil)
+	increment(w.nonce)
+
+	w.Seal(payloadBuf[:0], w.nonce, payloadBuf, nil)
+	increment(w.nonce)
+
+	_, err := w.Writer.Write(buf)
+	return err
+}
+
 type reader struct {
 	io.Reader
 	cipher.AEAD
@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func benchmarkCipher(b *testing.B) (Cipher, []byte) {
+	ciph, err := NewAEADCipher("CHACHA20-IETF-POLY1305", nil, "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return ciph, make([]byte, ciph.SaltSize())
+}
+
+// Seal records of the maximum payload size
+func BenchmarkWriter(b *testing.B) {
+	ciph, salt := benchmarkCipher(b)
+	aead, err := ciph.Encrypter(salt)
+	if err != nil {
+		b.Fatal(err)
+	}
+	writer := NewWriter(ioutil.Discard, aead)
+	payload := make([]byte, MaxPayloadSize)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := writer.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Open records of the maximum payload size
+func BenchmarkReader(b *testing.B) {
+	ciph, salt := benchmarkCipher(b)
+	encrypter, err := ciph.Encrypter(salt)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var sealed bytes.Buffer
+	payload := make([]byte, MaxPayloadSize)
+	writer := NewWriter(&sealed, encrypter)
+	for i := 0; i < 64; i++ {
+		if _, err := writer.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+	stream := sealed.Bytes()
+
+	// Nonces of a reader must follow the writer, so a new reader starts over with the stream
+	source := bytes.NewReader(nil)
+	var reader io.Reader
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if source.Len() == 0 {
+			source.Reset(stream)
+			decrypter, err := ciph.Decrypter(salt)
+			if err != nil {
+				b.Fatal(err)
+			}
+			reader = NewReader(source, decrypter)
+		}
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package tunnel_pool
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Secret of a peer, agreed by X25519 on the first tunnel of its session and never sent.
+// Tunnels joining the session later prove they know it by HMAC over a challenge of the server.
+const SecretSize = 32
+
+type Secret [SecretSize]byte
+
+const (
+	challengeSize = 32
+	proofSize     = sha256.Size
+	secretInfo    = "rabbit-tcp peer secret"
+)
+
+func newKeyPair() (private, public []byte, err error) {
+	private = make([]byte, curve25519.ScalarSize)
+	if _, err = io.ReadFull(crand.Reader, private); err != nil {
+		return nil, nil, err
+	}
+	public, err = curve25519.X25519(private, curve25519.Basepoint)
+	return private, public, err
+}
+
+// Derive the secret of peerID from an X25519 exchange, challenge makes it unique even if keys are reused
+func deriveSecret(private, remotePublic, challenge []byte, peerID uint32) (Secret, error) {
+	var secret Secret
+	shared, err := curve25519.X25519(private, remotePublic)
+	if err != nil {
+		return secret, err
+	}
+	info := make([]byte, len(secretInfo)+4)
+	copy(info, secretInfo)
+	binary.LittleEndian.PutUint32(info[len(secretInfo):], peerID)
+	_, err = io.ReadFull(hkdf.New(sha256.New, shared, challenge, info), secret[:])
+	return secret, err
+}
+
+// Proof of knowing secret, for a tunnel of peerID answering challenge
+func prove(secret Secret, challenge []byte, peerID uint32) []byte {
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write(challenge)
+	var id [4]byte
+	binary.LittleEndian.PutUint32(id[:], peerID)
+	mac.Write(id[:])
+	return mac.Sum(nil)
+}
+
+func verifyProof(secret Secret, challenge []byte, peerID uint32, proof []byte) bool {
+	return hmac.Equal(prove(secret, challenge, peerID), proof)
+}
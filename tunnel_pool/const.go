@@ -1,9 +1,21 @@
 package tunnel_pool
 
+import (
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/tunnel"
+)
+
 const (
-	ErrorWaitSec          = 3  // If a tunnel cannot be dialed, will wait for this period and retry infinitely
-	TunnelBlockTimeoutSec = 8  // If a tunnel cannot send a block within the limit, will treat it a dead tunnel
-	EmptyPoolDestroySec   = 60 // The pool will be destroyed(server side) if no tunnel dialed in
-	SendQueueSize         = 48 // SendQueue channel cap
-	RecvQueueSize         = 48 // RecvQueue channel cap
+	// Blocks waiting in send queues are packed together up to TunnelBatchSize bytes, so they share
+	// one encrypted record and one syscall. Then the batch waits options.Options.TunnelBatchDelay at most
+	// for more blocks; 0 means only blocks already queued are batched, adding no latency.
+	TunnelBatchSize = tunnel.MaxPayloadSize
+
+	// If resumption is negotiated, blocks received are acknowledged every AckInterval,
+	// or once AckEvery blocks are received
+	AckInterval = 100 * time.Millisecond
+	AckEvery    = 64
+
+	seqSize = 4 // Sequence preceding every block if resumption is negotiated
 )
@@ -0,0 +1,132 @@
+package tunnel_pool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	ProtocolVersion    = 2 // Version 1 is the legacy handshake, which only echoes peer ID
+	MinProtocolVersion = 1 // Peers older than this are refused
+)
+
+// Features are optional parts of the protocol, a tunnel uses those supported by both sides.
+// Bits must never be reused once assigned.
+const (
+	FeatureCompression uint32 = 1 << iota
+	FeatureReset              // Reset blocks, disconnect blocks are sent in place of them otherwise
+	FeatureResume             // Blocks are acknowledged and replayed, so tunnels can reattach to the session of the peer
+)
+
+const SupportedFeatures = FeatureCompression | FeatureReset | FeatureResume
+
+// handshakeMagic is sent in place of peer ID by clients speaking the versioned handshake.
+// Servers of version 1 take it as peer ID and echo it back, which tells the client to fall back.
+const handshakeMagic = 0x2a7ab817
+
+// Client sends handshakeMagic and hello, server replies with its own hello
+const helloSize = 2 + 2 + 4 + 4
+
+// What a legacy peer is taken to send
+var legacyHello = hello{version: 1, minVersion: 1}
+
+var (
+	ErrLegacyPeer      = errors.New("peer only supports legacy handshake")
+	ErrSessionRejected = errors.New("session rejected by peer")
+)
+
+// If FeatureResume is negotiated, server sends a random challenge after hello. Client replies sessionFlag*,
+// an X25519 public key, and the proof of its Secret if it has one. Server replies session* and its public key,
+// which both sides derive the Secret of a new session from.
+const (
+	sessionFlagAlone = 1 << iota // Client has no other tunnel, so tunnels of the session at server side are stale
+	sessionFlagProof             // Client joins its session with a proof
+)
+
+const (
+	sessionNew = iota
+	sessionResumed
+	sessionRejected
+)
+
+// SessionStore keeps sessions of peers for servers
+type SessionStore interface {
+	// Attach a tunnel of peerID to its session if verify accepts the Secret of the session,
+	// or create a session with secret if peerID has none. It returns whether the session existed.
+	Attach(peerID uint32, verify func(Secret) bool, secret Secret, alone bool) (bool, error)
+}
+
+// IncompatibleError is returned by the handshake when version ranges of both sides don't overlap
+type IncompatibleError struct {
+	LocalVersion     uint16
+	LocalMinVersion  uint16
+	RemoteVersion    uint16
+	RemoteMinVersion uint16
+}
+
+func (e *IncompatibleError) Error() string {
+	return fmt.Sprintf("incompatible protocol version(local: %d~%d, remote: %d~%d)",
+		e.LocalMinVersion, e.LocalVersion, e.RemoteMinVersion, e.RemoteVersion)
+}
+
+type hello struct {
+	version    uint16
+	minVersion uint16
+	features   uint32
+	peerID     uint32
+}
+
+// FeatureResume is only offered by tunnels which can attach to sessions
+func localHello(peerID uint32, resumable bool) hello {
+	features := SupportedFeatures
+	if !resumable {
+		features &^= FeatureResume
+	}
+	return hello{
+		version:    ProtocolVersion,
+		minVersion: MinProtocolVersion,
+		features:   features,
+		peerID:     peerID,
+	}
+}
+
+func (h hello) marshal() []byte {
+	buf := make([]byte, helloSize)
+	binary.LittleEndian.PutUint16(buf, h.version)
+	binary.LittleEndian.PutUint16(buf[2:], h.minVersion)
+	binary.LittleEndian.PutUint32(buf[4:], h.features)
+	binary.LittleEndian.PutUint32(buf[8:], h.peerID)
+	return buf
+}
+
+func readHello(reader io.Reader) (hello, error) {
+	buf := make([]byte, helloSize)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return hello{}, err
+	}
+	return hello{
+		version:    binary.LittleEndian.Uint16(buf),
+		minVersion: binary.LittleEndian.Uint16(buf[2:]),
+		features:   binary.LittleEndian.Uint32(buf[4:]),
+		peerID:     binary.LittleEndian.Uint32(buf[8:]),
+	}, nil
+}
+
+// Pick the highest version and features supported by both sides
+func negotiate(local, remote hello) (version uint16, features uint32, err error) {
+	if local.version < remote.minVersion || remote.version < local.minVersion {
+		return 0, 0, &IncompatibleError{
+			LocalVersion:     local.version,
+			LocalMinVersion:  local.minVersion,
+			RemoteVersion:    remote.version,
+			RemoteMinVersion: remote.minVersion,
+		}
+	}
+	version = local.version
+	if remote.version < version {
+		version = remote.version
+	}
+	return version, local.features & remote.features, nil
+}
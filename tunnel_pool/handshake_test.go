@@ -0,0 +1,208 @@
+package tunnel_pool
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		local        hello
+		remote       hello
+		version      uint16
+		features     uint32
+		incompatible bool
+	}{
+		{
+			name:     "same",
+			local:    hello{version: 2, minVersion: 1, features: SupportedFeatures},
+			remote:   hello{version: 2, minVersion: 1, features: SupportedFeatures},
+			version:  2,
+			features: SupportedFeatures,
+		},
+		{
+			name:    "remote newer",
+			local:   hello{version: 2, minVersion: 1},
+			remote:  hello{version: 4, minVersion: 2},
+			version: 2,
+		},
+		{
+			name:    "remote older",
+			local:   hello{version: 3, minVersion: 1},
+			remote:  hello{version: 2, minVersion: 2},
+			version: 2,
+		},
+		{
+			name:     "features of both",
+			local:    hello{version: 2, minVersion: 1, features: FeatureCompression | FeatureReset},
+			remote:   hello{version: 2, minVersion: 1, features: FeatureReset | FeatureResume | 1<<31},
+			version:  2,
+			features: FeatureReset,
+		},
+		{
+			name:    "no common feature",
+			local:   hello{version: 2, minVersion: 1, features: FeatureCompression},
+			remote:  hello{version: 2, minVersion: 1, features: FeatureResume},
+			version: 2,
+		},
+		{
+			name:         "remote too new",
+			local:        hello{version: 2, minVersion: 1, features: SupportedFeatures},
+			remote:       hello{version: 5, minVersion: 3, features: SupportedFeatures},
+			incompatible: true,
+		},
+		{
+			name:         "remote too old",
+			local:        hello{version: 4, minVersion: 3},
+			remote:       hello{version: 2, minVersion: 1},
+			incompatible: true,
+		},
+	} {
+		version, features, err := negotiate(c.local, c.remote)
+		if c.incompatible {
+			var incompatible *IncompatibleError
+			if !errors.As(err, &incompatible) {
+				t.Errorf("%s: error %v, want IncompatibleError", c.name, err)
+				continue
+			}
+			want := IncompatibleError{
+				LocalVersion:     c.local.version,
+				LocalMinVersion:  c.local.minVersion,
+				RemoteVersion:    c.remote.version,
+				RemoteMinVersion: c.remote.minVersion,
+			}
+			if *incompatible != want {
+				t.Errorf("%s: %+v, want %+v", c.name, *incompatible, want)
+			}
+			continue
+		}
+		if err != nil || version != c.version || features != c.features {
+			t.Errorf("%s: version %d, features %#x, error %v, want version %d, features %#x",
+				c.name, version, features, err, c.version, c.features)
+		}
+	}
+}
+
+// Run handshakes of both ends of a loopback TCP connection, whose writes are buffered like on the internet
+func handshakePair(t *testing.T, active, passive func(conn net.Conn) error) (activeErr, passiveErr error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		done <- passive(conn)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeErr = active(conn)
+	conn.Close()
+	return activeErr, <-done
+}
+
+// A server of protocol version 1 echoes the first 4 bytes as peer ID
+func legacyServer(conn net.Conn) error {
+	peerID := make([]byte, 4)
+	if _, err := io.ReadFull(conn, peerID); err != nil {
+		return err
+	}
+	_, err := conn.Write(peerID)
+	return err
+}
+
+// A peer speaking the versioned handshake with the given hello, it sends the magic first if it's a client
+func helloPeer(h hello, client bool) func(conn net.Conn) error {
+	return func(conn net.Conn) error {
+		if client {
+			magic := make([]byte, 4)
+			binary.LittleEndian.PutUint32(magic, handshakeMagic)
+			if _, err := conn.Write(magic); err != nil {
+				return err
+			}
+		}
+		if _, err := conn.Write(h.marshal()); err != nil {
+			return err
+		}
+		if !client {
+			if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+				return err
+			}
+		}
+		_, err := readHello(conn)
+		return err
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	var tun, serverTun Tunnel
+	active := func(conn net.Conn) (err error) {
+		tun, err = NewActiveTunnel(conn, nil, 7)
+		return err
+	}
+	passive := func(conn net.Conn) (err error) {
+		serverTun, err = NewPassiveTunnel(conn, nil)
+		return err
+	}
+
+	activeErr, passiveErr := handshakePair(t, active, passive)
+	if activeErr != nil || passiveErr != nil {
+		t.Fatalf("versioned: %v, %v", activeErr, passiveErr)
+	}
+	// Tunnels which can't attach to sessions don't offer FeatureResume
+	for _, tun := range []Tunnel{tun, serverTun} {
+		if tun.GetVersion() != ProtocolVersion || tun.GetFeatures() != SupportedFeatures&^FeatureResume || tun.GetPeerID() != 7 {
+			t.Fatalf("versioned: version %d, features %#x, peer %d", tun.GetVersion(), tun.GetFeatures(), tun.GetPeerID())
+		}
+	}
+
+	// A legacy client sends peer ID without magic
+	activeErr, passiveErr = handshakePair(t, func(conn net.Conn) (err error) {
+		tun, err = NewLegacyActiveTunnel(conn, nil, 7)
+		return err
+	}, passive)
+	if activeErr != nil || passiveErr != nil {
+		t.Fatalf("legacy client: %v, %v", activeErr, passiveErr)
+	}
+	for _, tun := range []Tunnel{tun, serverTun} {
+		if tun.GetVersion() != 1 || tun.GetFeatures() != 0 || tun.GetPeerID() != 7 {
+			t.Fatalf("legacy client: version %d, features %#x, peer %d", tun.GetVersion(), tun.GetFeatures(), tun.GetPeerID())
+		}
+	}
+
+	// A legacy server echoes the magic, then the client falls back
+	if activeErr, _ = handshakePair(t, active, legacyServer); activeErr != ErrLegacyPeer {
+		t.Fatalf("legacy server: %v, want %v", activeErr, ErrLegacyPeer)
+	}
+	activeErr, passiveErr = handshakePair(t, func(conn net.Conn) (err error) {
+		tun, err = NewLegacyActiveTunnel(conn, nil, 7)
+		return err
+	}, legacyServer)
+	if activeErr != nil || passiveErr != nil || tun.GetVersion() != 1 || tun.GetFeatures() != 0 {
+		t.Fatalf("fallback to legacy server: %v, %v, version %d", activeErr, passiveErr, tun.GetVersion())
+	}
+
+	// Both sides tell incompatible versions
+	var incompatible *IncompatibleError
+	activeErr, _ = handshakePair(t, active, helloPeer(hello{version: 9, minVersion: 5, peerID: 7}, false))
+	if !errors.As(activeErr, &incompatible) || incompatible.RemoteVersion != 9 || incompatible.LocalVersion != ProtocolVersion {
+		t.Fatalf("newer server: %v", activeErr)
+	}
+	_, passiveErr = handshakePair(t, helloPeer(hello{version: 0, minVersion: 0, peerID: 7}, true), passive)
+	if !errors.As(passiveErr, &incompatible) || incompatible.RemoteVersion != 0 || incompatible.LocalMinVersion != MinProtocolVersion {
+		t.Fatalf("older client: %v", passiveErr)
+	}
+}
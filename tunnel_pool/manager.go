@@ -5,7 +5,6 @@ import (
 	"github.com/ihciah/rabbit-tcp/logger"
 	"github.com/ihciah/rabbit-tcp/tunnel"
 	"go.uber.org/atomic"
-	"net"
 	"sync"
 	"time"
 )
@@ -21,6 +20,8 @@ type ClientManager struct {
 	endpoint           string
 	peerID             uint32
 	cipher             tunnel.Cipher
+	legacy             atomic.Bool // Server only supports legacy handshake
+	secret             Secret      // Of the session at server side, guarded by decreaseNotifyLock
 	logger             *logger.Logger
 }
 
@@ -30,7 +31,7 @@ func NewClientManager(tunnelNum int, endpoint string, peerID uint32, cipher tunn
 		endpoint:  endpoint,
 		cipher:    cipher,
 		peerID:    peerID,
-		logger:    logger.NewLogger("[ClientManager]"),
+		logger:    logger.NewLogger("ClientManager"),
 	}
 }
 
@@ -38,7 +39,7 @@ func NewClientManager(tunnelNum int, endpoint string, peerID uint32, cipher tunn
 func (cm *ClientManager) DecreaseNotify(pool *TunnelPool) {
 	cm.decreaseNotifyLock.Lock()
 	defer cm.decreaseNotifyLock.Unlock()
-	tunnelCount := len(pool.tunnelMapping)
+	tunnelCount := pool.TunnelCount()
 
 	for tunnelToCreate := cm.tunnelNum - tunnelCount; tunnelToCreate > 0; {
 		select {
@@ -49,18 +50,37 @@ func (cm *ClientManager) DecreaseNotify(pool *TunnelPool) {
 		}
 
 		cm.logger.Infof("Need %d new tunnels now.\n", tunnelToCreate)
-		conn, err := net.Dial("tcp", cm.endpoint)
+		conn, err := pool.opts.DialTunnel(cm.endpoint)
 		if err != nil {
 			cm.logger.Errorf("Error when dial to %s: %v.\n", cm.endpoint, err)
-			time.Sleep(ErrorWaitSec * time.Second)
+			time.Sleep(pool.opts.ErrorWait)
+			continue
+		}
+		var tun Tunnel
+		if cm.legacy.Load() {
+			tun, err = NewLegacyActiveTunnel(conn, cm.cipher, cm.peerID)
+		} else {
+			tun, err = NewResumableActiveTunnel(conn, cm.cipher, cm.peerID, cm.secret, pool.TunnelCount() == 0)
+		}
+		if err == ErrLegacyPeer {
+			cm.logger.Warnf("Server %s only supports legacy handshake, fall back to it.\n", cm.endpoint)
+			cm.legacy.Store(true)
+			conn.Close()
 			continue
 		}
-		tun, err := NewActiveTunnel(conn, cm.cipher, cm.peerID)
 		if err != nil {
 			cm.logger.Errorf("Error when create active tunnel: %v\n", err)
-			time.Sleep(ErrorWaitSec * time.Second)
+			conn.Close()
+			time.Sleep(pool.opts.ErrorWait)
 			continue
 		}
+		if tun.resumable() {
+			if !tun.resumed && cm.secret != (Secret{}) {
+				// Server has destroyed our session
+				pool.resetSession()
+			}
+			cm.secret = tun.secret
+		}
 		pool.AddTunnel(&tun)
 		tunnelToCreate--
 		cm.logger.Infof("Successfully dialed to %s. TunnelToCreate: %d\n", cm.endpoint, tunnelToCreate)
@@ -79,12 +99,12 @@ type ServerManager struct {
 
 func NewServerManager(removePeerFunc context.CancelFunc) ServerManager {
 	return ServerManager{
-		logger:         logger.NewLogger("[ServerManager]"),
+		logger:         logger.NewLogger("ServerManager"),
 		removePeerFunc: removePeerFunc,
 	}
 }
 
-// If tunnelPool size is zero for more than EmptyPoolDestroySec, delete it
+// If tunnelPool size is zero for more than EmptyPoolDestroy, delete it
 func (sm *ServerManager) Notify(pool *TunnelPool) {
 	tunnelCount := len(pool.tunnelMapping)
 
@@ -95,7 +115,7 @@ func (sm *ServerManager) Notify(pool *TunnelPool) {
 			select {
 			case <-destroyAfterCtx.Done():
 				sm.logger.Debugln("ServerManager notify canceled.")
-			case <-time.After(EmptyPoolDestroySec * time.Second):
+			case <-time.After(pool.opts.EmptyPoolDestroy):
 				sm.logger.Infoln("ServerManager will be destroyed.")
 				sm.removePeerFunc()
 			}
@@ -4,37 +4,56 @@ import (
 	"context"
 	"github.com/ihciah/rabbit-tcp/block"
 	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
+	"go.uber.org/atomic"
 	"sync"
+	"time"
 )
 
 type TunnelPool struct {
 	mutex          sync.Mutex
 	tunnelMapping  map[uint32]*Tunnel
 	peerID         uint32
+	remoteAddr     string // Of the latest tunnel, guarded by mutex
 	manager        Manager
+	opts           *options.Options
 	sendQueue      chan block.Block
 	sendRetryQueue chan block.Block
 	recvQueue      chan block.Block
+	features       atomic.Uint32
+	handshakeOnce  sync.Once
+	handshaked     chan struct{} // Closed when the first tunnel is added
+	session        *session      // Only used if resumption is negotiated
+	ackNeeded      chan struct{}
+	resetHooks     []func() // Guarded by mutex
 	ctx            context.Context
 	cancel         context.CancelFunc // currently useless
 	logger         *logger.Logger
 }
 
-func NewTunnelPool(peerID uint32, manager Manager, peerContext context.Context) *TunnelPool {
+func NewTunnelPool(peerID uint32, manager Manager, opts *options.Options, peerContext context.Context) *TunnelPool {
 	ctx, cancel := context.WithCancel(peerContext)
+	opts = opts.WithDefaults()
 	tp := &TunnelPool{
 		tunnelMapping:  make(map[uint32]*Tunnel),
 		peerID:         peerID,
 		manager:        manager,
-		sendQueue:      make(chan block.Block, SendQueueSize),
-		sendRetryQueue: make(chan block.Block, SendQueueSize),
-		recvQueue:      make(chan block.Block, RecvQueueSize),
+		opts:           opts,
+		sendQueue:      make(chan block.Block, opts.TunnelSendQueueSize),
+		sendRetryQueue: make(chan block.Block, opts.TunnelSendQueueSize),
+		recvQueue:      make(chan block.Block, opts.TunnelRecvQueueSize),
+		handshaked:     make(chan struct{}),
+		session:        newSession(opts.ResumeBufferBlocks),
+		ackNeeded:      make(chan struct{}, 1),
 		ctx:            ctx,
 		cancel:         cancel,
-		logger:         logger.NewLogger("[TunnelPool]"),
+		logger:         logger.NewLogger("TunnelPool").With("peer_id", peerID),
 	}
 	tp.logger.Infof("Tunnel Pool of peer %d created.\n", peerID)
+	// A pool may be created before its first tunnel is added
+	manager.Notify(tp)
 	go manager.DecreaseNotify(tp)
+	go tp.ackRelay()
 	return tp
 }
 
@@ -45,11 +64,21 @@ func (tp *TunnelPool) AddTunnel(tunnel *Tunnel) {
 	defer tp.mutex.Unlock()
 
 	tp.tunnelMapping[tunnel.tunnelID] = tunnel
+	tp.remoteAddr = tunnel.RemoteAddr().String()
 	tp.manager.Notify(tp)
+	// Tunnels of a pool connect the same peer, so the latest handshake is taken
+	tp.features.Store(tunnel.features)
+	tp.handshakeOnce.Do(func() {
+		close(tp.handshaked)
+	})
 
 	tunnel.ctx, tunnel.cancel = context.WithCancel(tp.ctx)
+	tunnel.opts = tp.opts
+	tunnel.pool = tp
 	go func() {
 		<-tunnel.ctx.Done()
+		// Relays of the tunnel stop, and the other side sees it closed when the pool is stopped
+		tunnel.Close()
 		tp.RemoveTunnel(tunnel)
 	}()
 
@@ -67,6 +96,126 @@ func (tp *TunnelPool) RemoveTunnel(tunnel *Tunnel) {
 		tp.manager.Notify(tp)
 		go tp.manager.DecreaseNotify(tp)
 	}
+	if tunnel.resumable() {
+		tp.replay(tunnel.tunnelID)
+	}
+}
+
+// Close all tunnels, blocks not acknowledged are replayed by tunnels added later
+func (tp *TunnelPool) CloseTunnels() {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	for _, tunnel := range tp.tunnelMapping {
+		tunnel.closeThenCancel()
+	}
+}
+
+// Send blocks not acknowledged of a broken tunnel again by other tunnels
+func (tp *TunnelPool) replay(tunnelID uint32) {
+	blocks := tp.session.reclaim(tunnelID)
+	if len(blocks) == 0 {
+		return
+	}
+	tp.logger.Infof("%d blocks of tunnel %d will be replayed.\n", len(blocks), tunnelID)
+	// Use new goroutine to avoid channel blocked
+	go func() {
+		for i, blk := range blocks {
+			select {
+			case tp.sendRetryQueue <- blk:
+			case <-tp.ctx.Done():
+				for _, blk := range blocks[i:] {
+					blk.Release()
+				}
+				return
+			}
+		}
+	}()
+}
+
+// Record a block received with seq, return false if it's received already
+func (tp *TunnelPool) received(seq uint32) bool {
+	ok, pending := tp.session.receive(seq)
+	if pending >= AckEvery {
+		select {
+		case tp.ackNeeded <- struct{}{}:
+		default:
+		}
+	}
+	return ok
+}
+
+// Queue acks for blocks received periodically, or once AckEvery blocks are received
+func (tp *TunnelPool) ackRelay() {
+	ticker := time.NewTicker(AckInterval)
+	defer ticker.Stop()
+	for {
+		min := uint32(1)
+		select {
+		case <-ticker.C:
+		case <-tp.ackNeeded:
+			min = AckEvery
+		case <-tp.ctx.Done():
+			return
+		}
+		if !tp.session.needAck(min) {
+			continue
+		}
+		// The sequence acknowledged is filled when it's sent
+		select {
+		case tp.sendRetryQueue <- block.NewAckBlock(0):
+		case <-tp.ctx.Done():
+			return
+		}
+	}
+}
+
+// Start a new session since the other side has lost ours, connections of the old one are lost too
+func (tp *TunnelPool) resetSession() {
+	tp.logger.Warnln("Session is lost by the other side, start a new one.")
+	tp.CloseTunnels()
+	tp.session.reset()
+	tp.mutex.Lock()
+	hooks := tp.resetHooks
+	tp.mutex.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// Call f when the session is reset, see resetSession
+func (tp *TunnelPool) OnSessionReset(f func()) {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	tp.resetHooks = append(tp.resetHooks, f)
+}
+
+// Whether blocks can neither be sent nor received until a tunnel is added back, which is
+// only possible if resumption is negotiated, otherwise the pool is destroyed without tunnels
+func (tp *TunnelPool) Stalled() bool {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	return tp.features.Load()&FeatureResume != 0 && len(tp.tunnelMapping) == 0
+}
+
+// Wait until the other side acknowledges enough blocks, so more blocks can be kept for replay
+func (tp *TunnelPool) WaitWindow() {
+	tp.session.waitWindow(tp.ctx)
+}
+
+// Number of tunnels in the pool now
+func (tp *TunnelPool) TunnelCount() int {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	return len(tp.tunnelMapping)
+}
+
+// Features supported by the peer, it blocks until the first tunnel is added
+func (tp *TunnelPool) Features() uint32 {
+	select {
+	case <-tp.handshaked:
+	case <-tp.ctx.Done():
+	}
+	return tp.features.Load()
 }
 
 func (tp *TunnelPool) GetSendQueue() chan block.Block {
@@ -76,3 +225,14 @@ func (tp *TunnelPool) GetSendQueue() chan block.Block {
 func (tp *TunnelPool) GetRecvQueue() chan block.Block {
 	return tp.recvQueue
 }
+
+func (tp *TunnelPool) GetPeerID() uint32 {
+	return tp.peerID
+}
+
+// Remote address of the latest tunnel added, or empty if none is added
+func (tp *TunnelPool) GetRemoteAddr() string {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	return tp.remoteAddr
+}
@@ -0,0 +1,187 @@
+package tunnel_pool
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/ihciah/rabbit-tcp/block"
+)
+
+// Sequence numbers compared by serial number arithmetic, 0 is never used
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func nextSeq(seq uint32) uint32 {
+	if seq++; seq == 0 {
+		seq++
+	}
+	return seq
+}
+
+type sentBlock struct {
+	blk      block.Block // Holds a reference of the buffer until acknowledged
+	tunnelID uint32      // 0 if it's being replayed
+}
+
+// session tracks blocks of a tunnel pool when resumption is negotiated: blocks sent are kept
+// until the other side acknowledges them, and blocks received are deduplicated since a replayed
+// block may have been received from a tunnel just broken.
+type session struct {
+	lock      sync.Mutex
+	sendSeq   uint32      // Assigned to the next block sent
+	unacked   []sentBlock // Ordered by sequence
+	windowed  chan struct{}
+	maxBlocks int
+
+	recvSeq   uint32 // All blocks sequenced before it are received
+	received  map[uint32]struct{}
+	ackSeq    uint32 // recvSeq acknowledged lastly
+	ackQueued bool   // An ack is waiting to be sent
+}
+
+func newSession(maxBlocks int) *session {
+	return &session{
+		sendSeq:   1,
+		windowed:  make(chan struct{}),
+		maxBlocks: maxBlocks,
+		recvSeq:   1,
+		received:  make(map[uint32]struct{}),
+		ackSeq:    1,
+	}
+}
+
+// Start over with a new session, blocks kept are dropped
+func (s *session) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, sent := range s.unacked {
+		sent.blk.Release()
+	}
+	s.unacked = nil
+	s.sendSeq = 1
+	s.recvSeq = 1
+	s.received = make(map[uint32]struct{})
+	s.ackSeq = 1
+	s.notify()
+}
+
+// Wake up senders waiting for window, must be called with lock held
+func (s *session) notify() {
+	close(s.windowed)
+	s.windowed = make(chan struct{})
+}
+
+// Wait until fewer than maxBlocks blocks are not acknowledged
+func (s *session) waitWindow(ctx context.Context) {
+	s.lock.Lock()
+	for len(s.unacked) >= s.maxBlocks {
+		windowed := s.windowed
+		s.lock.Unlock()
+		select {
+		case <-windowed:
+		case <-ctx.Done():
+			return
+		}
+		s.lock.Lock()
+	}
+	s.lock.Unlock()
+}
+
+// Assign a sequence to a packed block sent by tunnelID and keep it until acknowledged.
+// Replayed blocks keep their sequences; false is returned if one needn't be sent any more,
+// because it's acknowledged during replay or it's of a session reset.
+func (s *session) track(blk *block.Block, tunnelID uint32) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if blk.Seq == 0 {
+		blk.Seq = s.sendSeq
+		s.sendSeq = nextSeq(s.sendSeq)
+		blk.Retain()
+		s.unacked = append(s.unacked, sentBlock{blk: *blk, tunnelID: tunnelID})
+		return true
+	}
+	i := sort.Search(len(s.unacked), func(i int) bool {
+		return !seqBefore(s.unacked[i].blk.Seq, blk.Seq)
+	})
+	// Blocks kept share the buffer with their replays, which tells replays of another session apart
+	if i < len(s.unacked) && s.unacked[i].blk.Seq == blk.Seq && &s.unacked[i].blk.Pack()[0] == &blk.Pack()[0] {
+		s.unacked[i].tunnelID = tunnelID
+		return true
+	}
+	return false
+}
+
+// Release blocks sequenced before seq
+func (s *session) ack(seq uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	acked := 0
+	for acked < len(s.unacked) && seqBefore(s.unacked[acked].blk.Seq, seq) {
+		s.unacked[acked].blk.Release()
+		acked++
+	}
+	if acked > 0 {
+		s.unacked = append(s.unacked[:0], s.unacked[acked:]...)
+		s.notify()
+	}
+}
+
+// Blocks sent by tunnelID but not acknowledged, in order. Each of them holds a new reference.
+func (s *session) reclaim(tunnelID uint32) []block.Block {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var blocks []block.Block
+	for i := range s.unacked {
+		if s.unacked[i].tunnelID == tunnelID {
+			s.unacked[i].tunnelID = 0
+			s.unacked[i].blk.Retain()
+			blocks = append(blocks, s.unacked[i].blk)
+		}
+	}
+	return blocks
+}
+
+// Record a received block, return false if it's received already.
+// Blocks received but not acknowledged yet are returned too.
+func (s *session) receive(seq uint32) (bool, uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if seqBefore(seq, s.recvSeq) {
+		return false, s.recvSeq - s.ackSeq
+	}
+	if _, ok := s.received[seq]; ok {
+		return false, s.recvSeq - s.ackSeq
+	}
+	s.received[seq] = struct{}{}
+	for {
+		if _, ok := s.received[s.recvSeq]; !ok {
+			break
+		}
+		delete(s.received, s.recvSeq)
+		s.recvSeq = nextSeq(s.recvSeq)
+	}
+	return true, s.recvSeq - s.ackSeq
+}
+
+// Whether an ack should be queued since at least min blocks are received after the last one.
+// It's false if an ack is queued already, which acknowledges the latest when it's sent.
+func (s *session) needAck(min uint32) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ackQueued || s.recvSeq == s.ackSeq || s.recvSeq-s.ackSeq < min {
+		return false
+	}
+	s.ackQueued = true
+	return true
+}
+
+// Sequence acknowledged by an ack being sent
+func (s *session) ackSending() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ackQueued = false
+	s.ackSeq = s.recvSeq
+	return s.ackSeq
+}
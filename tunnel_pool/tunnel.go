@@ -3,12 +3,15 @@ package tunnel_pool
 import (
 	"bytes"
 	"context"
+	crand "crypto/rand"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"github.com/ihciah/rabbit-tcp/block"
+	"github.com/ihciah/rabbit-tcp/fault"
 	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
 	"github.com/ihciah/rabbit-tcp/tunnel"
+	"golang.org/x/crypto/curve25519"
 	"io"
 	"math/rand"
 	"net"
@@ -21,34 +24,237 @@ type Tunnel struct {
 	cancel   context.CancelFunc
 	tunnelID uint32
 	peerID   uint32
+	version  uint16 // Negotiated protocol version
+	features uint32 // Features supported by both sides
+	secret   Secret // Of the session if resumption is negotiated
+	resumed  bool   // The session existed before this tunnel
+	pool     *TunnelPool
+	opts     *options.Options
 	logger   *logger.Logger
+
+	batch    []block.Block // Blocks being sent together, only used by OutboundRelay
+	batchBuf []byte
 }
 
 // Create a new tunnel from a net.Conn and cipher with random tunnelID
 func NewActiveTunnel(conn net.Conn, ciph tunnel.Cipher, peerID uint32) (Tunnel, error) {
+	tun := newTunnelWithID(conn, ciph, peerID)
+	return tun, tun.activeHandshake(false, false)
+}
+
+// Like NewActiveTunnel, but join the session of secret if the server supports resumption, or start a new one
+// if secret is zero. alone tells the server that the peer has no other tunnel.
+func NewResumableActiveTunnel(conn net.Conn, ciph tunnel.Cipher, peerID uint32, secret Secret, alone bool) (Tunnel, error) {
+	tun := newTunnelWithID(conn, ciph, peerID)
+	tun.secret = secret
+	return tun, tun.activeHandshake(true, alone)
+}
+
+// Like NewActiveTunnel, but for servers which return ErrLegacyPeer
+func NewLegacyActiveTunnel(conn net.Conn, ciph tunnel.Cipher, peerID uint32) (Tunnel, error) {
 	tun := newTunnelWithID(conn, ciph, peerID)
 	return tun, tun.activeExchangePeerID()
 }
 
 func NewPassiveTunnel(conn net.Conn, ciph tunnel.Cipher) (Tunnel, error) {
 	tun := newTunnelWithID(conn, ciph, 0)
-	return tun, tun.passiveExchangePeerID()
+	return tun, tun.passiveHandshake(nil)
+}
+
+// Like NewPassiveTunnel, but clients supporting resumption attach to sessions of store
+func NewResumablePassiveTunnel(conn net.Conn, ciph tunnel.Cipher, store SessionStore) (Tunnel, error) {
+	tun := newTunnelWithID(conn, ciph, 0)
+	return tun, tun.passiveHandshake(store)
 }
 
 // Create a new tunnel from a net.Conn and cipher with given tunnelID
 func newTunnelWithID(conn net.Conn, ciph tunnel.Cipher, peerID uint32) Tunnel {
 	tunnelID := rand.Uint32()
 	tun := Tunnel{
-		Conn:     tunnel.NewEncryptedConn(conn, ciph),
+		Conn:     tunnel.NewEncryptedConn(fault.WrapTunnelConn(tunnelID, conn), ciph),
 		peerID:   peerID,
 		tunnelID: tunnelID,
-		logger:   logger.NewLogger(fmt.Sprintf("[Tunnel-%d]", tunnelID)),
+		logger:   logger.NewLogger("Tunnel").With("tunnel_id", tunnelID).With("remote", conn.RemoteAddr().String()),
+	}
+	if peerID != 0 {
+		tun.logger = tun.logger.With("peer_id", peerID)
 	}
 	tun.logger.Infoln("Tunnel created.")
 	return tun
 }
 
+func (tunnel *Tunnel) activeHandshake(resumable, alone bool) (err error) {
+	local := localHello(tunnel.peerID, resumable)
+	if err = tunnel.sendPeerID(handshakeMagic); err == nil {
+		_, err = tunnel.Conn.Write(local.marshal())
+	}
+	if err != nil {
+		tunnel.logger.Errorf("Cannot handshake(send failed: %v).\n", err)
+		return err
+	}
+	magic, err := tunnel.recvPeerID()
+	if err != nil {
+		tunnel.logger.Errorf("Cannot handshake(recv failed: %v).\n", err)
+		return err
+	}
+	if magic == handshakeMagic {
+		// Echoed by a legacy server
+		return ErrLegacyPeer
+	}
+	magicBuffer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(magicBuffer, magic)
+	remote, err := readHello(io.MultiReader(bytes.NewReader(magicBuffer), tunnel.Conn))
+	if err != nil {
+		tunnel.logger.Errorf("Cannot handshake(recv failed: %v).\n", err)
+		return err
+	}
+	if remote.peerID != tunnel.peerID {
+		tunnel.logger.Errorf("Cannot handshake(local peerID: %d, remote: %d).\n", tunnel.peerID, remote.peerID)
+		return errors.New("invalid exchanging")
+	}
+	if err = tunnel.negotiate(local, remote); err != nil || !tunnel.resumable() {
+		return err
+	}
+	return tunnel.activeAttach(alone)
+}
+
+func (tunnel *Tunnel) passiveHandshake(store SessionStore) (err error) {
+	magic, err := tunnel.recvPeerID()
+	if err != nil {
+		tunnel.logger.Errorf("Cannot handshake(recv failed: %v).\n", err)
+		return err
+	}
+	if magic != handshakeMagic {
+		// A legacy client sends its peer ID directly
+		return tunnel.passiveExchangePeerID(magic)
+	}
+	remote, err := readHello(tunnel.Conn)
+	if err != nil {
+		tunnel.logger.Errorf("Cannot handshake(recv failed: %v).\n", err)
+		return err
+	}
+	// Reply even if incompatible, so the client can tell why
+	local := localHello(remote.peerID, store != nil)
+	if _, err = tunnel.Conn.Write(local.marshal()); err != nil {
+		tunnel.logger.Errorf("Cannot handshake(send failed: %v).\n", err)
+		return err
+	}
+	tunnel.peerID = remote.peerID
+	if err = tunnel.negotiate(local, remote); err != nil || !tunnel.resumable() {
+		return err
+	}
+	return tunnel.passiveAttach(store)
+}
+
+// Join the session of tunnel.secret, or start a new one whose secret is kept in tunnel.secret
+func (tunnel *Tunnel) activeAttach(alone bool) error {
+	challenge := make([]byte, challengeSize)
+	if _, err := io.ReadFull(tunnel.Conn, challenge); err != nil {
+		tunnel.logger.Errorf("Cannot attach to session(recv failed: %v).\n", err)
+		return err
+	}
+	private, public, err := newKeyPair()
+	if err != nil {
+		return err
+	}
+	request := make([]byte, 1+curve25519.PointSize+proofSize)
+	if alone {
+		request[0] |= sessionFlagAlone
+	}
+	copy(request[1:], public)
+	if tunnel.secret != (Secret{}) {
+		request[0] |= sessionFlagProof
+		copy(request[1+curve25519.PointSize:], prove(tunnel.secret, challenge, tunnel.peerID))
+	}
+	if _, err = tunnel.Conn.Write(request); err != nil {
+		tunnel.logger.Errorf("Cannot attach to session(send failed: %v).\n", err)
+		return err
+	}
+	reply := make([]byte, 1+curve25519.PointSize)
+	if _, err = io.ReadFull(tunnel.Conn, reply); err != nil {
+		tunnel.logger.Errorf("Cannot attach to session(recv failed: %v).\n", err)
+		return err
+	}
+	switch reply[0] {
+	case sessionNew:
+		if tunnel.secret, err = deriveSecret(private, reply[1:], challenge, tunnel.peerID); err != nil {
+			tunnel.logger.Errorf("Cannot attach to session: %v.\n", err)
+			return err
+		}
+	case sessionResumed:
+		tunnel.resumed = true
+	default:
+		tunnel.logger.Errorln("Cannot attach to session(rejected).")
+		return ErrSessionRejected
+	}
+	tunnel.logger.Infof("Session attached(resumed: %v).\n", tunnel.resumed)
+	return nil
+}
+
+func (tunnel *Tunnel) passiveAttach(store SessionStore) error {
+	challenge := make([]byte, challengeSize)
+	if _, err := io.ReadFull(crand.Reader, challenge); err != nil {
+		return err
+	}
+	if _, err := tunnel.Conn.Write(challenge); err != nil {
+		tunnel.logger.Errorf("Cannot attach to session(send failed: %v).\n", err)
+		return err
+	}
+	request := make([]byte, 1+curve25519.PointSize+proofSize)
+	if _, err := io.ReadFull(tunnel.Conn, request); err != nil {
+		tunnel.logger.Errorf("Cannot attach to session(recv failed: %v).\n", err)
+		return err
+	}
+	private, public, err := newKeyPair()
+	if err != nil {
+		return err
+	}
+	var resumed bool
+	secret, attachErr := deriveSecret(private, request[1:1+curve25519.PointSize], challenge, tunnel.peerID)
+	if attachErr == nil {
+		verify := func(secret Secret) bool {
+			return request[0]&sessionFlagProof != 0 &&
+				verifyProof(secret, challenge, tunnel.peerID, request[1+curve25519.PointSize:])
+		}
+		resumed, attachErr = store.Attach(tunnel.peerID, verify, secret, request[0]&sessionFlagAlone != 0)
+	}
+	reply := make([]byte, 1+curve25519.PointSize)
+	switch {
+	case attachErr != nil:
+		reply[0] = sessionRejected
+	case resumed:
+		reply[0] = sessionResumed
+	default:
+		copy(reply[1:], public)
+	}
+	if _, err = tunnel.Conn.Write(reply); err != nil {
+		tunnel.logger.Errorf("Cannot attach to session(send failed: %v).\n", err)
+		return err
+	}
+	if attachErr != nil {
+		tunnel.logger.Errorf("Cannot attach to session: %v.\n", attachErr)
+		return attachErr
+	}
+	tunnel.resumed = resumed
+	tunnel.logger.Infof("Session attached(resumed: %v).\n", resumed)
+	return nil
+}
+
+func (tunnel *Tunnel) negotiate(local, remote hello) (err error) {
+	tunnel.version, tunnel.features, err = negotiate(local, remote)
+	if err != nil {
+		tunnel.logger.Errorf("Cannot handshake: %v.\n", err)
+		return err
+	}
+	tunnel.logger.Infof("Handshake successfully(version: %d, features: %#x).\n", tunnel.version, tunnel.features)
+	return nil
+}
+
+// Handshake of protocol version 1, which has no feature
 func (tunnel *Tunnel) activeExchangePeerID() (err error) {
+	if err = tunnel.negotiate(localHello(tunnel.peerID, false), legacyHello); err != nil {
+		return err
+	}
 	err = tunnel.sendPeerID(tunnel.peerID)
 	if err != nil {
 		tunnel.logger.Errorf("Cannot exchange peerID(send failed: %v).\n", err)
@@ -67,10 +273,8 @@ func (tunnel *Tunnel) activeExchangePeerID() (err error) {
 	return
 }
 
-func (tunnel *Tunnel) passiveExchangePeerID() (err error) {
-	peerID, err := tunnel.recvPeerID()
-	if err != nil {
-		tunnel.logger.Errorf("Cannot exchange peerID(recv failed: %v).\n", err)
+func (tunnel *Tunnel) passiveExchangePeerID(peerID uint32) (err error) {
+	if err = tunnel.negotiate(localHello(peerID, false), legacyHello); err != nil {
 		return err
 	}
 	err = tunnel.sendPeerID(peerID)
@@ -122,7 +326,8 @@ func (tunnel *Tunnel) OutboundRelay(normalQueue, retryQueue chan block.Block) {
 		case <-tunnel.ctx.Done():
 			return
 		case blk := <-retryQueue:
-			tunnel.packThenSend(blk, retryQueue)
+			tunnel.batchThenSend(blk, normalQueue, retryQueue)
+			continue
 		default:
 		}
 		// normalQueue is of secondary highest priority
@@ -130,71 +335,286 @@ func (tunnel *Tunnel) OutboundRelay(normalQueue, retryQueue chan block.Block) {
 		case <-tunnel.ctx.Done():
 			return
 		case blk := <-retryQueue:
-			tunnel.packThenSend(blk, retryQueue)
+			tunnel.batchThenSend(blk, normalQueue, retryQueue)
 		case blk := <-normalQueue:
-			tunnel.packThenSend(blk, retryQueue)
+			tunnel.batchThenSend(blk, normalQueue, retryQueue)
 		}
 	}
 }
 
-func (tunnel *Tunnel) packThenSend(blk block.Block, retryQueue chan block.Block) {
-	dataToSend := blk.Pack()
-	reader := bytes.NewReader(dataToSend)
+// Pack the block together with blocks following it in queues, then send them at once
+func (tunnel *Tunnel) batchThenSend(blk block.Block, normalQueue, retryQueue chan block.Block) {
+	for {
+		next, ok := tunnel.sendBatch(blk, normalQueue, retryQueue)
+		if !ok {
+			return
+		}
+		// The block which doesn't fit in the last batch starts the next one
+		blk = next
+	}
+}
+
+// Send the block and blocks following it in queues in a batch of at most TunnelBatchSize bytes.
+// If a block taken from queues doesn't fit in the batch, it's returned to be sent by the next batch.
+func (tunnel *Tunnel) sendBatch(blk block.Block, normalQueue, retryQueue chan block.Block) (block.Block, bool) {
+	size := tunnel.batchedSize(&blk)
+	tunnel.batch = append(tunnel.batch[:0], blk)
+	var budget <-chan time.Time
+	if tunnel.opts.TunnelBatchDelay > 0 {
+		timer := time.NewTimer(tunnel.opts.TunnelBatchDelay)
+		defer timer.Stop()
+		budget = timer.C
+	}
+	var overflow block.Block
+	var overflowed bool
+	for size < TunnelBatchSize {
+		next, ok := tunnel.nextBlock(normalQueue, retryQueue, budget)
+		if !ok {
+			break
+		}
+		nextSize := tunnel.batchedSize(&next)
+		if size+nextSize > TunnelBatchSize {
+			overflow, overflowed = next, true
+			break
+		}
+		size += nextSize
+		tunnel.batch = append(tunnel.batch, next)
+	}
 
-	tunnel.Conn.SetWriteDeadline(time.Now().Add(TunnelBlockTimeoutSec * time.Second))
-	n, err := io.Copy(tunnel.Conn, reader)
-	if err != nil || n != int64(len(dataToSend)) {
+	tunnel.Conn.SetWriteDeadline(time.Now().Add(tunnel.opts.TunnelBlockTimeout))
+	n, err := tunnel.writeBatch(size)
+	if err != nil {
 		tunnel.logger.Warnf("Error when send bytes to tunnel: (n: %d, error: %v).\n", n, err)
-		// Tunnel down and message has not been fully sent.
+		// Tunnel down and messages have not been fully sent.
 		tunnel.closeThenCancel()
+		var batch []block.Block
+		for _, blk := range tunnel.batch {
+			if blk.Seq != 0 {
+				// Kept by the session, and replayed along with others sent by this tunnel
+				blk.Release()
+				continue
+			}
+			batch = append(batch, blk)
+		}
+		if overflowed {
+			// Not sent by this tunnel, so it's not replayed even if it's kept by the session
+			batch = append(batch, overflow)
+		}
+		if tunnel.resumable() {
+			tunnel.pool.replay(tunnel.tunnelID)
+		}
+		// Use new goroutine to avoid channel blocked
 		go func() {
-			retryQueue <- blk
+			for _, blk := range batch {
+				retryQueue <- blk
+			}
 		}()
-		// Use new goroutine to avoid channel blocked
-	} else {
-		tunnel.Conn.SetWriteDeadline(time.Time{})
-		tunnel.logger.Debugf("Copied data to tunnel successfully(n: %d).\n", n)
+		tunnel.batch = tunnel.batch[:0]
+		return block.Block{}, false
+	}
+	tunnel.Conn.SetWriteDeadline(time.Time{})
+	tunnel.logger.Debugf("Copied %d blocks to tunnel successfully(n: %d).\n", len(tunnel.batch), n)
+	for _, blk := range tunnel.batch {
+		blk.Release()
+	}
+	tunnel.batch = tunnel.batch[:0]
+	return overflow, overflowed
+}
+
+// Bytes taken by the block in a batch, including the sequence preceding it if resumption is negotiated.
+// The block is packed, so copies of it share the packed buffer.
+func (tunnel *Tunnel) batchedSize(blk *block.Block) int {
+	size := len(blk.Pack())
+	if tunnel.resumable() {
+		size += seqSize
+	}
+	return size
+}
+
+// Get a queued block without blocking, or wait until budget is exceeded if it is not nil
+func (tunnel *Tunnel) nextBlock(normalQueue, retryQueue chan block.Block, budget <-chan time.Time) (block.Block, bool) {
+	select {
+	case blk := <-retryQueue:
+		return blk, true
+	default:
+	}
+	if budget == nil {
+		select {
+		case blk := <-retryQueue:
+			return blk, true
+		case blk := <-normalQueue:
+			return blk, true
+		default:
+			return block.Block{}, false
+		}
+	}
+	select {
+	case blk := <-retryQueue:
+		return blk, true
+	case blk := <-normalQueue:
+		return blk, true
+	case <-budget:
+		return block.Block{}, false
+	case <-tunnel.ctx.Done():
+		return block.Block{}, false
+	}
+}
+
+// Write packed blocks of the batch in as few writes as possible, size is the sum of their batchedSize.
+// If resumption is negotiated, every block is preceded by its sequence, which is 0 for acks.
+func (tunnel *Tunnel) writeBatch(size int) (int, error) {
+	resumable := tunnel.resumable()
+	if len(tunnel.batch) == 1 && !resumable {
+		return tunnel.Conn.Write(tunnel.batch[0].Pack())
+	}
+	if cap(tunnel.batchBuf) < size {
+		tunnel.batchBuf = make([]byte, 0, size)
+	}
+	buf := tunnel.batchBuf[:0]
+	batch := tunnel.batch[:0]
+	for _, blk := range tunnel.batch {
+		if resumable {
+			if blk.Type == block.TypeAck {
+				// Acknowledge the latest received
+				blk.Release()
+				blk = block.NewAckBlock(tunnel.pool.session.ackSending())
+			} else if !tunnel.pool.session.track(&blk, tunnel.tunnelID) {
+				blk.Release()
+				continue
+			}
+			var seq [seqSize]byte
+			binary.LittleEndian.PutUint32(seq[:], blk.Seq)
+			buf = append(buf, seq[:]...)
+		}
+		buf = append(buf, blk.Pack()...)
+		batch = append(batch, blk)
+	}
+	tunnel.batch = batch
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	return tunnel.Conn.Write(buf)
+}
+
+func (tunnel *Tunnel) resumable() bool {
+	return tunnel.features&FeatureResume != 0
+}
+
+// Read the sequence preceding a block if resumption is negotiated
+func (tunnel *Tunnel) readSeq() (uint32, error) {
+	if !tunnel.resumable() {
+		return 0, nil
+	}
+	var seq [seqSize]byte
+	if _, err := io.ReadFull(tunnel.Conn, seq[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(seq[:]), nil
+}
+
+// Read a block, acks are consumed by the pool, so ok is false for them.
+// If resumption is negotiated, the sequence preceding the block is kept in blk.Seq.
+func (tunnel *Tunnel) readBlock(blk *block.Block) (ok bool, err error) {
+	seq, err := tunnel.readSeq()
+	if err != nil {
+		return false, err
+	}
+	if err = block.ReadBlock(tunnel.Conn, blk); err != nil || !tunnel.resumable() {
+		return err == nil, err
+	}
+	if blk.Type == block.TypeAck {
+		tunnel.pool.session.ack(blk.ParseAck())
+		blk.Release()
+		return false, nil
 	}
+	blk.Seq = seq
+	return true, nil
 }
 
 // Read bytes from connection, parse it to block then put in recv channel
 func (tunnel *Tunnel) InboundRelay(output chan<- block.Block) {
 	tunnel.logger.Infoln("Inbound relay started.")
+	if tunnel.resumable() {
+		// Blocks are acknowledged when they are put in output, but acks behind them must be read
+		// even if output is blocked, or both sides may wait for acks from each other.
+		// The other side keeps at most ResumeBufferBlocks blocks not acknowledged, so received is rarely full.
+		received := make(chan block.Block, tunnel.opts.ResumeBufferBlocks)
+		go tunnel.deliver(received, output)
+		defer close(received)
+		output = received
+	}
+	var blk block.Block
 	for {
 		select {
 		case <-tunnel.ctx.Done():
 			// Should read all before leave, or packet will be lost
 			for {
 				// Will never be blocked because the tunnel is closed
-				blk, err := block.NewBlockFromReader(tunnel.Conn)
-				if err == nil {
+				ok, err := tunnel.readBlock(&blk)
+				if ok {
 					tunnel.logger.Debugf("Block received from tunnel(type: %d) successfully after close.\n", blk.Type)
-					output <- *blk
-				} else {
+					output <- blk
+				} else if err != nil {
 					tunnel.logger.Debugf("Error when receiving block from tunnel after close: %v.\n", err)
 					break
 				}
 			}
 			return
 		default:
-			blk, err := block.NewBlockFromReader(tunnel.Conn)
-			if err != nil {
+			ok, err := tunnel.readBlock(&blk)
+			if invalidErr, isInvalid := err.(*block.InvalidBlockError); isInvalid {
+				// Only this tunnel is dropped, other tunnels of the peer are not affected
+				tunnel.logger.Warnf("Malformed block received from tunnel: %v.\n", invalidErr)
+				tunnel.closeThenCancel()
+			} else if err != nil {
 				// Server will never close connection in normal cases
 				tunnel.logger.Errorf("Error when receiving block from tunnel: %v.\n", err)
 				// Tunnel down and message has not been fully read.
 				tunnel.closeThenCancel()
-			} else {
+			} else if ok {
 				tunnel.logger.Debugf("Block received from tunnel(type: %d)successfully.\n", blk.Type)
-				output <- *blk
+				output <- blk
 			}
 		}
 	}
 }
 
+// Put blocks read by a resumable tunnel in output, blocks received already are dropped
+func (tunnel *Tunnel) deliver(received <-chan block.Block, output chan<- block.Block) {
+	for blk := range received {
+		seq := blk.Seq
+		blk.Seq = 0
+		if !tunnel.pool.received(seq) {
+			tunnel.logger.Debugf("Duplicated block %d dropped.\n", seq)
+			blk.Release()
+			continue
+		}
+		output <- blk
+	}
+}
+
 func (tunnel *Tunnel) GetPeerID() uint32 {
 	return tunnel.peerID
 }
 
+func (tunnel *Tunnel) GetVersion() uint16 {
+	return tunnel.version
+}
+
+func (tunnel *Tunnel) GetFeatures() uint32 {
+	return tunnel.features
+}
+
+// Secret of the session, zero if resumption is not negotiated
+func (tunnel *Tunnel) GetSecret() Secret {
+	return tunnel.secret
+}
+
+// Whether the session existed before the tunnel attached to it
+func (tunnel *Tunnel) IsResumed() bool {
+	return tunnel.resumed
+}
+
 func (tunnel *Tunnel) closeThenCancel() {
 	tunnel.Close()
 	tunnel.cancel()
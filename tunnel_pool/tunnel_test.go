@@ -0,0 +1,144 @@
+package tunnel_pool
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ihciah/rabbit-tcp/block"
+	"github.com/ihciah/rabbit-tcp/logger"
+	"github.com/ihciah/rabbit-tcp/options"
+	"github.com/ihciah/rabbit-tcp/tunnel"
+	"go.uber.org/atomic"
+)
+
+// Records sizes of writes
+type writeRecorder struct {
+	net.Conn
+	writes []int
+}
+
+func (w *writeRecorder) Write(b []byte) (int, error) {
+	w.writes = append(w.writes, len(b))
+	return len(b), nil
+}
+
+func (w *writeRecorder) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func newTestTunnel(conn net.Conn) *Tunnel {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Tunnel{
+		Conn:   conn,
+		ctx:    ctx,
+		cancel: cancel,
+		opts:   options.Default(),
+		logger: logger.NewLogger("Tunnel"),
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	conn := &writeRecorder{}
+	tun := newTestTunnel(conn)
+	var blockID atomic.Uint32
+	queue := make(chan block.Block, 64)
+	total := 0
+	for i := 0; i < cap(queue); i++ {
+		blk := block.NewDataBlocks(1, &blockID, make([]byte, 1000+i*37))[0]
+		total += len(blk.Pack())
+		queue <- blk
+	}
+
+	tun.batchThenSend(<-queue, queue, make(chan block.Block))
+	written := 0
+	for _, n := range conn.writes {
+		if n > TunnelBatchSize {
+			t.Errorf("batch of %d bytes exceeds %d", n, TunnelBatchSize)
+		}
+		written += n
+	}
+	if written != total || len(queue) != 0 {
+		t.Fatalf("%d of %d bytes written, %d blocks left", written, total, len(queue))
+	}
+	if len(conn.writes) > total/TunnelBatchSize+2 {
+		t.Fatalf("%d bytes written in %d batches", total, len(conn.writes))
+	}
+}
+
+// Send small blocks through an encrypted loopback TCP connection, one write per block or in batches.
+// The other side decrypts and parses all of them.
+func BenchmarkBatchThenSend(b *testing.B) {
+	for _, bm := range []struct {
+		name    string
+		batched bool
+	}{{"single", false}, {"batched", true}} {
+		b.Run(bm.name, func(b *testing.B) {
+			benchmarkBatchThenSend(b, bm.batched, 256)
+		})
+	}
+}
+
+func benchmarkBatchThenSend(b *testing.B, batched bool, size int) {
+	ciph, err := tunnel.NewAEADCipher("CHACHA20-IETF-POLY1305", nil, "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		reader := tunnel.NewEncryptedConn(conn, ciph)
+		var blk block.Block
+		for i := 0; i < b.N; i++ {
+			if err := block.ReadBlock(reader, &blk); err != nil {
+				done <- err
+				return
+			}
+			blk.Release()
+		}
+		done <- nil
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	tun := newTestTunnel(tunnel.NewEncryptedConn(conn, ciph))
+	defer tun.cancel()
+	normalQueue := make(chan block.Block, tun.opts.TunnelSendQueueSize)
+	if batched {
+		go tun.OutboundRelay(normalQueue, make(chan block.Block))
+	}
+
+	data := make([]byte, size)
+	var blockID atomic.Uint32
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blk := block.NewDataBlocks(1, &blockID, data)[0]
+		if batched {
+			normalQueue <- blk
+			continue
+		}
+		if _, err := tun.Conn.Write(blk.Pack()); err != nil {
+			b.Fatal(err)
+		}
+		blk.Release()
+	}
+	if err := <-done; err != nil && err != io.EOF {
+		b.Fatal(err)
+	}
+}